@@ -0,0 +1,538 @@
+package treeply
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"compress/flate"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// the granularity of the reads made while loading an archive's directory
+const ArchiveIndexChunkSize = 256 * 1024
+
+// the granularity of the reads of a zip member's local header, which is
+// normally much smaller than this
+const ArchiveHeaderChunkSize = 1024
+
+// the number of partially read deflated members whose decompressors are kept
+// open, so that reading the next block carries on where the previous one ended
+const ArchiveMaxIdleStreams = 4
+
+// ArchiveRemoteProvider presents the members of a zip or uncompressed tar
+// file, which is read through another RemoteProvider, as a tree. Only the
+// archive's directory is read up front, and reading a member only fetches
+// that member's byte range.
+type ArchiveRemoteProvider struct {
+	Remote      RemoteProvider
+	ArchivePath string
+
+	lock  sync.Mutex
+	index *archiveIndex
+	// set while the archive's directory is being read
+	loading *indexLoad
+	// decompressors left open after a read, oldest first
+	idleStreams []*deflateStream
+}
+
+// indexLoad is a read of the archive's directory, which callers who need the
+// index while it's in progress wait on rather than starting their own
+type indexLoad struct {
+	// closed once index or err is set
+	done  chan bool
+	index *archiveIndex
+	err   error
+}
+
+type ArchiveRemoteProviderDiagnostics struct {
+	ArchivePath string
+	ArchiveETag string
+	MemberCount int
+	Remote      interface{}
+}
+
+type archiveMember struct {
+	// the offset of the member's data within the archive, or -1 if not yet known
+	dataOffset     int64
+	size           int64
+	compressedSize int64
+	deflated       bool
+	// for zip members, used to look up dataOffset
+	zipFile *zip.File
+}
+
+type archiveIndex struct {
+	archiveETag string
+	members     map[string]*archiveMember
+	dirs        map[string][]RemoteFile
+
+	// guards readerAt and the members' dataOffset
+	lock sync.Mutex
+	// used to read zip members' local headers
+	readerAt *remoteReaderAt
+}
+
+func NewArchiveRemoteProvider(remote RemoteProvider, archivePath string) *ArchiveRemoteProvider {
+	return &ArchiveRemoteProvider{Remote: remote, ArchivePath: archivePath}
+}
+
+func (a *ArchiveRemoteProvider) GetDiagnostics() interface{} {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	diagnostics := &ArchiveRemoteProviderDiagnostics{ArchivePath: a.ArchivePath, Remote: a.Remote.GetDiagnostics()}
+	if a.index != nil {
+		diagnostics.ArchiveETag = a.index.archiveETag
+		diagnostics.MemberCount = len(a.index.members)
+	}
+	return diagnostics
+}
+
+// remoteReaderAt implements io.ReaderAt over a remote file, fetching it in
+// chunks so the many small reads made while parsing a directory don't each
+// turn into a request
+type remoteReaderAt struct {
+	ctx    context.Context
+	remote RemoteProvider
+	path   string
+	etag   string
+	size   int64
+
+	chunkSize  int64
+	chunkStart int64
+	chunk      []byte
+}
+
+func (r *remoteReaderAt) ReadAt(p []byte, off int64) (int, error) {
+	n := 0
+	for n < len(p) {
+		pos := off + int64(n)
+		if pos >= r.size {
+			return n, io.EOF
+		}
+		if pos < r.chunkStart || pos >= r.chunkStart+int64(len(r.chunk)) {
+			err := r.fetchChunk(pos - pos%r.chunkSize)
+			if err != nil {
+				return n, err
+			}
+		}
+		n += copy(p[n:], r.chunk[pos-r.chunkStart:])
+	}
+	return n, nil
+}
+
+func (r *remoteReaderAt) fetchChunk(start int64) error {
+	length := r.chunkSize
+	if start+length > r.size {
+		length = r.size - start
+	}
+	reader, err := r.remote.GetReader(r.ctx, r.path, r.etag, start, length)
+	if err != nil {
+		return err
+	}
+	chunk := make([]byte, length)
+	_, err = io.ReadFull(reader, chunk)
+	if err != nil {
+		return err
+	}
+	r.chunkStart = start
+	r.chunk = chunk
+	return nil
+}
+
+// cleanMemberName normalizes the name of an archive member, returning false
+// if it isn't usable (ie: it escapes the archive)
+func cleanMemberName(name string) (string, bool) {
+	name = strings.Trim(filepath.ToSlash(name), "/")
+	name = strings.TrimPrefix(name, "./")
+	if name == "" || name == "." {
+		return "", false
+	}
+	for _, component := range strings.Split(name, "/") {
+		if component == "" || component == "." || component == ".." {
+			return "", false
+		}
+	}
+	return name, true
+}
+
+// addDir records a directory and all of its parents
+func (index *archiveIndex) addDir(name string) {
+	for name != "" {
+		if _, exists := index.dirs[name]; exists {
+			return
+		}
+		index.dirs[name] = make([]RemoteFile, 0)
+		parent := filepathDir(name)
+		index.dirs[parent] = append(index.dirs[parent], RemoteFile{Name: filepath.Base(name), IsDir: true})
+		name = parent
+	}
+}
+
+func (index *archiveIndex) addMember(name string, member *archiveMember) {
+	if _, exists := index.members[name]; exists {
+		// later copies of a member replace earlier ones, but we only list it once
+		index.members[name] = member
+		return
+	}
+	parent := filepathDir(name)
+	index.addDir(parent)
+	index.members[name] = member
+	var checksum string
+	if member.zipFile != nil {
+		checksum = formatCRC32Checksum(ChecksumCRC32, member.zipFile.CRC32)
+	}
+	index.dirs[parent] = append(index.dirs[parent], RemoteFile{Name: filepath.Base(name), ETag: index.archiveETag, Size: member.size,
+		Checksum: checksum})
+}
+
+// filepathDir returns the parent of a member name, with "" meaning the root
+func filepathDir(name string) string {
+	parent := filepath.Dir(name)
+	if parent == "." {
+		return ""
+	}
+	return parent
+}
+
+func readZipIndex(index *archiveIndex, readerAt io.ReaderAt, size int64) error {
+	zipReader, err := zip.NewReader(readerAt, size)
+	if err != nil {
+		return err
+	}
+
+	for _, f := range zipReader.File {
+		name, ok := cleanMemberName(f.Name)
+		if !ok {
+			continue
+		}
+		if f.FileInfo().IsDir() {
+			index.addDir(name)
+			continue
+		}
+		if f.Method != zip.Store && f.Method != zip.Deflate {
+			log.Printf("Skipping %s which uses unsupported compression method %d", f.Name, f.Method)
+			continue
+		}
+		index.addMember(name, &archiveMember{dataOffset: -1, size: int64(f.UncompressedSize64),
+			compressedSize: int64(f.CompressedSize64), deflated: f.Method == zip.Deflate, zipFile: f})
+	}
+	return nil
+}
+
+func readTarIndex(index *archiveIndex, readerAt io.ReaderAt, size int64) error {
+	// the tar reader seeks past the content of each member, so only the headers get fetched
+	section := io.NewSectionReader(readerAt, 0, size)
+	tarReader := tar.NewReader(section)
+	for {
+		header, err := tarReader.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		name, ok := cleanMemberName(header.Name)
+		if !ok {
+			continue
+		}
+		switch header.Typeflag {
+		case tar.TypeDir:
+			index.addDir(name)
+		case tar.TypeReg:
+			// the reader has consumed exactly the header blocks, so we're at the start of the data
+			dataOffset, err := section.Seek(0, io.SeekCurrent)
+			if err != nil {
+				return err
+			}
+			index.addMember(name, &archiveMember{dataOffset: dataOffset, size: header.Size, compressedSize: header.Size})
+		default:
+			log.Printf("Skipping %s which has unsupported type %c", header.Name, header.Typeflag)
+		}
+	}
+}
+
+// getIndex returns the directory of the archive, reading it if it hasn't been read yet
+func (a *ArchiveRemoteProvider) getIndex(ctx context.Context) (*archiveIndex, error) {
+	a.lock.Lock()
+	if a.index != nil {
+		index := a.index
+		a.lock.Unlock()
+		return index, nil
+	}
+
+	load := a.loading
+	if load == nil {
+		// the directory is read without holding the lock, so a slow remote
+		// doesn't hold up anything which only needs the provider's state
+		load = &indexLoad{done: make(chan bool)}
+		a.loading = load
+		a.lock.Unlock()
+
+		load.index, load.err = a.readIndex(ctx)
+
+		a.lock.Lock()
+		a.loading = nil
+		if load.err == nil {
+			a.index = load.index
+		}
+		a.lock.Unlock()
+		close(load.done)
+	} else {
+		a.lock.Unlock()
+	}
+
+	select {
+	case <-load.done:
+		return load.index, load.err
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// readIndex reads the directory of the archive from the remote
+func (a *ArchiveRemoteProvider) readIndex(ctx context.Context) (*archiveIndex, error) {
+	// find the archive's current ETag and size from its parent's listing
+	parent := filepathDir(a.ArchivePath)
+	files, err := a.Remote.GetDirListing(ctx, parent)
+	if err != nil {
+		return nil, err
+	}
+	var archive *RemoteFile
+	for i := range files {
+		if files[i].Name == filepath.Base(a.ArchivePath) && !files[i].IsDir {
+			archive = &files[i]
+		}
+	}
+	if archive == nil {
+		return nil, fmt.Errorf("Could not find archive %s", a.ArchivePath)
+	}
+
+	readerAt := &remoteReaderAt{ctx: ctx, remote: a.Remote, path: a.ArchivePath, etag: archive.ETag,
+		size: archive.Size, chunkSize: ArchiveIndexChunkSize}
+	index := &archiveIndex{archiveETag: archive.ETag, members: make(map[string]*archiveMember),
+		dirs: map[string][]RemoteFile{"": make([]RemoteFile, 0)}, readerAt: readerAt}
+	if strings.HasSuffix(strings.ToLower(a.ArchivePath), ".tar") {
+		err = readTarIndex(index, readerAt, archive.Size)
+	} else {
+		err = readZipIndex(index, readerAt, archive.Size)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("Could not read archive %s: %w", a.ArchivePath, err)
+	}
+
+	// from now on, the only reads are of individual local headers
+	readerAt.chunkSize = ArchiveHeaderChunkSize
+	readerAt.chunk = nil
+
+	log.Printf("Read %d members from archive %s", len(index.members), a.ArchivePath)
+	return index, nil
+}
+
+// resetIndex discards the directory of the archive so it's read again on next access
+func (a *ArchiveRemoteProvider) resetIndex(index *archiveIndex) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	if a.index == index {
+		a.index = nil
+	}
+	for _, stream := range a.idleStreams {
+		stream.Close()
+	}
+	a.idleStreams = nil
+}
+
+func (a *ArchiveRemoteProvider) GetDirListing(ctx context.Context, path string) ([]RemoteFile, error) {
+	index, err := a.getIndex(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	files, ok := index.dirs[path]
+	if !ok {
+		if _, isMember := index.members[path]; isMember {
+			return nil, IS_NOT_DIR
+		}
+		return nil, INVALID_NAME
+	}
+	return append([]RemoteFile(nil), files...), nil
+}
+
+// getDataOffset returns where the member's data starts, which for zip
+// files requires reading the member's local header
+func (a *ArchiveRemoteProvider) getDataOffset(ctx context.Context, index *archiveIndex, member *archiveMember) (int64, error) {
+	index.lock.Lock()
+	defer index.lock.Unlock()
+
+	if member.dataOffset < 0 {
+		index.readerAt.ctx = ctx
+		dataOffset, err := member.zipFile.DataOffset()
+		if err != nil {
+			return 0, err
+		}
+		member.dataOffset = dataOffset
+	}
+	return member.dataOffset, nil
+}
+
+func (a *ArchiveRemoteProvider) GetReader(ctx context.Context, path string, ETag string, Offset int64, Length int64) (io.Reader, error) {
+	index, err := a.getIndex(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	member, ok := index.members[path]
+	if !ok || index.archiveETag != ETag {
+		return nil, FILE_CHANGED
+	}
+
+	if Offset >= member.size {
+		return strings.NewReader(""), nil
+	}
+	if Offset+Length > member.size {
+		Length = member.size - Offset
+	}
+
+	var reader io.Reader
+	if member.deflated {
+		reader, err = a.getDeflatedReader(ctx, index, member, Offset, Length)
+	} else {
+		var dataOffset int64
+		dataOffset, err = a.getDataOffset(ctx, index, member)
+		if err == nil {
+			reader, err = a.Remote.GetReader(ctx, a.ArchivePath, ETag, dataOffset+Offset, Length)
+		}
+	}
+	if errors.Is(err, FILE_CHANGED) {
+		// the archive was replaced, so the next listing should read the new directory
+		a.resetIndex(index)
+	}
+	return reader, err
+}
+
+// deflateStream is a decompressor part way through a member
+type deflateStream struct {
+	member       *archiveMember
+	decompressor io.ReadCloser
+	// the offset within the uncompressed member of the next byte read
+	position int64
+	// stops the fetch of the compressed data
+	cancel context.CancelFunc
+}
+
+func (s *deflateStream) Close() {
+	s.decompressor.Close()
+	s.cancel()
+}
+
+// takeIdleStream returns the open decompressor of member which is positioned
+// at offset, if there is one
+func (a *ArchiveRemoteProvider) takeIdleStream(member *archiveMember, offset int64) *deflateStream {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	for i, stream := range a.idleStreams {
+		if stream.member == member && stream.position == offset {
+			a.idleStreams = append(a.idleStreams[:i], a.idleStreams[i+1:]...)
+			return stream
+		}
+	}
+	return nil
+}
+
+// putIdleStream keeps stream open for the next read, closing the oldest idle
+// stream if there are too many
+func (a *ArchiveRemoteProvider) putIdleStream(stream *deflateStream) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	a.idleStreams = append(a.idleStreams, stream)
+	if len(a.idleStreams) > ArchiveMaxIdleStreams {
+		a.idleStreams[0].Close()
+		a.idleStreams = a.idleStreams[1:]
+	}
+}
+
+// getDeflatedReader decompresses Length bytes of a member starting at Offset.
+// Deflate streams can't be read from the middle, so the member is fetched in
+// one request and decompressed from the start, and the decompressor is kept
+// open afterwards so reading the following block doesn't start over.
+func (a *ArchiveRemoteProvider) getDeflatedReader(ctx context.Context, index *archiveIndex, member *archiveMember, Offset int64, Length int64) (io.Reader, error) {
+	stream := a.takeIdleStream(member, Offset)
+	if stream == nil {
+		dataOffset, err := a.getDataOffset(ctx, index, member)
+		if err != nil {
+			return nil, err
+		}
+
+		// the stream may outlive this request, so it's cancelled by its own context
+		streamCtx, cancel := context.WithCancel(context.WithoutCancel(ctx))
+		compressed, err := a.Remote.GetReader(streamCtx, a.ArchivePath, index.archiveETag, dataOffset, member.compressedSize)
+		if err != nil {
+			cancel()
+			return nil, err
+		}
+		stream = &deflateStream{member: member, decompressor: flate.NewReader(compressed), cancel: cancel}
+		_, err = io.CopyN(io.Discard, stream.decompressor, Offset)
+		if err != nil {
+			stream.Close()
+			if err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			return nil, err
+		}
+		stream.position = Offset
+	}
+
+	// if this request is abandoned part way, the stream can't be used again
+	stopWatching := context.AfterFunc(ctx, stream.cancel)
+	return &deflateStreamReader{archive: a, stream: stream, bytesRemaining: Length, stopWatching: stopWatching}, nil
+}
+
+// deflateStreamReader reads part of a member from a deflateStream, and hands
+// the stream back to the archive when closed
+type deflateStreamReader struct {
+	archive        *ArchiveRemoteProvider
+	stream         *deflateStream
+	bytesRemaining int64
+	stopWatching   func() bool
+	failed         bool
+}
+
+func (r *deflateStreamReader) Read(buffer []byte) (int, error) {
+	if r.bytesRemaining == 0 {
+		return 0, io.EOF
+	}
+	if int64(len(buffer)) > r.bytesRemaining {
+		buffer = buffer[:r.bytesRemaining]
+	}
+	n, err := r.stream.decompressor.Read(buffer)
+	r.bytesRemaining -= int64(n)
+	r.stream.position += int64(n)
+	if err != nil {
+		r.failed = true
+	}
+	return n, err
+}
+
+func (r *deflateStreamReader) Close() error {
+	if r.stream == nil {
+		return nil
+	}
+	stream := r.stream
+	r.stream = nil
+	if r.stopWatching() && !r.failed && r.bytesRemaining == 0 && stream.position < stream.member.size {
+		r.archive.putIdleStream(stream)
+	} else {
+		stream.Close()
+	}
+	return nil
+}
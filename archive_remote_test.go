@@ -0,0 +1,288 @@
+package treeply
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"context"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type readRange struct {
+	Offset int64
+	Length int64
+}
+
+// RecordingRemoteProvider remembers every range read through it
+type RecordingRemoteProvider struct {
+	RemoteProvider
+	lock  sync.Mutex
+	reads []readRange
+}
+
+func (r *RecordingRemoteProvider) GetReader(ctx context.Context, path string, ETag string, Offset int64, Length int64) (io.Reader, error) {
+	r.lock.Lock()
+	r.reads = append(r.reads, readRange{Offset: Offset, Length: Length})
+	r.lock.Unlock()
+	return r.RemoteProvider.GetReader(ctx, path, ETag, Offset, Length)
+}
+
+func (r *RecordingRemoteProvider) takeReads() []readRange {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	reads := r.reads
+	r.reads = nil
+	return reads
+}
+
+var testArchiveMembers = map[string]string{
+	"a.txt":          strings.Repeat("a", 100),
+	"dir/b.txt":      strings.Repeat("0123456789", 50),
+	"dir/sub/c.txt":  "c",
+	"dir/empty.txt":  "",
+	"other/d.txt":    strings.Repeat("d", 10),
+	"../escaped.txt": "should be ignored",
+}
+
+func writeTestZip(path string) {
+	f, err := os.Create(path)
+	if err != nil {
+		panic(err)
+	}
+	defer f.Close()
+
+	w := zip.NewWriter(f)
+	for _, name := range []string{"a.txt", "dir/b.txt", "dir/sub/c.txt", "dir/empty.txt", "other/d.txt", "../escaped.txt"} {
+		// store some members and compress the others
+		method := zip.Deflate
+		if strings.HasPrefix(name, "dir/") {
+			method = zip.Store
+		}
+		member, err := w.CreateHeader(&zip.FileHeader{Name: name, Method: method})
+		if err != nil {
+			panic(err)
+		}
+		_, err = member.Write([]byte(testArchiveMembers[name]))
+		if err != nil {
+			panic(err)
+		}
+	}
+	err = w.Close()
+	if err != nil {
+		panic(err)
+	}
+}
+
+func writeTestTar(path string) {
+	f, err := os.Create(path)
+	if err != nil {
+		panic(err)
+	}
+	defer f.Close()
+
+	w := tar.NewWriter(f)
+	err = w.WriteHeader(&tar.Header{Name: "dir/", Typeflag: tar.TypeDir, Mode: 0755})
+	if err != nil {
+		panic(err)
+	}
+	for _, name := range []string{"a.txt", "dir/b.txt", "dir/sub/c.txt", "dir/empty.txt", "other/d.txt", "../escaped.txt"} {
+		content := testArchiveMembers[name]
+		err = w.WriteHeader(&tar.Header{Name: name, Typeflag: tar.TypeReg, Mode: 0644, Size: int64(len(content))})
+		if err != nil {
+			panic(err)
+		}
+		_, err = w.Write([]byte(content))
+		if err != nil {
+			panic(err)
+		}
+	}
+	err = w.Close()
+	if err != nil {
+		panic(err)
+	}
+}
+
+func checkArchiveRemote(t *testing.T, archiveName string, writeArchive func(path string)) {
+	tmpDir, err := os.MkdirTemp(os.TempDir(), "test")
+	if err != nil {
+		panic(err)
+	}
+	err = os.Mkdir(tmpDir+"/data", 0777)
+	if err != nil {
+		panic(err)
+	}
+	writeArchive(tmpDir + "/data/" + archiveName)
+
+	ctx := context.Background()
+	recording := &RecordingRemoteProvider{RemoteProvider: &DirRemoteProvider{Root: tmpDir}}
+	archive := NewArchiveRemoteProvider(recording, "data/"+archiveName)
+
+	files, err := archive.GetDirListing(ctx, "")
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"a.txt", "dir/", "other/"}, sortedNames(files))
+
+	files, err = archive.GetDirListing(ctx, "dir")
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"b.txt", "empty.txt", "sub/"}, sortedNames(files))
+
+	_, err = archive.GetDirListing(ctx, "a.txt")
+	assert.Equal(t, IS_NOT_DIR, err)
+	_, err = archive.GetDirListing(ctx, "missing")
+	assert.Equal(t, INVALID_NAME, err)
+
+	var bFile RemoteFile
+	for _, file := range files {
+		if file.Name == "b.txt" {
+			bFile = file
+		}
+	}
+	assert.Equal(t, int64(500), bFile.Size)
+
+	// reading a member should only read a small part of the archive
+	recording.takeReads()
+	reader, err := archive.GetReader(ctx, "dir/b.txt", bFile.ETag, 15, 10)
+	assert.Nil(t, err)
+	buffer, err := io.ReadAll(reader)
+	assert.Nil(t, err)
+	assert.Equal(t, "5678901234", string(buffer))
+	for _, read := range recording.takeReads() {
+		assert.LessOrEqual(t, read.Length, int64(ArchiveHeaderChunkSize))
+	}
+
+	// read through a FileService, which includes the compressed members of the zip
+	workDir, err := os.MkdirTemp(os.TempDir(), "test")
+	if err != nil {
+		panic(err)
+	}
+	fs, err := NewFileService(archive, workDir, 64)
+	if err != nil {
+		panic(err)
+	}
+	client := NewFileClient(fs)
+	for _, name := range []string{"a.txt", "dir/b.txt", "dir/sub/c.txt", "other/d.txt"} {
+		openResp, err := client.Open(&OpenReq{Path: name})
+		assert.Nil(t, err)
+		readResp, err := client.Read(&ReadReq{FD: openResp.FD, Length: len(testArchiveMembers[name])})
+		assert.Nil(t, err)
+		assert.Equal(t, testArchiveMembers[name], string(readResp.Data), name)
+	}
+
+	// once the archive is replaced, reads of the old version should fail
+	writeFile(tmpDir+"/data/"+archiveName, "replaced", 1)
+	_, err = archive.GetReader(ctx, "dir/b.txt", bFile.ETag, 0, 10)
+	assert.Equal(t, FILE_CHANGED, err)
+}
+
+func TestZipArchiveRemote(t *testing.T) {
+	checkArchiveRemote(t, "test.zip", writeTestZip)
+}
+
+func TestTarArchiveRemote(t *testing.T) {
+	checkArchiveRemote(t, "test.tar", writeTestTar)
+}
+
+func TestZipDeflatedMemberReadInBlocks(t *testing.T) {
+	tmpDir, err := os.MkdirTemp(os.TempDir(), "test")
+	if err != nil {
+		panic(err)
+	}
+	writeTestZip(tmpDir + "/test.zip")
+
+	ctx := context.Background()
+	recording := &RecordingRemoteProvider{RemoteProvider: &DirRemoteProvider{Root: tmpDir}}
+	archive := NewArchiveRemoteProvider(recording, "test.zip")
+
+	files, err := archive.GetDirListing(ctx, "")
+	assert.Nil(t, err)
+	var aFile RemoteFile
+	for _, file := range files {
+		if file.Name == "a.txt" {
+			aFile = file
+		}
+	}
+
+	readBlock := func(offset int64, length int64) string {
+		reader, err := archive.GetReader(ctx, "a.txt", aFile.ETag, offset, length)
+		assert.Nil(t, err)
+		buffer, err := io.ReadAll(reader)
+		assert.Nil(t, err)
+		if closer, ok := reader.(io.Closer); ok {
+			closer.Close()
+		}
+		return string(buffer)
+	}
+
+	// reading the member a block at a time should only fetch it once
+	recording.takeReads()
+	var content strings.Builder
+	for offset := int64(0); offset < 100; offset += 10 {
+		content.WriteString(readBlock(offset, 10))
+	}
+	assert.Equal(t, testArchiveMembers["a.txt"], content.String())
+	// one read of the member's local header and one of its data
+	assert.Equal(t, 2, len(recording.takeReads()))
+
+	// reads past the end of the member are empty
+	assert.Equal(t, "", readBlock(100, 10))
+	assert.Equal(t, "", readBlock(200, 10))
+	assert.Equal(t, "aaaaa", readBlock(95, 10))
+}
+
+// BlockingListingRemoteProvider holds every listing until Release is closed
+type BlockingListingRemoteProvider struct {
+	RemoteProvider
+	Release      chan bool
+	listingCount atomic.Int32
+}
+
+func (b *BlockingListingRemoteProvider) GetDirListing(ctx context.Context, path string) ([]RemoteFile, error) {
+	b.listingCount.Add(1)
+	<-b.Release
+	return b.RemoteProvider.GetDirListing(ctx, path)
+}
+
+func TestArchiveIndexReadOnce(t *testing.T) {
+	tmpDir, err := os.MkdirTemp(os.TempDir(), "test")
+	if err != nil {
+		panic(err)
+	}
+	writeTestZip(tmpDir + "/test.zip")
+
+	ctx := context.Background()
+	remote := &BlockingListingRemoteProvider{RemoteProvider: &DirRemoteProvider{Root: tmpDir}, Release: make(chan bool)}
+	archive := NewArchiveRemoteProvider(remote, "test.zip")
+
+	listings := make(chan []string, 2)
+	for i := 0; i < 2; i++ {
+		go (func() {
+			files, err := archive.GetDirListing(ctx, "")
+			assert.Nil(t, err)
+			listings <- sortedNames(files)
+		})()
+	}
+	assert.Eventually(t, func() bool { return remote.listingCount.Load() == 1 }, time.Second, 10*time.Millisecond)
+
+	// while the archive is being read, diagnostics don't wait for it
+	diagnostics := archive.GetDiagnostics().(*ArchiveRemoteProviderDiagnostics)
+	assert.Equal(t, "", diagnostics.ArchiveETag)
+
+	// and a caller which gives up doesn't have to wait either
+	cancelledCtx, cancel := context.WithCancel(ctx)
+	cancel()
+	_, err = archive.GetDirListing(cancelledCtx, "")
+	assert.Equal(t, context.Canceled, err)
+
+	close(remote.Release)
+	for i := 0; i < 2; i++ {
+		assert.Equal(t, []string{"a.txt", "dir/", "other/"}, <-listings)
+	}
+	// both callers shared a single read of the archive
+	assert.Equal(t, int32(1), remote.listingCount.Load())
+}
@@ -0,0 +1,214 @@
+package treeply
+
+import (
+	"bufio"
+	"encoding/json"
+	"log"
+	"os"
+	"strconv"
+)
+
+// The index is an append-only log of which remote block each block file
+// holds. It lives in the blocks directory so that a work directory can be
+// reused across restarts without fetching those blocks again.
+const blockIndexFilename = "index"
+
+// BlockKey identifies a block of a specific version of a remote file
+type BlockKey struct {
+	Path       string
+	ETag       string
+	BlockIndex int
+}
+
+// blockIndexEntry adds a key to a block. A block with several keys has one
+// entry per key. If Deleted is set, the key is removed from the block, or the
+// whole block if there's no key.
+type blockIndexEntry struct {
+	BlockID BlockID
+	Key     *BlockKey `json:",omitempty"`
+	// the hash of the block's contents, if it was stored in content-addressed mode
+	Hash    string `json:",omitempty"`
+	Deleted bool   `json:",omitempty"`
+}
+
+func (b *Blocks) getIndexFilename() string {
+	return b.dir + "/" + blockIndexFilename
+}
+
+func (b *Blocks) appendToIndex(entry *blockIndexEntry) {
+	if b.indexFile == nil {
+		return
+	}
+
+	line, err := json.Marshal(entry)
+	if err != nil {
+		panic(err)
+	}
+	line = append(line, '\n')
+	_, err = b.indexFile.Write(line)
+	if err != nil {
+		log.Printf("Could not write to block index: %s", err)
+	}
+}
+
+// indexedBlock is what the index says about a block once every entry has been applied
+type indexedBlock struct {
+	keys []BlockKey
+	hash string
+}
+
+func readBlockIndex(filename string) (map[BlockID]*indexedBlock, error) {
+	blocks := make(map[BlockID]*indexedBlock)
+
+	f, err := os.Open(filename)
+	if os.IsNotExist(err) {
+		return blocks, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		var entry blockIndexEntry
+		err = json.Unmarshal(scanner.Bytes(), &entry)
+		if err != nil {
+			// most likely the last line was only partially written before we stopped
+			log.Printf("Ignoring corrupt entry in block index: %s", err)
+			continue
+		}
+		if entry.Key == nil {
+			delete(blocks, entry.BlockID)
+			continue
+		}
+
+		block, exists := blocks[entry.BlockID]
+		if !exists {
+			block = &indexedBlock{}
+			blocks[entry.BlockID] = block
+		}
+		keys := make([]BlockKey, 0, len(block.keys)+1)
+		for _, key := range block.keys {
+			if key != *entry.Key {
+				keys = append(keys, key)
+			}
+		}
+		if !entry.Deleted {
+			keys = append(keys, *entry.Key)
+			block.hash = entry.Hash
+		}
+		block.keys = keys
+	}
+
+	// blocks whose keys were all removed can't be looked up
+	for blockID, block := range blocks {
+		if len(block.keys) == 0 {
+			delete(blocks, blockID)
+		}
+	}
+
+	return blocks, scanner.Err()
+}
+
+// loadIndex restores the blocks recorded in the index from a previous run.
+// Block files which are not in the index are deleted, and the index is
+// rewritten to only contain the blocks which remain.
+func (b *Blocks) loadIndex() error {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	indexedBlocks, err := readBlockIndex(b.getIndexFilename())
+	if err != nil {
+		return err
+	}
+
+	entries, err := os.ReadDir(b.dir)
+	if err != nil {
+		return err
+	}
+
+	for _, entry := range entries {
+		if entry.Name() == blockIndexFilename {
+			continue
+		}
+
+		id, err := strconv.ParseUint(entry.Name(), 10, 64)
+		blockID := BlockID(id)
+		indexedBlock, inIndex := indexedBlocks[blockID]
+		if err != nil || !inIndex {
+			log.Printf("Removing unindexed block file %s", entry.Name())
+			err = os.Remove(b.dir + "/" + entry.Name())
+			if err != nil {
+				return err
+			}
+			continue
+		}
+
+		fi, err := entry.Info()
+		if err != nil {
+			return err
+		}
+
+		state := &BlockState{size: fi.Size(), hash: indexedBlock.hash,
+			owners: make(map[INodeBlock]bool), lruElement: b.lru.PushBack(blockID)}
+		b.blockStates[blockID] = state
+		for _, key := range indexedBlock.keys {
+			b.addKeyWithNoLock(blockID, state, key)
+		}
+		if indexedBlock.hash != "" {
+			b.byHash[indexedBlock.hash] = blockID
+		}
+		b.totalBytes += fi.Size()
+		if blockID > b.nextBlockID {
+			b.nextBlockID = blockID
+		}
+	}
+
+	// write out a compacted index with only the blocks we found
+	tmpFilename := b.getIndexFilename() + ".tmp"
+	indexFile, err := os.Create(tmpFilename)
+	if err != nil {
+		return err
+	}
+	b.indexFile = indexFile
+	for blockID, state := range b.blockStates {
+		for _, key := range state.keys {
+			key := key
+			b.appendToIndex(&blockIndexEntry{BlockID: blockID, Key: &key, Hash: state.hash})
+		}
+	}
+	// make sure the compacted index is on disk before it replaces the old one
+	err = indexFile.Sync()
+	if err != nil {
+		return err
+	}
+
+	err = os.Rename(tmpFilename, b.getIndexFilename())
+	if err != nil {
+		return err
+	}
+
+	log.Printf("Loaded %d blocks (%d bytes) from block index", len(b.blockStates), b.totalBytes)
+	return nil
+}
+
+// closeIndex flushes the index to disk and closes it. Blocks cached after
+// this aren't recorded, so will be fetched again after a restart.
+func (b *Blocks) closeIndex() error {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	if b.indexFile == nil {
+		return nil
+	}
+	indexFile := b.indexFile
+	b.indexFile = nil
+
+	err := indexFile.Sync()
+	if err != nil {
+		indexFile.Close()
+		return err
+	}
+	return indexFile.Close()
+}
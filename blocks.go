@@ -1,16 +1,29 @@
 package treeply
 
 import (
+	"container/list"
+	"crypto/sha256"
+	"encoding/hex"
 	"fmt"
+	"io"
 	"log"
 	"os"
 )
 
+func newBlocks(dir string, blockSize int) *Blocks {
+	return &Blocks{nextBlockID: 1, blockStates: map[BlockID]*BlockState{},
+		dir: dir, blockSize: uint64(blockSize), lru: list.New(),
+		byKey: make(map[BlockKey]BlockID), byPath: make(map[string]*pathKeys), byHash: make(map[string]BlockID)}
+}
+
 func (b *Blocks) deleteFile(blockID BlockID) {
 	filename := b.getFilename(blockID)
 	err := os.Remove(filename)
 	if err != nil {
-		log.Fatalf("Could not delete %s: %s", filename, err)
+		// the block is already forgotten, and files which aren't in the index
+		// are removed the next time it's loaded, so this only costs disk space
+		log.Printf("Could not delete %s: %s", filename, err)
+		return
 	}
 	log.Printf("Deleted %s", filename)
 }
@@ -36,7 +49,12 @@ func (b *Blocks) ReadBlock(blockID BlockID, startOffsetWithinBlock int64, buffer
 
 func (b *Blocks) UpdateRefCount(blockID BlockID, delta int) int {
 	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	return b.updateRefCountWithNoLock(blockID, delta)
+}
 
+func (b *Blocks) updateRefCountWithNoLock(blockID BlockID, delta int) int {
 	state, ok := b.blockStates[blockID]
 	if !ok {
 		panic(fmt.Sprintf("accessed invalid block: %d", blockID))
@@ -46,24 +64,442 @@ func (b *Blocks) UpdateRefCount(blockID BlockID, delta int) int {
 	refCount := state.refCount
 	if refCount < 0 {
 		panic("refcount < 0")
-	} else if refCount == 0 {
-		delete(b.blockStates, blockID)
-		b.deleteFile(blockID)
+	} else if refCount == 0 && len(state.keys) == 0 {
+		// blocks with a key stay in the index so they can be reused later,
+		// until they get evicted
+		b.deleteWithNoLock(blockID)
+	} else if delta > 0 {
+		// a new reference means someone is about to read this block
+		b.lru.MoveToBack(state.lruElement)
+	}
+
+	return refCount
+}
+
+func (b *Blocks) deleteWithNoLock(blockID BlockID) {
+	state := b.blockStates[blockID]
+	b.removeKeysWithNoLock(blockID, state)
+	if state.hash != "" && b.byHash[state.hash] == blockID {
+		delete(b.byHash, state.hash)
+	}
+	delete(b.blockStates, blockID)
+	b.lru.Remove(state.lruElement)
+	b.totalBytes -= state.size
+	b.deleteFile(blockID)
+}
+
+// SetMaxBytes sets the size the cache will try to stay under. Zero means no limit.
+func (b *Blocks) SetMaxBytes(maxBytes int64) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	b.maxBytes = maxBytes
+}
+
+// addOwner records that the given inode block now holds a reference to this
+// block. The caller must have already accounted for that reference in the refcount.
+func (b *Blocks) addOwner(blockID BlockID, owner INodeBlock) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	state, ok := b.blockStates[blockID]
+	if !ok {
+		panic(fmt.Sprintf("accessed invalid block: %d", blockID))
+	}
+	state.owners[owner] = true
+}
+
+// releaseOwner drops the reference held by the given inode block
+func (b *Blocks) releaseOwner(blockID BlockID, owner INodeBlock) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	state, ok := b.blockStates[blockID]
+	if !ok {
+		panic(fmt.Sprintf("accessed invalid block: %d", blockID))
+	}
+	delete(state.owners, owner)
+	b.updateRefCountWithNoLock(blockID, -1)
+}
+
+// pin takes an extra reference to the block on behalf of a pinned inode,
+// which keeps it from being evicted until it's unpinned
+func (b *Blocks) pin(blockID BlockID) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	b.pinWithNoLock(blockID)
+}
+
+func (b *Blocks) pinWithNoLock(blockID BlockID) {
+	state, ok := b.blockStates[blockID]
+	if !ok {
+		panic(fmt.Sprintf("accessed invalid block: %d", blockID))
+	}
+	state.pins++
+	if state.pins == 1 {
+		b.pinnedBlocks++
+		b.pinnedBytes += state.size
+	}
+	b.updateRefCountWithNoLock(blockID, 1)
+}
+
+func (b *Blocks) unpin(blockID BlockID) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	b.unpinWithNoLock(blockID)
+}
+
+func (b *Blocks) unpinWithNoLock(blockID BlockID) {
+	state, ok := b.blockStates[blockID]
+	if !ok || state.pins <= 0 {
+		panic(fmt.Sprintf("unpinned block which was not pinned: %d", blockID))
+	}
+	state.pins--
+	if state.pins == 0 {
+		b.pinnedBlocks--
+		b.pinnedBytes -= state.size
+	}
+	b.updateRefCountWithNoLock(blockID, -1)
+}
+
+// pinKeys pins every cached block whose key matches, and returns them so they
+// can be unpinned later. Used to protect the blocks of pinned files after a
+// restart, until the files themselves have been pinned again.
+func (b *Blocks) pinKeys(match func(key BlockKey) bool) []BlockID {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	pinned := make([]BlockID, 0)
+	for blockID, state := range b.blockStates {
+		for _, key := range state.keys {
+			if match(key) {
+				b.pinWithNoLock(blockID)
+				pinned = append(pinned, blockID)
+				break
+			}
+		}
+	}
+	return pinned
+}
+
+// isEvictable returns true if the only references to this block are from the
+// inodes which own it (ie: no reader has it pinned)
+func (state *BlockState) isEvictable() bool {
+	if len(state.owners) == 0 && len(state.keys) == 0 {
+		// allocated but not yet assigned to an inode
+		return false
+	}
+	return state.refCount == len(state.owners)
+}
+
+// getEvictionCandidates returns the least recently used blocks which nobody
+// other than their owning inodes reference, until enough have been selected to
+// bring the cache under its quota. Blocks which are currently pinned by a
+// reader and the block in "keep" are never selected.
+func (b *Blocks) getEvictionCandidates(keep BlockID) []BlockID {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	candidates := make([]BlockID, 0)
+	if b.maxBytes <= 0 {
+		return candidates
+	}
+
+	bytesOverQuota := b.totalBytes - b.maxBytes
+	for e := b.lru.Front(); e != nil && bytesOverQuota > 0; e = e.Next() {
+		blockID := e.Value.(BlockID)
+		state := b.blockStates[blockID]
+		if blockID == keep || !state.isEvictable() {
+			continue
+		}
+		candidates = append(candidates, blockID)
+		bytesOverQuota -= state.size
+	}
+
+	return candidates
+}
+
+// evict deletes the block if it is still evictable, and returns the inode
+// blocks which referenced it so the caller can clear them. Returns false if
+// the block was pinned since being selected for eviction.
+func (b *Blocks) evict(blockID BlockID) ([]INodeBlock, bool) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	state, ok := b.blockStates[blockID]
+	if !ok || !state.isEvictable() {
+		return nil, false
+	}
+
+	owners := make([]INodeBlock, 0, len(state.owners))
+	for owner := range state.owners {
+		owners = append(owners, owner)
+	}
+
+	log.Printf("Evicting block %d", blockID)
+	b.evictions++
+	b.deleteWithNoLock(blockID)
+
+	return owners, true
+}
+
+// SetKey records a remote block which this block holds, so that it can be
+// found again via LookupAndRef, including after a restart. A block shared by
+// several files is indexed under the key of each of them.
+func (b *Blocks) SetKey(blockID BlockID, key BlockKey) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	state, ok := b.blockStates[blockID]
+	if !ok {
+		panic(fmt.Sprintf("accessed invalid block: %d", blockID))
+	}
+
+	if _, exists := b.byKey[key]; exists {
+		// we already have a copy of this block, so don't index this one
+		return
+	}
+
+	b.addKeyWithNoLock(blockID, state, key)
+	b.appendToIndex(&blockIndexEntry{BlockID: blockID, Key: &key, Hash: state.hash})
+
+	// a newer version of the file has been cached, so the blocks of older
+	// ones will never be looked up again
+	if len(b.byPath[key.Path].etags) > 1 {
+		b.removeStaleKeysWithNoLock(key)
+	}
+}
+
+func (b *Blocks) addKeyWithNoLock(blockID BlockID, state *BlockState, key BlockKey) {
+	state.keys = append(state.keys, key)
+	b.byKey[key] = blockID
+
+	paths, ok := b.byPath[key.Path]
+	if !ok {
+		paths = &pathKeys{keys: make(map[BlockKey]bool), etags: make(map[string]int)}
+		b.byPath[key.Path] = paths
+	}
+	paths.keys[key] = true
+	paths.etags[key.ETag]++
+}
+
+func (b *Blocks) unindexKeyWithNoLock(key BlockKey) {
+	delete(b.byKey, key)
+
+	paths := b.byPath[key.Path]
+	delete(paths.keys, key)
+	paths.etags[key.ETag]--
+	if paths.etags[key.ETag] == 0 {
+		delete(paths.etags, key.ETag)
+	}
+	if len(paths.keys) == 0 {
+		delete(b.byPath, key.Path)
 	}
+}
 
+// removeKeysWithNoLock stops the block from being found via any of its keys
+func (b *Blocks) removeKeysWithNoLock(blockID BlockID, state *BlockState) {
+	if len(state.keys) == 0 {
+		return
+	}
+	for _, key := range state.keys {
+		b.unindexKeyWithNoLock(key)
+	}
+	state.keys = nil
+	b.appendToIndex(&blockIndexEntry{BlockID: blockID, Deleted: true})
+}
+
+// removeStaleKeysWithNoLock removes the keys of the same path as latest which
+// have a different ETag. Blocks left without a key are deleted once nothing
+// references them.
+func (b *Blocks) removeStaleKeysWithNoLock(latest BlockKey) {
+	for key := range b.byPath[latest.Path].keys {
+		if key.ETag == latest.ETag {
+			continue
+		}
+
+		key := key
+		blockID := b.byKey[key]
+		state := b.blockStates[blockID]
+		b.unindexKeyWithNoLock(key)
+		keys := make([]BlockKey, 0, len(state.keys))
+		for _, blockKey := range state.keys {
+			if blockKey != key {
+				keys = append(keys, blockKey)
+			}
+		}
+		state.keys = keys
+		b.appendToIndex(&blockIndexEntry{BlockID: blockID, Key: &key, Deleted: true})
+
+		if len(state.keys) == 0 && state.refCount == 0 {
+			log.Printf("Deleting block %d of an old version of %s", blockID, key.Path)
+			b.deleteWithNoLock(blockID)
+		}
+	}
+}
+
+// LookupAndRef finds the block holding the given remote block and takes a
+// reference to it. Returns UNALLOCATED_BLOCK_ID if there is no such block.
+func (b *Blocks) LookupAndRef(key BlockKey) BlockID {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	blockID, ok := b.byKey[key]
+	if !ok {
+		return UNALLOCATED_BLOCK_ID
+	}
+
+	b.updateRefCountWithNoLock(blockID, 1)
+	return blockID
+}
+
+// SetContentAddressed controls whether blocks allocated via AllocateWithHash
+// share a single copy when their contents are identical
+func (b *Blocks) SetContentAddressed(enabled bool) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	b.contentAddressed = enabled
+}
+
+// copyBlock writes the contents of the block to w
+func (b *Blocks) copyBlock(blockID BlockID, w io.Writer) error {
+	f, err := os.Open(b.getFilename(blockID))
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	_, err = io.Copy(w, f)
+	return err
+}
+
+// getHashes returns the hash of every block which has one, and the number of
+// blocks which don't
+func (b *Blocks) getHashes() (map[BlockID]string, int) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	hashes := make(map[BlockID]string)
+	unhashed := 0
+	for blockID, state := range b.blockStates {
+		if state.hash == "" {
+			unhashed++
+			continue
+		}
+		hashes[blockID] = state.hash
+	}
+	return hashes, unhashed
+}
+
+// refWithHash takes a reference to the block if it still exists with the given hash
+func (b *Blocks) refWithHash(blockID BlockID, hash string) bool {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	state, ok := b.blockStates[blockID]
+	if !ok || state.hash != hash {
+		return false
+	}
+	b.updateRefCountWithNoLock(blockID, 1)
+	return true
+}
+
+// discard removes the block from the index so that it's never reused, and
+// returns the inode blocks which own it so the caller can release them. The
+// block is deleted once the last reference to it is dropped. Returns the
+// size of the block.
+func (b *Blocks) discard(blockID BlockID) ([]INodeBlock, int64) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	state, ok := b.blockStates[blockID]
+	if !ok {
+		return nil, 0
+	}
+
+	log.Printf("Discarding block %d", blockID)
+	b.removeKeysWithNoLock(blockID, state)
+	if state.hash != "" && b.byHash[state.hash] == blockID {
+		delete(b.byHash, state.hash)
+	}
+	state.hash = ""
+
+	owners := make([]INodeBlock, 0, len(state.owners))
+	for owner := range state.owners {
+		owners = append(owners, owner)
+	}
+	if state.refCount == 0 {
+		// cached, but not in use by anyone
+		b.deleteWithNoLock(blockID)
+	}
+	return owners, state.size
+}
+
+// hashBlockFile returns the hex encoded sha256 of the file's contents
+func hashBlockFile(filename string) (string, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	hash := sha256.New()
+	_, err = io.Copy(hash, f)
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+// AllocateWithHash is like Allocate, but records the hash of the block's
+// contents so that it can be checked later by Verify. When content addressed,
+// if there is already a block with the same hash, the file is deleted and a
+// new reference to the existing block is returned instead.
+func (b *Blocks) AllocateWithHash(filename string, hash string) (BlockID, error) {
+	b.lock.Lock()
+	if blockID, exists := b.byHash[hash]; exists && b.contentAddressed {
+		state := b.blockStates[blockID]
+		b.updateRefCountWithNoLock(blockID, 1)
+		b.dedupedBlocks++
+		b.dedupedBytes += state.size
+		b.lock.Unlock()
+
+		log.Printf("%s is identical to block %d", filename, blockID)
+		err := os.Remove(filename)
+		if err != nil {
+			log.Printf("Could not delete %s: %s", filename, err)
+		}
+		return blockID, nil
+	}
 	b.lock.Unlock()
 
-	return refCount
+	blockID, err := b.Allocate(filename)
+	if err != nil {
+		return UNALLOCATED_BLOCK_ID, err
+	}
+
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	b.blockStates[blockID].hash = hash
+	if _, exists := b.byHash[hash]; !exists {
+		b.byHash[hash] = blockID
+	}
+	return blockID, nil
 }
 
-func (b *Blocks) Allocate(filename string) BlockID {
+// Allocate moves the file into the cache as a new block, with a single
+// reference held by the caller. On failure, the file is left where it is.
+func (b *Blocks) Allocate(filename string) (BlockID, error) {
 	fi, err := os.Stat(filename)
 	if err != nil {
-		panic(err)
+		return UNALLOCATED_BLOCK_ID, &CacheError{Op: "stat", Filename: filename, Err: err}
 	}
 
 	if fi.Size() > int64(b.blockSize) {
-		panic("too big")
+		return UNALLOCATED_BLOCK_ID, BLOCK_TOO_BIG
 	}
 
 	b.lock.Lock()
@@ -76,15 +512,23 @@ func (b *Blocks) Allocate(filename string) BlockID {
 		b.nextBlockID += 1
 		blockID = b.nextBlockID
 	}
-	b.blockStates[blockID] = &BlockState{refCount: 1}
+	b.blockStates[blockID] = &BlockState{refCount: 1, size: fi.Size(),
+		owners: make(map[INodeBlock]bool), lruElement: b.lru.PushBack(blockID)}
+	b.totalBytes += fi.Size()
 	b.lock.Unlock()
 
 	destName := b.getFilename(blockID)
 	log.Printf("Renaming %s -> %s", filename, destName)
 	err = os.Rename(filename, destName)
 	if err != nil {
-		panic("rename failed")
+		b.lock.Lock()
+		state := b.blockStates[blockID]
+		delete(b.blockStates, blockID)
+		b.lru.Remove(state.lruElement)
+		b.totalBytes -= state.size
+		b.lock.Unlock()
+		return UNALLOCATED_BLOCK_ID, &CacheError{Op: "rename", Filename: filename, Err: err}
 	}
 
-	return blockID
+	return blockID, nil
 }
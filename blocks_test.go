@@ -0,0 +1,203 @@
+package treeply
+
+import (
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBlockCacheEviction(t *testing.T) {
+	workDir, err := os.MkdirTemp(os.TempDir(), "test")
+	if err != nil {
+		panic(err)
+	}
+
+	inodes, err := NewINodes(workDir, 3)
+	if err != nil {
+		panic(err)
+	}
+	// only allow two blocks to be cached
+	inodes.SetMaxCacheBytes(6)
+
+	source := []byte("abcdefghijk")
+	requests := make(map[int]int)
+	requestCallback := func(inode INode, blockIndices []int, priority Priority) error {
+		for _, index := range blockIndices {
+			requests[index]++
+
+			end := (index + 1) * 3
+			if end > len(source) {
+				end = len(source)
+			}
+
+			f, err := os.CreateTemp(inodes.workDir, "block")
+			if err != nil {
+				panic(err)
+			}
+			f.Write(source[index*3 : end])
+			f.Close()
+
+			blockID, err := inodes.blocks.Allocate(f.Name())
+			if err != nil {
+				return err
+			}
+			err = inodes.SetBlock(inode, index, blockID)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	sampleInode := inodes.CreateLazyFile(int64(len(source)), "", requestCallback)
+
+	// read the whole file a few bytes at a time
+	for offset := 0; offset < len(source); offset += 2 {
+		length := 2
+		if offset+length > len(source) {
+			length = len(source) - offset
+		}
+		buffer := make([]byte, length)
+		n, err := inodes.ReadFile(sampleInode, int64(offset), buffer)
+		assert.Nil(t, err)
+		assert.Equal(t, length, n)
+		assert.Equal(t, source[offset:offset+length], buffer)
+	}
+
+	diag := inodes.blocks.GetDiagnostics()
+	assert.LessOrEqual(t, diag.BytesInUse, int64(6))
+	assert.Equal(t, 2, diag.BlocksInUse)
+	assert.Equal(t, 2, diag.Evictions)
+	assert.Equal(t, 1, requests[0])
+
+	// the first block was evicted, so reading it again should refetch it
+	buffer := make([]byte, 4)
+	n, err := inodes.ReadFile(sampleInode, 0, buffer)
+	assert.Nil(t, err)
+	assert.Equal(t, 4, n)
+	assert.Equal(t, []byte("abcd"), buffer)
+	assert.Equal(t, 2, requests[0])
+	assert.Equal(t, 2, requests[1])
+
+	// a read spanning more blocks than the quota should still succeed
+	buffer = make([]byte, len(source))
+	n, err = inodes.ReadFile(sampleInode, 0, buffer)
+	assert.Nil(t, err)
+	assert.Equal(t, len(source), n)
+	assert.Equal(t, source, buffer)
+
+	inodes.UpdateRefCount(sampleInode, -1)
+	assert.Equal(t, 0, len(inodes.blocks.blockStates))
+	assert.Equal(t, int64(0), inodes.blocks.GetDiagnostics().BytesInUse)
+}
+
+func TestContentAddressedBlocks(t *testing.T) {
+	workDir, err := os.MkdirTemp(os.TempDir(), "test")
+	if err != nil {
+		panic(err)
+	}
+
+	tmpDir, err := os.MkdirTemp(os.TempDir(), "test")
+	if err != nil {
+		panic(err)
+	}
+
+	// the same file under two versions of a dataset, plus one that differs
+	writeFile(tmpDir+"/v1/data", "0123456789", 2)
+	writeFile(tmpDir+"/v2/data", "0123456789", 2)
+	writeFile(tmpDir+"/v2/other", "abcdefghij", 2)
+	writeFile(tmpDir+"/v3/data", "0123456789", 2)
+
+	readAll := func(fs *FileService, path string) string {
+		inode, err := fs.GetINodeForPath(path)
+		assert.Nil(t, err)
+		defer fs.INodes.UpdateRefCount(inode, -1)
+
+		buffer := make([]byte, 20)
+		n, err := fs.INodes.ReadFile(inode, 0, buffer)
+		assert.Nil(t, err)
+		return string(buffer[:n])
+	}
+
+	fs, err := NewFileService(&DirRemoteProvider{Root: tmpDir}, workDir, 10)
+	if err != nil {
+		panic(err)
+	}
+	fs.INodes.SetContentAddressed(true)
+
+	assert.Equal(t, "01234567890123456789", readAll(fs, "v1/data"))
+	assert.Equal(t, "01234567890123456789", readAll(fs, "v2/data"))
+	assert.Equal(t, "abcdefghijabcdefghij", readAll(fs, "v2/other"))
+
+	// each distinct block is only stored once, even within the same file
+	diagnostics := fs.INodes.blocks.GetDiagnostics()
+	assert.Equal(t, 2, diagnostics.BlocksInUse)
+	assert.Equal(t, int64(20), diagnostics.BytesInUse)
+	assert.Equal(t, 4, diagnostics.DedupedBlocks)
+	assert.Equal(t, int64(40), diagnostics.DedupedBytes)
+	assert.Equal(t, 3.0, diagnostics.DedupRatio)
+
+	// the hashes are kept across restarts, so new copies are still deduplicated
+	remote := &CountingRemoteProvider{RemoteProvider: &DirRemoteProvider{Root: tmpDir}}
+	fs, err = NewFileService(remote, workDir, 10)
+	if err != nil {
+		panic(err)
+	}
+	fs.INodes.SetContentAddressed(true)
+
+	// and shared blocks can be found under the key of every file which used them
+	assert.Equal(t, "01234567890123456789", readAll(fs, "v2/data"))
+	assert.Equal(t, 0, int(remote.readerCount.Load()))
+
+	assert.Equal(t, "01234567890123456789", readAll(fs, "v3/data"))
+	diagnostics = fs.INodes.blocks.GetDiagnostics()
+	assert.Equal(t, 2, diagnostics.BlocksInUse)
+	assert.Equal(t, 2, diagnostics.DedupedBlocks)
+}
+
+func TestBlockErrors(t *testing.T) {
+	workDir, err := os.MkdirTemp(os.TempDir(), "test")
+	if err != nil {
+		panic(err)
+	}
+
+	inodes, err := NewINodes(workDir, 4)
+	if err != nil {
+		panic(err)
+	}
+
+	// a block larger than the block size is rejected, and left in place
+	filename := workDir + "/big"
+	writeFile(filename, "0123456789", 1)
+	_, err = inodes.blocks.Allocate(filename)
+	assert.Equal(t, BLOCK_TOO_BIG, err)
+	_, err = os.Stat(filename)
+	assert.Nil(t, err)
+
+	var cacheErr *CacheError
+	_, err = inodes.blocks.Allocate(workDir + "/missing")
+	assert.ErrorAs(t, err, &cacheErr)
+	assert.True(t, os.IsNotExist(cacheErr.Err))
+
+	// unknown inodes are reported rather than crashing
+	writeFile(filename, "0123", 1)
+	blockID, err := inodes.blocks.Allocate(filename)
+	assert.Nil(t, err)
+	assert.Equal(t, INVALID_INODE, inodes.SetBlock(100, 0, blockID))
+	_, err = inodes.GetBlockIDs(100, 0, 1)
+	assert.Equal(t, INVALID_INODE, err)
+	_, err = inodes.IsDirPopulated(100)
+	assert.Equal(t, INVALID_INODE, err)
+
+	// as are reads of blocks past the end of a file
+	inode := inodes.CreateLazyFile(4, "", func(inode INode, blockIndices []int, priority Priority) error { return nil })
+	_, err = inodes.GetBlockIDs(inode, 1, 1)
+	assert.Equal(t, INVALID_OFFSET, err)
+	_, err = inodes.IsBlockPopulated(inode, 1)
+	assert.Equal(t, INVALID_OFFSET, err)
+
+	// and a callback which never populates the block fails the read
+	buffer := make([]byte, 4)
+	_, err = inodes.ReadFile(inode, 0, buffer)
+	assert.Equal(t, BLOCK_NOT_POPULATED, err)
+}
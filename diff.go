@@ -0,0 +1,151 @@
+package treeply
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+	"time"
+)
+
+// ManifestChange describes how a single path differs between two manifests.
+// Old is nil for added paths, and New is nil for removed ones.
+type ManifestChange struct {
+	Path string
+	Old  *ManifestEntry `json:",omitempty"`
+	New  *ManifestEntry `json:",omitempty"`
+}
+
+// ManifestDiff lists the files which differ between two trees, each ordered by path
+type ManifestDiff struct {
+	Added    []ManifestChange
+	Removed  []ManifestChange
+	Modified []ManifestChange
+}
+
+func (d *ManifestDiff) IsEmpty() bool {
+	return len(d.Added) == 0 && len(d.Removed) == 0 && len(d.Modified) == 0
+}
+
+// DiffManifests compares the files in two manifests. A file is modified if
+// its ETag or size changed, or if it was replaced by a directory or vice
+// versa. Directories are only compared by the files within them.
+func DiffManifests(oldManifest *Manifest, newManifest *Manifest) *ManifestDiff {
+	oldEntries := make(map[string]*ManifestEntry)
+	for i := range oldManifest.Entries {
+		oldEntries[oldManifest.Entries[i].Path] = &oldManifest.Entries[i]
+	}
+	newEntries := make(map[string]*ManifestEntry)
+	for i := range newManifest.Entries {
+		newEntries[newManifest.Entries[i].Path] = &newManifest.Entries[i]
+	}
+
+	diff := &ManifestDiff{Added: make([]ManifestChange, 0), Removed: make([]ManifestChange, 0),
+		Modified: make([]ManifestChange, 0)}
+
+	for path, newEntry := range newEntries {
+		oldEntry, existed := oldEntries[path]
+		if !existed {
+			if !newEntry.IsDir {
+				diff.Added = append(diff.Added, ManifestChange{Path: path, New: newEntry})
+			}
+		} else if oldEntry.IsDir != newEntry.IsDir || (!newEntry.IsDir && (oldEntry.ETag != newEntry.ETag || oldEntry.Size != newEntry.Size)) {
+			diff.Modified = append(diff.Modified, ManifestChange{Path: path, Old: oldEntry, New: newEntry})
+		}
+	}
+	for path, oldEntry := range oldEntries {
+		if _, exists := newEntries[path]; !exists && !oldEntry.IsDir {
+			diff.Removed = append(diff.Removed, ManifestChange{Path: path, Old: oldEntry})
+		}
+	}
+
+	for _, changes := range [][]ManifestChange{diff.Added, diff.Removed, diff.Modified} {
+		sort.Slice(changes, func(i, j int) bool { return changes[i].Path < changes[j].Path })
+	}
+	return diff
+}
+
+// WalkRemote builds a manifest by listing the remote directly, without
+// going through a FileService
+func WalkRemote(ctx context.Context, remote RemoteProvider, path string) (*Manifest, error) {
+	manifest := &Manifest{Version: ManifestVersion, Root: path, CreatedAt: time.Now().UTC(),
+		Entries: make([]ManifestEntry, 0)}
+	err := walkRemoteDir(ctx, remote, path, "", manifest)
+	if err != nil {
+		return nil, err
+	}
+
+	sort.Slice(manifest.Entries, func(i, j int) bool { return manifest.Entries[i].Path < manifest.Entries[j].Path })
+	return manifest, nil
+}
+
+func walkRemoteDir(ctx context.Context, remote RemoteProvider, remotePath string, dirPath string, manifest *Manifest) error {
+	var files []RemoteFile
+	err := DefaultRetryPolicy.Retry(ctx, func(ctx context.Context) error {
+		var err error
+		files, err = remote.GetDirListing(ctx, remotePath)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+
+	for _, file := range files {
+		childPath := pathConcat(dirPath, file.Name)
+		if file.IsDir {
+			manifest.Entries = append(manifest.Entries, ManifestEntry{Path: childPath, IsDir: true})
+			err = walkRemoteDir(ctx, remote, pathConcat(remotePath, file.Name), childPath, manifest)
+			if err != nil {
+				return err
+			}
+		} else {
+			manifest.Entries = append(manifest.Entries, ManifestEntry{Path: childPath, Size: file.Size, ETag: file.ETag})
+		}
+	}
+	return nil
+}
+
+// DiffManifestWithRemote compares a manifest against the current state of the
+// remote, under the same root as the manifest
+func DiffManifestWithRemote(ctx context.Context, manifest *Manifest, remote RemoteProvider) (*ManifestDiff, error) {
+	live, err := WalkRemote(ctx, remote, manifest.Root)
+	if err != nil {
+		return nil, err
+	}
+	return DiffManifests(manifest, live), nil
+}
+
+func WriteDiffJSON(w io.Writer, diff *ManifestDiff) error {
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(diff)
+}
+
+// WriteDiffText writes the diff in a form similar to "git diff --name-status"
+func WriteDiffText(w io.Writer, diff *ManifestDiff) error {
+	var err error
+	printf := func(format string, args ...interface{}) {
+		if err == nil {
+			_, err = fmt.Fprintf(w, format, args...)
+		}
+	}
+
+	for _, change := range diff.Added {
+		printf("A %s (size %d, etag %s)\n", change.Path, change.New.Size, change.New.ETag)
+	}
+	for _, change := range diff.Removed {
+		printf("D %s (size %d, etag %s)\n", change.Path, change.Old.Size, change.Old.ETag)
+	}
+	for _, change := range diff.Modified {
+		if change.Old.IsDir != change.New.IsDir {
+			printf("M %s (directory %v -> %v)\n", change.Path, change.Old.IsDir, change.New.IsDir)
+		} else {
+			printf("M %s (size %d -> %d, etag %s -> %s)\n", change.Path, change.Old.Size, change.New.Size,
+				change.Old.ETag, change.New.ETag)
+		}
+	}
+	printf("%d added, %d removed, %d modified\n", len(diff.Added), len(diff.Removed), len(diff.Modified))
+
+	return err
+}
@@ -0,0 +1,101 @@
+package treeply
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDiffManifests(t *testing.T) {
+	oldManifest := &Manifest{Version: ManifestVersion, Entries: []ManifestEntry{
+		{Path: "d1", IsDir: true},
+		{Path: "d1/same", Size: 1, ETag: "a"},
+		{Path: "d1/removed", Size: 2, ETag: "b"},
+		{Path: "d1/modified", Size: 3, ETag: "c"},
+		{Path: "becomes-dir", Size: 4, ETag: "d"},
+	}}
+	newManifest := &Manifest{Version: ManifestVersion, Entries: []ManifestEntry{
+		{Path: "d1", IsDir: true},
+		{Path: "d1/same", Size: 1, ETag: "a"},
+		{Path: "d1/modified", Size: 3, ETag: "c2"},
+		{Path: "d1/added", Size: 5, ETag: "e"},
+		{Path: "becomes-dir", IsDir: true},
+		{Path: "empty-dir", IsDir: true},
+	}}
+
+	diff := DiffManifests(oldManifest, newManifest)
+	assert.Equal(t, []ManifestChange{{Path: "d1/added", New: &newManifest.Entries[3]}}, diff.Added)
+	assert.Equal(t, []ManifestChange{{Path: "d1/removed", Old: &oldManifest.Entries[2]}}, diff.Removed)
+	assert.Equal(t, []ManifestChange{
+		{Path: "becomes-dir", Old: &oldManifest.Entries[4], New: &newManifest.Entries[4]},
+		{Path: "d1/modified", Old: &oldManifest.Entries[3], New: &newManifest.Entries[2]}}, diff.Modified)
+
+	var text bytes.Buffer
+	assert.Nil(t, WriteDiffText(&text, diff))
+	assert.Equal(t, "A d1/added (size 5, etag e)\n"+
+		"D d1/removed (size 2, etag b)\n"+
+		"M becomes-dir (directory false -> true)\n"+
+		"M d1/modified (size 3 -> 3, etag c -> c2)\n"+
+		"1 added, 1 removed, 2 modified\n", text.String())
+
+	var jsonOutput bytes.Buffer
+	assert.Nil(t, WriteDiffJSON(&jsonOutput, diff))
+	var parsed ManifestDiff
+	assert.Nil(t, json.Unmarshal(jsonOutput.Bytes(), &parsed))
+	assert.Equal(t, diff, &parsed)
+
+	assert.True(t, DiffManifests(oldManifest, oldManifest).IsEmpty())
+}
+
+func TestDiffManifestWithRemote(t *testing.T) {
+	tmpDir, err := os.MkdirTemp(os.TempDir(), "test")
+	if err != nil {
+		panic(err)
+	}
+
+	writeFile(tmpDir+"/f1", "f1", 10)
+	writeFile(tmpDir+"/d1/f2", "d1f2", 10)
+	writeFile(tmpDir+"/d1/f3", "d1f3", 10)
+
+	ctx := context.Background()
+	remote := &DirRemoteProvider{Root: tmpDir}
+	manifest, err := WalkRemote(ctx, remote, "")
+	assert.Nil(t, err)
+
+	diff, err := DiffManifestWithRemote(ctx, manifest, remote)
+	assert.Nil(t, err)
+	assert.True(t, diff.IsEmpty())
+
+	writeFile(tmpDir+"/d1/f2", "changed", 1)
+	assert.Nil(t, os.Remove(tmpDir+"/d1/f3"))
+	writeFile(tmpDir+"/d1/d2/f4", "new", 1)
+
+	diff, err = DiffManifestWithRemote(ctx, manifest, remote)
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(diff.Added))
+	assert.Equal(t, "d1/d2/f4", diff.Added[0].Path)
+	assert.Equal(t, 1, len(diff.Removed))
+	assert.Equal(t, "d1/f3", diff.Removed[0].Path)
+	assert.Equal(t, 1, len(diff.Modified))
+	assert.Equal(t, "d1/f2", diff.Modified[0].Path)
+	assert.Equal(t, int64(7), diff.Modified[0].New.Size)
+
+	// a manifest of a subdirectory is compared with the same subdirectory
+	subManifest, err := WalkRemote(ctx, remote, "d1")
+	assert.Nil(t, err)
+	assert.Equal(t, "d1", subManifest.Root)
+	diff, err = DiffManifestWithRemote(ctx, subManifest, remote)
+	assert.Nil(t, err)
+	assert.True(t, diff.IsEmpty())
+
+	writeFile(tmpDir+"/d1/f2", "changed again", 1)
+	diff, err = DiffManifestWithRemote(ctx, subManifest, remote)
+	assert.Nil(t, err)
+	assert.Equal(t, 0, len(diff.Added))
+	assert.Equal(t, 1, len(diff.Modified))
+	assert.Equal(t, "f2", diff.Modified[0].Path)
+}
@@ -1,6 +1,11 @@
 package treeply
 
-import "errors"
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"net/http"
+)
 
 var INVALID_HANDLE = errors.New("Invalid handle")
 var IS_DIR = errors.New("Is directory")
@@ -8,3 +13,153 @@ var INVALID_NAME = errors.New("Invalid Name")
 var INVALID_INODE = errors.New("Invalid INode")
 var IS_NOT_DIR = errors.New("INode is not a directory")
 var FILE_CHANGED = errors.New("File changed")
+var INVALID_WHENCE = errors.New("Invalid whence")
+var INVALID_OFFSET = errors.New("Invalid offset")
+var INVALID_LENGTH = errors.New("Invalid length")
+var UNKNOWN_COMMAND = errors.New("Unknown command")
+var INVALID_REQUEST = errors.New("Request is not a valid JSON envelope")
+var INVALID_PAYLOAD = errors.New("Invalid payload for command")
+var MOUNT_EXISTS = errors.New("Mount already exists")
+var NO_SUCH_MOUNT = errors.New("No such mount")
+var NOT_MOUNTABLE = errors.New("Remotes can only be mounted when the root is not itself a remote")
+var MOUNT_NOT_ALLOWED = errors.New("Directory is not one which clients may mount")
+var INVALID_MANIFEST = errors.New("Unsupported manifest version")
+var SNAPSHOT_SPANS_MOUNTS = errors.New("Snapshots must be of a path within a single mount")
+var NOT_PINNED = errors.New("Path is not pinned")
+var CHECKSUM_MISMATCH = errors.New("Checksum of fetched data does not match the remote")
+var BLOCK_TOO_BIG = errors.New("Block is larger than the block size")
+var BLOCK_NOT_POPULATED = errors.New("Block could not be populated")
+var BLOCK_TRUNCATED = errors.New("Cached block is shorter than expected")
+var DIR_NOT_POPULATED = errors.New("Directory could not be populated")
+
+// CacheError is a failure reading or writing a file in the work directory
+type CacheError struct {
+	Op       string
+	Filename string
+	Err      error
+}
+
+func (e *CacheError) Error() string {
+	return fmt.Sprintf("Could not %s %s: %s", e.Op, e.Filename, e.Err)
+}
+
+func (e *CacheError) Unwrap() error {
+	return e.Err
+}
+
+// CACHE_ERROR matches any CacheError, so it can be looked up in errorCodes
+var CACHE_ERROR = errors.New("Could not access the cache")
+
+func (e *CacheError) Is(target error) bool {
+	return target == CACHE_ERROR
+}
+
+// The code reported to clients for errors which aren't one of the below
+const UnknownErrorCode = "UNKNOWN"
+
+// Errno style codes, which group errors by how a client should react to them
+// in the way the equivalent POSIX errors would be
+const (
+	ENOENT  = "ENOENT"
+	EISDIR  = "EISDIR"
+	ENOTDIR = "ENOTDIR"
+	EBADF   = "EBADF"
+	// the file changed on the remote since it was listed
+	ESTALE = "ESTALE"
+	EINVAL = "EINVAL"
+	EEXIST = "EEXIST"
+	EACCES = "EACCES"
+	// the request may succeed if tried again
+	EAGAIN = "EAGAIN"
+	// anything else, including unrecognized failures from the remote
+	EIO = "EIO"
+)
+
+// errorCodes are reported to clients alongside the message, so they can tell
+// errors apart without depending on the wording. Once added, a code must not
+// change. Errors from elsewhere which only have an errno use UnknownErrorCode.
+var errorCodes = []struct {
+	err   error
+	code  string
+	errno string
+}{
+	{INVALID_HANDLE, "INVALID_HANDLE", EBADF},
+	{IS_DIR, "IS_DIR", EISDIR},
+	{INVALID_NAME, "INVALID_NAME", ENOENT},
+	{INVALID_INODE, "INVALID_INODE", ESTALE},
+	{IS_NOT_DIR, "IS_NOT_DIR", ENOTDIR},
+	{FILE_CHANGED, "FILE_CHANGED", ESTALE},
+	{INVALID_WHENCE, "INVALID_WHENCE", EINVAL},
+	{INVALID_OFFSET, "INVALID_OFFSET", EINVAL},
+	{INVALID_LENGTH, "INVALID_LENGTH", EINVAL},
+	{UNKNOWN_COMMAND, "UNKNOWN_COMMAND", EINVAL},
+	{INVALID_REQUEST, "INVALID_REQUEST", EINVAL},
+	{INVALID_PAYLOAD, "INVALID_PAYLOAD", EINVAL},
+	{MOUNT_EXISTS, "MOUNT_EXISTS", EEXIST},
+	{NO_SUCH_MOUNT, "NO_SUCH_MOUNT", ENOENT},
+	{NOT_MOUNTABLE, "NOT_MOUNTABLE", EINVAL},
+	{MOUNT_NOT_ALLOWED, "MOUNT_NOT_ALLOWED", EACCES},
+	{INVALID_MANIFEST, "INVALID_MANIFEST", EINVAL},
+	{SNAPSHOT_SPANS_MOUNTS, "SNAPSHOT_SPANS_MOUNTS", EINVAL},
+	{NOT_PINNED, "NOT_PINNED", ENOENT},
+	{CHECKSUM_MISMATCH, "CHECKSUM_MISMATCH", EIO},
+	{BLOCK_TOO_BIG, "BLOCK_TOO_BIG", EIO},
+	{BLOCK_TRUNCATED, "BLOCK_TRUNCATED", EIO},
+	// the remote didn't provide the data this time, but a later request may
+	{BLOCK_NOT_POPULATED, "BLOCK_NOT_POPULATED", EAGAIN},
+	{DIR_NOT_POPULATED, "DIR_NOT_POPULATED", EAGAIN},
+	{CACHE_ERROR, "CACHE_ERROR", EIO},
+	{fs.ErrNotExist, UnknownErrorCode, ENOENT},
+	{fs.ErrPermission, UnknownErrorCode, EACCES},
+}
+
+// ErrorCode returns the stable code for err, which may wrap one of the errors above
+func ErrorCode(err error) string {
+	for _, errorCode := range errorCodes {
+		if errors.Is(err, errorCode.err) {
+			return errorCode.code
+		}
+	}
+	return UnknownErrorCode
+}
+
+// remoteErrnos translate errors specific to one kind of remote, returning
+// false for errors they don't recognize. Each remote registers its own, so
+// this file doesn't depend on their client libraries.
+var remoteErrnos []func(err error) (string, bool)
+
+func registerRemoteErrno(remoteErrno func(err error) (string, bool)) {
+	remoteErrnos = append(remoteErrnos, remoteErrno)
+}
+
+// statusCodeErrno maps the HTTP status of a failed remote request
+func statusCodeErrno(statusCode int) (string, bool) {
+	switch statusCode {
+	case http.StatusNotFound:
+		return ENOENT, true
+	case http.StatusUnauthorized, http.StatusForbidden:
+		return EACCES, true
+	}
+	return "", false
+}
+
+// ErrorErrno returns the errno style code for err, which may be one of the
+// errors above or one from a remote
+func ErrorErrno(err error) string {
+	for _, errorCode := range errorCodes {
+		if errors.Is(err, errorCode.err) {
+			return errorCode.errno
+		}
+	}
+
+	for _, remoteErrno := range remoteErrnos {
+		if errno, ok := remoteErrno(err); ok {
+			return errno
+		}
+	}
+
+	if IsTransientError(err) {
+		return EAGAIN
+	}
+	return EIO
+}
@@ -1,10 +1,14 @@
 package treeply
 
 import (
+	"fmt"
+	"io"
 	"log"
+	"math"
 	"os"
 	"sort"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 )
@@ -38,11 +42,223 @@ func TestFileClientOperations(t *testing.T) {
 	// list an invalid file should fail
 	checkListDir(client, t)
 
+	checkStat(client, t)
+
 	checkOpen(client, t)
 	// opening a file should work
 	//	resp, err := client.Open(&OpenReq{})
 }
 
+func TestReadAtEndOfFile(t *testing.T) {
+	workDir, err := os.MkdirTemp(os.TempDir(), "test")
+	if err != nil {
+		panic(err)
+	}
+
+	tmpDir, err := os.MkdirTemp(os.TempDir(), "test")
+	if err != nil {
+		panic(err)
+	}
+
+	// not a multiple of the block size, so the last block is short
+	writeFile(tmpDir+"/short", "0123456789", 1)
+	writeFile(tmpDir+"/empty", "", 0)
+
+	fs, err := NewFileService(&DirRemoteProvider{Root: tmpDir}, workDir, 4)
+	if err != nil {
+		panic(err)
+	}
+	client := NewFileClient(fs)
+
+	inode, err := fs.GetINodeForPath("short")
+	assert.Nil(t, err)
+	buffer := make([]byte, 10)
+	n, err := fs.INodes.ReadFile(inode, 0, buffer)
+	assert.Nil(t, err)
+	assert.Equal(t, "0123456789", string(buffer[:n]))
+
+	// reads past the end are clamped to the length of the file
+	n, err = fs.INodes.ReadFile(inode, 8, buffer)
+	assert.Equal(t, io.EOF, err)
+	assert.Equal(t, "89", string(buffer[:n]))
+	for _, offset := range []int64{10, 12, 100} {
+		n, err = fs.INodes.ReadFile(inode, offset, buffer)
+		assert.Equal(t, io.EOF, err)
+		assert.Equal(t, 0, n)
+	}
+	fs.INodes.UpdateRefCount(inode, -1)
+
+	openResp, err := client.Open(&OpenReq{Path: "short"})
+	assert.Nil(t, err)
+	for _, expected := range []ReadResp{{Data: []byte("0123")}, {Data: []byte("4567")},
+		{Data: []byte("89"), EOF: true}, {Data: []byte{}, EOF: true}} {
+		readResp, err := client.Read(&ReadReq{FD: openResp.FD, Length: 4})
+		assert.Nil(t, err)
+		assert.Equal(t, &expected, readResp)
+	}
+	readResp, err := client.PRead(&PReadReq{FD: openResp.FD, Offset: 6, Length: 100})
+	assert.Nil(t, err)
+	assert.Equal(t, &ReadResp{Data: []byte("6789"), EOF: true}, readResp)
+
+	// a huge length only allocates what's left of the file
+	readResp, err = client.PRead(&PReadReq{FD: openResp.FD, Offset: 6, Length: math.MaxInt})
+	assert.Nil(t, err)
+	assert.Equal(t, &ReadResp{Data: []byte("6789"), EOF: true}, readResp)
+	resp := DispatchReq(client, []byte(fmt.Sprintf("{\"Type\": \"pread\", \"Payload\": {\"FD\": %d, \"Offset\": 8, \"Length\": %d}}",
+		openResp.FD, math.MaxInt64)))
+	assert.Equal(t, &RespEnvelope{Type: "result", Payload: &ReadResp{Data: []byte("89"), EOF: true}}, resp)
+
+	// a zero length file has no blocks, so every read is at the end
+	stat, err := client.Stat(&StatReq{Path: "empty"})
+	assert.Nil(t, err)
+	assert.Equal(t, 0, stat.BlockCount)
+	openResp, err = client.Open(&OpenReq{Path: "empty"})
+	assert.Nil(t, err)
+	readResp, err = client.Read(&ReadReq{FD: openResp.FD, Length: 4})
+	assert.Nil(t, err)
+	assert.Equal(t, &ReadResp{Data: []byte{}, EOF: true}, readResp)
+	readResp, err = client.Read(&ReadReq{FD: openResp.FD, Length: 0})
+	assert.Nil(t, err)
+	assert.Equal(t, &ReadResp{Data: []byte{}, EOF: true}, readResp)
+
+	// a cached block which was truncated is dropped rather than shifting the rest of the read
+	blockIDs, err := fs.INodes.GetBlockIDs(inode, 0, 1)
+	assert.Nil(t, err)
+	err = os.Truncate(fs.INodes.blocks.getFilename(blockIDs[0]), 2)
+	if err != nil {
+		panic(err)
+	}
+	fs.INodes.blocks.UpdateRefCount(blockIDs[0], -1)
+	n, err = fs.INodes.ReadFile(inode, 0, buffer)
+	assert.Equal(t, BLOCK_TRUNCATED, err)
+	assert.Equal(t, 0, n)
+	populated, err := fs.INodes.IsBlockPopulated(inode, 0)
+	assert.Nil(t, err)
+	assert.False(t, populated)
+
+	n, err = fs.INodes.ReadFile(inode, 0, buffer)
+	assert.Nil(t, err)
+	assert.Equal(t, "0123456789", string(buffer[:n]))
+}
+
+func TestFileClientReadahead(t *testing.T) {
+	workDir, err := os.MkdirTemp(os.TempDir(), "test")
+	if err != nil {
+		panic(err)
+	}
+
+	tmpDir, err := os.MkdirTemp(os.TempDir(), "test")
+	if err != nil {
+		panic(err)
+	}
+
+	writeFile(tmpDir+"/f1", "0123456789", 10)
+
+	fs, err := NewFileService(&DirRemoteProvider{Root: tmpDir}, workDir, 10)
+	if err != nil {
+		panic(err)
+	}
+	fs.ReadaheadBlocks = 3
+
+	client := NewFileClient(fs)
+	openResp, err := client.Open(&OpenReq{Path: "f1"})
+	assert.Nil(t, err)
+
+	cachedBlocks := func() int {
+		resp, err := client.Stat(&StatReq{Path: "f1"})
+		assert.Nil(t, err)
+		return resp.CachedBlocks
+	}
+	// readahead is started before the read returns, so this is set as soon as it's requested
+	isPrefetching := func() bool {
+		fs.INodes.lock.Lock()
+		defer fs.INodes.lock.Unlock()
+		return fs.INodes.inodeStates[client.FileHandles[openResp.FD].INode].prefetching
+	}
+
+	// a sequential read of the first block should also fetch the following 3
+	resp, err := client.Read(&ReadReq{FD: openResp.FD, Length: 10})
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("0123456789"), resp.Data)
+	assert.Eventually(t, func() bool { return cachedBlocks() == 4 && !isPrefetching() }, time.Second, 10*time.Millisecond)
+
+	// a random access read should not trigger readahead
+	preadResp, err := client.PRead(&PReadReq{FD: openResp.FD, Offset: 80, Length: 5})
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("01234"), preadResp.Data)
+	assert.False(t, isPrefetching())
+	assert.Equal(t, 5, cachedBlocks())
+
+	checkClose(client, t, openResp.FD)
+}
+
+func TestPrefetchOneAtATime(t *testing.T) {
+	workDir, err := os.MkdirTemp(os.TempDir(), "test")
+	if err != nil {
+		panic(err)
+	}
+
+	tmpDir, err := os.MkdirTemp(os.TempDir(), "test")
+	if err != nil {
+		panic(err)
+	}
+
+	writeFile(tmpDir+"/f1", "0123456789", 10)
+
+	remote := &CountingRemoteProvider{RemoteProvider: &DirRemoteProvider{Root: tmpDir, ReadDelay: 50 * time.Millisecond}}
+	fs, err := NewFileService(remote, workDir, 10)
+	if err != nil {
+		panic(err)
+	}
+
+	client := NewFileClient(fs)
+	openResp, err := client.Open(&OpenReq{Path: "f1"})
+	assert.Nil(t, err)
+	inode := client.FileHandles[openResp.FD].INode
+
+	// the second prefetch is dropped while the first is still outstanding
+	fs.INodes.Prefetch(inode, 0, 20)
+	fs.INodes.Prefetch(inode, 50, 20)
+	assert.Eventually(t, func() bool {
+		populated, err := fs.INodes.IsBlockPopulated(inode, 1)
+		return err == nil && populated
+	}, time.Second, 10*time.Millisecond)
+	assert.Equal(t, int32(1), remote.readerCount.Load())
+	populated, err := fs.INodes.IsBlockPopulated(inode, 5)
+	assert.Nil(t, err)
+	assert.False(t, populated)
+
+	checkClose(client, t, openResp.FD)
+}
+
+func checkStat(client *FileClient, t *testing.T) {
+	resp, err := client.Stat(&StatReq{Path: "d1"})
+	assert.Nil(t, err)
+	assert.True(t, resp.IsDir)
+
+	resp, err = client.Stat(&StatReq{Path: "d1/f2"})
+	assert.Nil(t, err)
+	assert.False(t, resp.IsDir)
+	assert.Equal(t, int64(160), resp.Size)
+	assert.NotEqual(t, "", resp.ETag)
+	assert.Equal(t, 1, resp.BlockCount)
+	assert.Equal(t, 0, resp.CachedBlocks)
+
+	// after reading the file, the block should be reported as cached
+	openResp, err := client.Open(&OpenReq{Path: "d1/f2"})
+	assert.Nil(t, err)
+	_, err = client.Read(&ReadReq{FD: openResp.FD, Length: 4})
+	assert.Nil(t, err)
+	checkClose(client, t, openResp.FD)
+
+	resp, err = client.Stat(&StatReq{Path: "d1/f2"})
+	assert.Nil(t, err)
+	assert.Equal(t, 1, resp.CachedBlocks)
+
+	_, err = client.Stat(&StatReq{Path: "f3"})
+	assert.Equal(t, INVALID_NAME, err)
+}
+
 func checkOpen(client *FileClient, t *testing.T) {
 	// opening a dir should fail
 	resp, err := client.Open(&OpenReq{Path: "d1"})
@@ -62,6 +278,10 @@ func checkOpen(client *FileClient, t *testing.T) {
 	// and now we can read
 	checkRead(client, t, fd)
 
+	checkSeek(client, t, fd)
+
+	checkPRead(client, t, fd)
+
 	checkClose(client, t, fd)
 }
 
@@ -89,6 +309,66 @@ func checkRead(client *FileClient, t *testing.T, fd int) {
 	assert.Equal(t, 15, len(resp.Data))
 }
 
+func checkSeek(client *FileClient, t *testing.T, fd int) {
+	// f1 is 20 bytes long, so seeking relative to the end should land at 18
+	resp, err := client.Seek(&SeekReq{FD: fd, Offset: -2, Whence: SEEK_END})
+	assert.Nil(t, err)
+	assert.Equal(t, 18, resp.Offset)
+
+	readResp, err := client.Read(&ReadReq{FD: fd, Length: 10})
+	assert.Nil(t, err)
+	assert.Equal(t, []byte{'f', '1'}, readResp.Data)
+
+	resp, err = client.Seek(&SeekReq{FD: fd, Offset: 1, Whence: SEEK_SET})
+	assert.Nil(t, err)
+	assert.Equal(t, 1, resp.Offset)
+
+	resp, err = client.Seek(&SeekReq{FD: fd, Offset: 2, Whence: SEEK_CUR})
+	assert.Nil(t, err)
+	assert.Equal(t, 3, resp.Offset)
+
+	readResp, err = client.Read(&ReadReq{FD: fd, Length: 2})
+	assert.Nil(t, err)
+	assert.Equal(t, []byte{'1', 'f'}, readResp.Data)
+
+	// seeking before the start of the file or with a bad whence should fail
+	_, err = client.Seek(&SeekReq{FD: fd, Offset: -10, Whence: SEEK_SET})
+	assert.Equal(t, INVALID_OFFSET, err)
+
+	_, err = client.Seek(&SeekReq{FD: fd, Offset: 0, Whence: "bogus"})
+	assert.Equal(t, INVALID_WHENCE, err)
+
+	_, err = client.Seek(&SeekReq{FD: 1000, Offset: 0, Whence: SEEK_SET})
+	assert.Equal(t, INVALID_HANDLE, err)
+}
+
+func checkPRead(client *FileClient, t *testing.T, fd int) {
+	seekResp, err := client.Seek(&SeekReq{FD: fd, Offset: 5, Whence: SEEK_SET})
+	assert.Nil(t, err)
+	assert.Equal(t, 5, seekResp.Offset)
+
+	resp, err := client.PRead(&PReadReq{FD: fd, Offset: 16, Length: 3})
+	assert.Nil(t, err)
+	assert.Equal(t, []byte{'f', '1', 'f'}, resp.Data)
+
+	// pread should not have moved the offset
+	seekResp, err = client.Seek(&SeekReq{FD: fd, Offset: 0, Whence: SEEK_CUR})
+	assert.Nil(t, err)
+	assert.Equal(t, 5, seekResp.Offset)
+
+	_, err = client.PRead(&PReadReq{FD: fd, Offset: -1, Length: 3})
+	assert.Equal(t, INVALID_OFFSET, err)
+
+	_, err = client.PRead(&PReadReq{FD: fd, Offset: 0, Length: -1})
+	assert.Equal(t, INVALID_LENGTH, err)
+
+	_, err = client.Read(&ReadReq{FD: fd, Length: -1})
+	assert.Equal(t, INVALID_LENGTH, err)
+
+	_, err = client.PRead(&PReadReq{FD: 1000, Offset: 0, Length: 3})
+	assert.Equal(t, INVALID_HANDLE, err)
+}
+
 func checkListDir(client *FileClient, t *testing.T) {
 	log.Printf("checkListDir1")
 	resp, err := client.ListDir(&ListDirReq{Path: "."})
@@ -121,3 +401,106 @@ func checkListDir(client *FileClient, t *testing.T) {
 	assert.Nil(t, resp)
 	assert.Equal(t, INVALID_NAME, err)
 }
+
+func listNames(client *FileClient, t *testing.T, path string) []string {
+	resp, err := client.ListDir(&ListDirReq{Path: path})
+	assert.Nil(t, err)
+	names := make([]string, 0, len(resp.Entries))
+	for _, entry := range resp.Entries {
+		names = append(names, entry.Name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func TestFileClientMounts(t *testing.T) {
+	workDir, err := os.MkdirTemp(os.TempDir(), "test")
+	if err != nil {
+		panic(err)
+	}
+
+	dir1, err := os.MkdirTemp(os.TempDir(), "test")
+	if err != nil {
+		panic(err)
+	}
+	dir2, err := os.MkdirTemp(os.TempDir(), "test")
+	if err != nil {
+		panic(err)
+	}
+
+	// both have a file with the same path and ETag, which must not be confused in the cache
+	writeFile(dir1+"/f1", "1", 10)
+	writeFile(dir2+"/f1", "2", 10)
+	writeFile(dir2+"/d1/f2", "d1f2", 10)
+	mtime := time.Now()
+	assert.Nil(t, os.Chtimes(dir1+"/f1", mtime, mtime))
+	assert.Nil(t, os.Chtimes(dir2+"/f1", mtime, mtime))
+
+	fs, err := NewFileService(nil, workDir, 10000)
+	if err != nil {
+		panic(err)
+	}
+	client := NewFileClient(fs)
+	assert.Equal(t, []string{".", ".."}, listNames(client, t, "."))
+
+	// local directories can only be mounted once they've been allowed
+	_, err = client.Mount(&MountReq{Name: "m1", Remote: dir1})
+	assert.Equal(t, MOUNT_NOT_ALLOWED, err)
+	fs.MountableDirs = []string{dir1, dir2 + "/d1"}
+	_, err = client.Mount(&MountReq{Name: "m1", Remote: dir2 + "/d1/.."})
+	assert.Equal(t, MOUNT_NOT_ALLOWED, err)
+	fs.MountableDirs = []string{dir1, dir2}
+
+	_, err = client.Mount(&MountReq{Name: "m1", Remote: dir1})
+	assert.Nil(t, err)
+	// mounts can also be added over the socket
+	resp := DispatchReq(client, []byte("{\"Type\": \"mount\", \"Payload\": {\"Name\": \"m2\", \"Remote\": \""+dir2+"\"}}"))
+	assert.Equal(t, &RespEnvelope{Type: "result", Payload: &MountResp{}}, resp)
+
+	_, err = client.Mount(&MountReq{Name: "m1", Remote: dir2})
+	assert.Equal(t, MOUNT_EXISTS, err)
+	_, err = client.Mount(&MountReq{Name: "a/b", Remote: dir2})
+	assert.Equal(t, INVALID_NAME, err)
+
+	assert.Equal(t, []string{".", "..", "m1", "m2"}, listNames(client, t, "."))
+	assert.Equal(t, []string{".", "..", "d1", "f1"}, listNames(client, t, "m2"))
+
+	readAll := func(path string) (int, string) {
+		openResp, err := client.Open(&OpenReq{Path: path})
+		assert.Nil(t, err)
+		readResp, err := client.Read(&ReadReq{FD: openResp.FD, Length: 10})
+		assert.Nil(t, err)
+		return openResp.FD, string(readResp.Data)
+	}
+	_, content := readAll("m1/f1")
+	assert.Equal(t, "1111111111", content)
+	fd, content := readAll("m2/f1")
+	assert.Equal(t, "2222222222", content)
+
+	// both mounts share the one cache
+	assert.Equal(t, int64(20), fs.INodes.blocks.GetDiagnostics().BytesInUse)
+
+	_, err = client.Unmount(&UnmountReq{Name: "m2"})
+	assert.Nil(t, err)
+	assert.Equal(t, []string{".", "..", "m1"}, listNames(client, t, "."))
+	_, err = client.Stat(&StatReq{Path: "m2/f1"})
+	assert.Equal(t, INVALID_NAME, err)
+	_, err = client.Unmount(&UnmountReq{Name: "m2"})
+	assert.Equal(t, NO_SUCH_MOUNT, err)
+
+	// files opened before the unmount can still be read
+	pread, err := client.PRead(&PReadReq{FD: fd, Offset: 5, Length: 5})
+	assert.Nil(t, err)
+	assert.Equal(t, "22222", string(pread.Data))
+
+	// a service with a remote at the root can't have mounts
+	workDir, err = os.MkdirTemp(os.TempDir(), "test")
+	if err != nil {
+		panic(err)
+	}
+	fs, err = NewFileService(&DirRemoteProvider{Root: dir1}, workDir, 10000)
+	if err != nil {
+		panic(err)
+	}
+	assert.Equal(t, NOT_MOUNTABLE, fs.Mount("m1", &DirRemoteProvider{Root: dir2}, 0))
+}
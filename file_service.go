@@ -4,19 +4,66 @@ import (
 	"context"
 	"io"
 	"log"
+	"path"
 	"path/filepath"
 	"strings"
+	"sync"
+	"time"
 )
 
+// The default number of blocks to fetch ahead of a sequential reader
+const DefaultReadaheadBlocks = 4
+
 type FileService struct {
 	Remote               RemoteProvider
 	INodes               *INodes
 	Root                 INode
 	TransferServiceQueue chan interface{}
+
+	// how many blocks past the end of a sequential read to prefetch. Zero disables readahead.
+	ReadaheadBlocks int
+
+	// how transient failures reading from Remote are retried
+	RetryPolicy RetryPolicy
+
+	// if true, a directory whose listing failed will be listed again the next
+	// time it's accessed. Otherwise the original failure is reported.
+	RetryFailedDirListings bool
+
+	// how long a directory listing of Remote is used before it's listed again
+	// in the background, keeping the entries which haven't changed. Zero means
+	// listings are used until the directory is forgotten. Mounts have their own TTL.
+	DirTTL time.Duration
+
+	// if true, once every block of a file has been fetched they're checked
+	// against the checksum of the remote object
+	VerifyChecksums bool
+
+	// creates the RemoteProvider for an address given to the mount command
+	RemoteFactory func(address string) (RemoteProvider, error)
+
+	// the local directories, along with everything under them, which the
+	// mount command may mount. If empty, clients can only mount remotes.
+	MountableDirs []string
+
+	workDir   string
+	blockSize int
+
+	// the remotes mounted under the root, when the service was created without a Remote
+	mountLock sync.Mutex
+	mounts    map[string]*Mount
+
+	// the files pinned under each pinned path
+	pinLock sync.Mutex
+	pins    map[string][]INode
+	// blocks of files pinned by a previous run, which are held until RestorePins
+	restoredPinBlocks []BlockID
 }
 
 type FileServiceDiagnostics struct {
 	Remote                interface{}
+	Mounts                []*MountDiagnostics
+	PinnedPaths           []string
 	INodes                interface{}
 	TransferServiceStatus interface{}
 }
@@ -26,8 +73,21 @@ func (f *FileService) GetDiagnostics() *FileServiceDiagnostics {
 	f.TransferServiceQueue <- &DiagnosticRequest{Response: response}
 	transferServiceStatus := <-response
 
+	var remoteDiagnostics interface{}
+	if f.Remote != nil {
+		remoteDiagnostics = f.Remote.GetDiagnostics()
+	}
+
+	mountDiagnostics := make([]*MountDiagnostics, 0)
+	for _, mount := range f.GetMounts() {
+		mountDiagnostics = append(mountDiagnostics, &MountDiagnostics{Name: mount.Name, DirTTL: mount.DirTTL,
+			Remote: mount.Remote.GetDiagnostics()})
+	}
+
 	return &FileServiceDiagnostics{
-		Remote:                f.Remote.GetDiagnostics(),
+		Remote:                remoteDiagnostics,
+		Mounts:                mountDiagnostics,
+		PinnedPaths:           f.GetPinnedPaths(),
 		INodes:                f.INodes.GetDiagnostics(),
 		TransferServiceStatus: transferServiceStatus,
 	}
@@ -53,29 +113,64 @@ func (f *FileService) Forget(path string) error {
 		// otherwise we need to update the parent dir
 		parentDir := filepath.Dir(path)
 		name := filepath.Base(path)
+		if parentDir == "." {
+			replaced, err := f.replaceMountRoot(name, newINode)
+			if replaced || err != nil {
+				return err
+			}
+		}
 		parentINode, err := f.GetINodeForPath(parentDir)
 		if err != nil {
 			return err
 		}
-		f.INodes.SetDirEntry(parentINode, name, newINode)
+		err = f.INodes.SetDirEntry(parentINode, name, newINode)
+		if err != nil {
+			return err
+		}
 	}
 
 	return nil
 }
 
+// Close flushes the state kept in the work directory to disk. Should be
+// called before exiting.
+func (f *FileService) Close() error {
+	return f.INodes.Close()
+}
+
+// SetTransferLimits changes the number of block transfers and directory listings
+// which may be in progress at once. Values <= 0 mean no limit.
+func (f *FileService) SetTransferLimits(maxActiveTransfers int, maxActiveDirListings int) {
+	f.TransferServiceQueue <- &SetLimitsRequest{MaxActiveTransfers: maxActiveTransfers, MaxActiveDirListings: maxActiveDirListings}
+}
+
+// cleanPath normalizes a path within the service as sent by a client (ie:
+// "./d1/" becomes "d1") so equivalent paths compare equal. The root is "".
+func cleanPath(filePath string) string {
+	filePath = strings.TrimPrefix(path.Clean(filePath), "/")
+	if filePath == "." {
+		return ""
+	}
+	return filePath
+}
+
 func pathConcat(base string, name string) string {
 	var result string
 	if name == "" {
 		result = base
 	} else if base == "" {
 		result = name
-	} else if base == "gs://" {
+	} else if strings.HasSuffix(base, "://") {
 		result = base + name
 	} else {
 		result = base + "/" + name
 	}
 
-	resultToCheck := strings.TrimPrefix(result, "gs://")
+	// don't treat the empty component in a url scheme (ie: "gs://") as invalid
+	resultToCheck := result
+	if schemeEnd := strings.Index(result, "://"); schemeEnd >= 0 {
+		resultToCheck = result[schemeEnd+len("://"):]
+	}
 
 	for _, component := range strings.Split(resultToCheck, "/") {
 		if component == "" || component == "." || component == ".." {
@@ -92,10 +187,40 @@ func NewFileService(Remote RemoteProvider, WorkDir string, BlockSize int) (*File
 	}
 
 	transferServiceQueue := make(chan interface{})
-	fs := &FileService{Remote: Remote, INodes: inodes, TransferServiceQueue: transferServiceQueue}
+	fs := &FileService{Remote: Remote, INodes: inodes, TransferServiceQueue: transferServiceQueue,
+		ReadaheadBlocks: DefaultReadaheadBlocks, RetryPolicy: DefaultRetryPolicy, VerifyChecksums: true,
+		workDir: WorkDir, blockSize: BlockSize, mounts: make(map[string]*Mount), pins: make(map[string][]INode),
+		RemoteFactory: func(address string) (RemoteProvider, error) {
+			return NewRemoteProviderForAddress(address, "")
+		}}
+
+	err = fs.loadPins()
+	if err != nil {
+		return nil, err
+	}
 
 	go TransferService(transferServiceQueue, inodes)
 
+	if Remote == nil {
+		// the root only contains whatever gets mounted
+		fs.Root = fs.INodes.CreateLazyDir(UNALLOCATED_BLOCK_ID, &LazyDirectoryCallback{RequestDirEntries: fs.requestMountEntries})
+	} else {
+		fs.Root = fs.newRemoteDir(Remote, "", UNALLOCATED_BLOCK_ID, func() time.Duration { return fs.DirTTL })
+	}
+
+	return fs, nil
+}
+
+// newRemoteDir creates a lazy directory for the root of the given remote.
+// Blocks are cached under their path within the remote, prefixed by keyPrefix
+// so that several remotes can share the same cache. getTTL returns how long
+// listings of the remote's directories are trusted.
+func (fs *FileService) newRemoteDir(Remote RemoteProvider, keyPrefix string, parentINode INode, getTTL func() time.Duration) INode {
+	inodes := fs.INodes
+	transferServiceQueue := fs.TransferServiceQueue
+	WorkDir := fs.workDir
+	BlockSize := fs.blockSize
+
 	// TODO: These implementations cause a fetch to always happen. This means
 	// that there's race conditions that can happen (ie: two threads ask for
 	// the same block) where we could make a single transfer as opposed to two.
@@ -103,72 +228,118 @@ func NewFileService(Remote RemoteProvider, WorkDir string, BlockSize int) (*File
 	// logging in SetBlocks to warn every time it sees we're replacing an
 	// existing block with a new one.
 
-	makeRequestCallback := func(path string, etag string) RequestCallback {
-		requestCallback := func(inode INode, blockIndices []int) {
+	makeRequestCallback := func(path string, etag string, checksum string) RequestCallback {
+		requestCallback := func(inode INode, blockIndices []int, priority Priority) error {
 			Responses := make([]chan error, 0, len(blockIndices))
+			missingBlockIndices := make([]int, 0, len(blockIndices))
+			cacheKeys := make([]*BlockKey, 0, len(blockIndices))
 
 			log.Printf("Requesting %d blocks", len(blockIndices))
 			for _, blockIndex := range blockIndices {
-				Response := make(chan error)
-				Responses = append(Responses, Response)
+				cacheKey := &BlockKey{Path: pathConcat(keyPrefix, path), ETag: etag, BlockIndex: blockIndex}
 
-				offset := int64(blockIndex) * int64(BlockSize)
-				length := int64(BlockSize)
+				// if we already have a copy of this block from an earlier read, use that
+				if blockID := inodes.blocks.LookupAndRef(*cacheKey); blockID != UNALLOCATED_BLOCK_ID {
+					log.Printf("Found cached block %d for %s:%d", blockID, path, blockIndex)
+					err := inodes.SetBlock(inode, blockIndex, blockID)
+					if err != nil {
+						inodes.blocks.UpdateRefCount(blockID, -1)
+						return err
+					}
+					continue
+				}
+
+				Responses = append(Responses, make(chan error, 1))
+				missingBlockIndices = append(missingBlockIndices, blockIndex)
+				cacheKeys = append(cacheKeys, cacheKey)
+			}
 
-				transferServiceQueue <- &BlockRequest{Block: INodeBlock{INode: inode, BlockIndex: blockIndex},
-					GetReader: func(ctx context.Context) (io.Reader, error) {
+			if len(missingBlockIndices) > 0 {
+				retryPolicy := fs.RetryPolicy
+				// send all the blocks in a single request so that the transfer service can
+				// fetch consecutive blocks with a single read
+				transferServiceQueue <- &BlockRequest{INode: inode, BlockIndices: missingBlockIndices,
+					GetReader: func(ctx context.Context, blockIndex int, blockCount int) (io.Reader, error) {
+						offset := int64(blockIndex) * int64(BlockSize)
+						length := int64(blockCount) * int64(BlockSize)
 						return Remote.GetReader(ctx, path, etag, offset, length)
-					}, WorkDir: WorkDir, Response: Response,
+					}, WorkDir: WorkDir, CacheKeys: cacheKeys, Responses: Responses, Priority: priority,
+					RetryPolicy: &retryPolicy,
 				}
 			}
 
 			// block waiting for all responses to come in
 			log.Printf("Waiting for completion of %d blocks", len(blockIndices))
+			var firstErr error
 			for _, response := range Responses {
 				value, ok := <-response
 				if ok {
-					log.Printf("Ok")
+					log.Printf("Got error: %s", value)
+					if firstErr == nil {
+						firstErr = value
+					}
 				}
-				log.Printf("Got response: %s", value)
 			}
 			log.Printf("Received completion for completion of %d blocks", len(blockIndices))
+			if firstErr == nil {
+				firstErr = fs.verifyFile(inode, Remote, path, etag, checksum)
+			}
+			return firstErr
 		}
 		return requestCallback
 	}
 
-	var _requestDirEntries func(dirInode INode)
+	var makeDirCallback func(dirPath string) *LazyDirectoryCallback
 
-	var makeRequestDirEntries func(dirPath string) func(dirInode INode)
+	makeRequestDirEntries := func(dirPath string, revalidate bool) func(dirInode INode) error {
+		return func(dirInode INode) error {
+			// unless configured to try again, report the same failure as last time
+			if !revalidate && !fs.RetryFailedDirListings {
+				if err := inodes.GetDirListingError(dirInode); err != nil {
+					return err
+				}
+			}
 
-	makeRequestDirEntries = func(dirPath string) func(dirInode INode) {
-		_requestDirEntries = func(dirInode INode) {
-			Response := make(chan error)
+			Response := make(chan error, 1)
 
 			transferServiceQueue <- &GetDirRequest{
 				GetDirListing: func(ctx context.Context) ([]RemoteFile, error) {
 					if strings.HasPrefix(dirPath, "/") || strings.HasPrefix(dirPath, "./") || dirPath == "." {
 						panic("bad dirPath")
 					}
-					return Remote.GetDirListing(ctx, dirPath)
+					var files []RemoteFile
+					retryPolicy := fs.RetryPolicy
+					err := retryPolicy.Retry(ctx, func(ctx context.Context) error {
+						var err error
+						files, err = Remote.GetDirListing(ctx, dirPath)
+						return err
+					})
+					return files, err
 				},
 				DirINode: dirInode,
-				MakeDirEntriesCallback: func(childName string) func(INode) {
-					return makeRequestDirEntries(pathConcat(dirPath, childName))
+				MakeDirCallback: func(childName string) *LazyDirectoryCallback {
+					return makeDirCallback(pathConcat(dirPath, childName))
 				},
-				MakeFileCallback: func(path string, etag string) RequestCallback {
-					return makeRequestCallback(pathConcat(dirPath, path), etag)
+				MakeFileCallback: func(path string, etag string, checksum string) RequestCallback {
+					return makeRequestCallback(pathConcat(dirPath, path), etag, checksum)
 				},
-				Response: Response,
+				Revalidate: revalidate,
+				Response:   Response,
 			}
 
 			// wait for response before returning
-			<-Response
+			err, ok := <-Response
+			if ok {
+				return err
+			}
+			return nil
 		}
-
-		return _requestDirEntries
 	}
 
-	fs.Root = fs.INodes.CreateLazyDir(UNALLOCATED_BLOCK_ID, &LazyDirectoryCallback{RequestDirEntries: makeRequestDirEntries("")})
+	makeDirCallback = func(dirPath string) *LazyDirectoryCallback {
+		return &LazyDirectoryCallback{RequestDirEntries: makeRequestDirEntries(dirPath, false),
+			RevalidateDirEntries: makeRequestDirEntries(dirPath, true), GetTTL: getTTL}
+	}
 
-	return fs, nil
+	return fs.INodes.CreateLazyDir(parentINode, makeDirCallback(""))
 }
@@ -1,11 +1,16 @@
 package treeply
 
 import (
+	"context"
+	"errors"
+	"io"
 	"log"
 	"os"
 	"path/filepath"
 	"sort"
+	"sync/atomic"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 )
@@ -30,6 +35,215 @@ func writeFile(path string, content string, count int) {
 	f.Close()
 }
 
+type CountingRemoteProvider struct {
+	RemoteProvider
+	readerCount atomic.Int32
+}
+
+func (c *CountingRemoteProvider) GetReader(ctx context.Context, path string, ETag string, Offset int64, Length int64) (io.Reader, error) {
+	c.readerCount.Add(1)
+	return c.RemoteProvider.GetReader(ctx, path, ETag, Offset, Length)
+}
+
+// FailingDirRemoteProvider fails to list any directory in FailPaths
+type FailingDirRemoteProvider struct {
+	RemoteProvider
+	FailPaths    map[string]bool
+	listingCount atomic.Int32
+}
+
+var errListingDenied = errors.New("permission denied")
+
+func (f *FailingDirRemoteProvider) GetDirListing(ctx context.Context, path string) ([]RemoteFile, error) {
+	f.listingCount.Add(1)
+	if f.FailPaths[path] {
+		return nil, errListingDenied
+	}
+	return f.RemoteProvider.GetDirListing(ctx, path)
+}
+
+func TestDirListingFailure(t *testing.T) {
+	workDir, err := os.MkdirTemp(os.TempDir(), "test")
+	if err != nil {
+		panic(err)
+	}
+
+	tmpDir, err := os.MkdirTemp(os.TempDir(), "test")
+	if err != nil {
+		panic(err)
+	}
+
+	writeFile(tmpDir+"/d1/f1", "d1f1", 30)
+
+	remote := &FailingDirRemoteProvider{RemoteProvider: &DirRemoteProvider{Root: tmpDir},
+		FailPaths: map[string]bool{"d1": true}}
+	fs, err := NewFileService(remote, workDir, 10000)
+	if err != nil {
+		panic(err)
+	}
+	client := NewFileClient(fs)
+
+	_, err = client.ListDir(&ListDirReq{Path: "."})
+	assert.Nil(t, err)
+	assert.Equal(t, 1, int(remote.listingCount.Load()))
+
+	// the error should be returned rather than hanging
+	_, err = client.ListDir(&ListDirReq{Path: "d1"})
+	assert.Equal(t, errListingDenied, err)
+	assert.Equal(t, 2, int(remote.listingCount.Load()))
+
+	// by default, the failure is remembered and not retried
+	_, err = client.Stat(&StatReq{Path: "d1/f1"})
+	assert.Equal(t, errListingDenied, err)
+	assert.Equal(t, 2, int(remote.listingCount.Load()))
+
+	// and is reported to socket clients as an error
+	resp := DispatchReq(client, []byte("{\"Type\": \"listdir\", \"Payload\": {\"Path\": \"d1\"}}"))
+	assert.Equal(t, &RespEnvelope{Type: "error", Payload: &ErrorResp{Code: UnknownErrorCode, Errno: EIO, Message: errListingDenied.Error(),
+		Path: "d1"}}, resp)
+
+	// once retries are enabled, the next access lists the dir again
+	fs.RetryFailedDirListings = true
+	remote.FailPaths = map[string]bool{}
+	resp2, err := client.ListDir(&ListDirReq{Path: "d1"})
+	assert.Nil(t, err)
+	assert.Equal(t, 3, len(resp2.Entries))
+	assert.Equal(t, 3, int(remote.listingCount.Load()))
+}
+
+func TestDirRevalidation(t *testing.T) {
+	workDir, err := os.MkdirTemp(os.TempDir(), "test")
+	if err != nil {
+		panic(err)
+	}
+
+	tmpDir, err := os.MkdirTemp(os.TempDir(), "test")
+	if err != nil {
+		panic(err)
+	}
+
+	writeFile(tmpDir+"/d1/same", "same", 10)
+	writeFile(tmpDir+"/d1/changed", "old", 10)
+	writeFile(tmpDir+"/d1/removed", "removed", 10)
+
+	fs, err := NewFileService(&DirRemoteProvider{Root: tmpDir}, workDir, 10000)
+	if err != nil {
+		panic(err)
+	}
+	fs.DirTTL = 50 * time.Millisecond
+	client := NewFileClient(fs)
+
+	assert.Equal(t, []string{".", "..", "changed", "removed", "same"}, listNames(client, t, "d1"))
+
+	// read the file which won't change so that its block gets cached
+	openResp, err := client.Open(&OpenReq{Path: "d1/same"})
+	assert.Nil(t, err)
+	_, err = client.Read(&ReadReq{FD: openResp.FD, Length: 4})
+	assert.Nil(t, err)
+	sameINode, err := fs.GetINodeForPath("d1/same")
+	assert.Nil(t, err)
+	changedINode, err := fs.GetINodeForPath("d1/changed")
+	assert.Nil(t, err)
+
+	writeFile(tmpDir+"/d1/changed", "new!", 10)
+	assert.Nil(t, os.Remove(tmpDir+"/d1/removed"))
+	writeFile(tmpDir+"/d1/added", "added", 10)
+
+	// before the TTL expires, the old listing is used
+	assert.Equal(t, []string{".", "..", "changed", "removed", "same"}, listNames(client, t, "d1"))
+
+	// after it expires, the next access kicks off a listing in the background
+	time.Sleep(100 * time.Millisecond)
+	assert.Eventually(t, func() bool {
+		return assert.ObjectsAreEqual([]string{".", "..", "added", "changed", "same"}, listNames(client, t, "d1"))
+	}, time.Second, 10*time.Millisecond)
+
+	// the unchanged file keeps its inode and cached block
+	inode, err := fs.GetINodeForPath("d1/same")
+	assert.Nil(t, err)
+	assert.Equal(t, sameINode, inode)
+	stat, err := client.Stat(&StatReq{Path: "d1/same"})
+	assert.Nil(t, err)
+	assert.Equal(t, 1, stat.CachedBlocks)
+
+	// while the changed one is replaced
+	inode, err = fs.GetINodeForPath("d1/changed")
+	assert.Nil(t, err)
+	assert.NotEqual(t, changedINode, inode)
+	openResp, err = client.Open(&OpenReq{Path: "d1/changed"})
+	assert.Nil(t, err)
+	readResp, err := client.Read(&ReadReq{FD: openResp.FD, Length: 4})
+	assert.Nil(t, err)
+	assert.Equal(t, "new!", string(readResp.Data))
+}
+
+func TestBlocksReusedAfterRestart(t *testing.T) {
+	workDir, err := os.MkdirTemp(os.TempDir(), "test")
+	if err != nil {
+		panic(err)
+	}
+
+	tmpDir, err := os.MkdirTemp(os.TempDir(), "test")
+	if err != nil {
+		panic(err)
+	}
+
+	writeFile(tmpDir+"/f1", "0123456789", 2)
+	writeFile(tmpDir+"/f2", "abcdefghij", 2)
+
+	readAll := func(fs *FileService, path string) string {
+		inode, err := fs.GetINodeForPath(path)
+		assert.Nil(t, err)
+		defer fs.INodes.UpdateRefCount(inode, -1)
+
+		buffer := make([]byte, 20)
+		n, err := fs.INodes.ReadFile(inode, 0, buffer)
+		assert.Nil(t, err)
+		return string(buffer[:n])
+	}
+
+	remote := &CountingRemoteProvider{RemoteProvider: &DirRemoteProvider{Root: tmpDir}}
+	fs, err := NewFileService(remote, workDir, 8)
+	if err != nil {
+		panic(err)
+	}
+	assert.Equal(t, "01234567890123456789", readAll(fs, "f1"))
+	assert.Equal(t, "abcdefghijabcdefghij", readAll(fs, "f2"))
+	// each file is fetched with a single read
+	assert.Equal(t, 2, int(remote.readerCount.Load()))
+
+	// modify f2 so the cached copy is stale
+	writeFile(tmpDir+"/f2", "ABCDEFGHIJ", 2)
+
+	// start a new service using the same work dir
+	assert.Nil(t, fs.Close())
+	remote = &CountingRemoteProvider{RemoteProvider: &DirRemoteProvider{Root: tmpDir}}
+	fs, err = NewFileService(remote, workDir, 8)
+	if err != nil {
+		panic(err)
+	}
+	assert.Equal(t, int64(40), fs.INodes.blocks.GetDiagnostics().BytesInUse)
+
+	// f1 is unchanged so should be read entirely from the cache
+	assert.Equal(t, "01234567890123456789", readAll(fs, "f1"))
+	assert.Equal(t, 0, int(remote.readerCount.Load()))
+
+	// but f2 has a different ETag, so must be fetched again
+	assert.Equal(t, "ABCDEFGHIJABCDEFGHIJ", readAll(fs, "f2"))
+	assert.Equal(t, 1, int(remote.readerCount.Load()))
+	// and the blocks of the old version are dropped, rather than kept until evicted
+	assert.Equal(t, int64(40), fs.INodes.blocks.GetDiagnostics().BytesInUse)
+
+	assert.Nil(t, fs.Close())
+	fs, err = NewFileService(remote, workDir, 8)
+	if err != nil {
+		panic(err)
+	}
+	assert.Equal(t, int64(40), fs.INodes.blocks.GetDiagnostics().BytesInUse)
+	assert.Equal(t, "ABCDEFGHIJABCDEFGHIJ", readAll(fs, "f2"))
+	assert.Equal(t, 1, int(remote.readerCount.Load()))
+}
+
 func TestWithDirRemote(t *testing.T) {
 	assert.Equal(t, 1, 1)
 
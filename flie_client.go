@@ -4,6 +4,7 @@ import (
 	"io"
 	"log"
 	"strings"
+	"time"
 )
 
 // Intended to be used by a single thread
@@ -14,6 +15,10 @@ type FileClient struct {
 
 	nextFileHandle  int
 	freeFileHandles []int
+
+	// if set, called with the intermediate progress of long running commands
+	// such as prefetch, before their result is returned
+	OnProgress func(progress interface{})
 }
 
 type FileClientDiagnostics struct {
@@ -37,6 +42,11 @@ func NewFileClient(fs *FileService) *FileClient {
 type FileHandle struct {
 	INode  INode
 	Offset int64
+	// the path the file was opened with
+	Path string
+
+	// where the last read on this handle ended. Used to detect sequential reads.
+	lastReadEnd int64
 }
 
 type FileClientDirEntry struct {
@@ -86,6 +96,90 @@ func (fc *FileClient) Forget(req *ForgetReq) (*CloseResp, error) {
 	return &CloseResp{}, nil
 }
 
+func (fc *FileClient) Mount(req *MountReq) (*MountResp, error) {
+	var dirTTL time.Duration
+	if req.DirTTL != "" {
+		var err error
+		dirTTL, err = time.ParseDuration(req.DirTTL)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	err := fc.FileService.checkMountAllowed(req.Remote)
+	if err != nil {
+		return nil, err
+	}
+
+	remote, err := fc.FileService.RemoteFactory(req.Remote)
+	if err != nil {
+		return nil, err
+	}
+
+	err = fc.FileService.Mount(req.Name, remote, dirTTL)
+	if err != nil {
+		return nil, err
+	}
+
+	return &MountResp{}, nil
+}
+
+func (fc *FileClient) Unmount(req *UnmountReq) (*UnmountResp, error) {
+	err := fc.FileService.Unmount(req.Name)
+	if err != nil {
+		return nil, err
+	}
+
+	return &UnmountResp{}, nil
+}
+
+// Snapshot returns a manifest of everything under the path
+func (fc *FileClient) Snapshot(req *SnapshotReq) (*SnapshotResp, error) {
+	manifest, err := fc.FileService.Snapshot(req.Path)
+	if err != nil {
+		return nil, err
+	}
+
+	resp := &SnapshotResp{Manifest: manifest}
+	for _, entry := range manifest.Entries {
+		if entry.IsDir {
+			resp.Dirs++
+		} else {
+			resp.Files++
+		}
+	}
+	return resp, nil
+}
+
+// sendPrefetchProgress passes along progress to OnProgress, except for the
+// final progress which is sent as the result instead
+func (fc *FileClient) sendPrefetchProgress(progress *PrefetchProgress) {
+	if fc.OnProgress != nil && !progress.Done {
+		fc.OnProgress(progress)
+	}
+}
+
+func (fc *FileClient) Prefetch(req *PrefetchReq) (*PrefetchProgress, error) {
+	return fc.FileService.Prefetch(req.Path, req.MetadataOnly, fc.sendPrefetchProgress)
+}
+
+func (fc *FileClient) Pin(req *PinReq) (*PrefetchProgress, error) {
+	return fc.FileService.Pin(req.Path, fc.sendPrefetchProgress)
+}
+
+func (fc *FileClient) Unpin(req *UnpinReq) (*UnpinResp, error) {
+	err := fc.FileService.Unpin(req.Path)
+	if err != nil {
+		return nil, err
+	}
+
+	return &UnpinResp{}, nil
+}
+
+func (fc *FileClient) Verify(req *VerifyReq) (*BlockVerification, error) {
+	return fc.FileService.Verify(), nil
+}
+
 func (fc *FileClient) ListDir(req *ListDirReq) (*ListDirResp, error) {
 	path := req.Path
 	inode, err := fc.GetINodeForPath(path)
@@ -110,6 +204,22 @@ func (fc *FileClient) ListDir(req *ListDirReq) (*ListDirResp, error) {
 	return &ListDirResp{Entries: fcde}, nil
 }
 
+func (fc *FileClient) Stat(req *StatReq) (*StatResp, error) {
+	inode, err := fc.GetINodeForPath(req.Path)
+	if err != nil {
+		return nil, err
+	}
+
+	defer fc.FileService.INodes.UpdateRefCount(inode, -1)
+
+	stat, err := fc.FileService.INodes.Stat(inode)
+	if err != nil {
+		return nil, err
+	}
+
+	return &StatResp{Size: stat.Size, IsDir: stat.IsDir, ETag: stat.ETag, BlockCount: stat.BlockCount, CachedBlocks: stat.CachedBlocks}, nil
+}
+
 const INVALID_FD = -1
 
 type Response interface{}
@@ -138,7 +248,7 @@ func (fc *FileClient) Open(req *OpenReq) (*OpenResp, error) {
 		fd = fc.freeFileHandles[len(fc.freeFileHandles)-1]
 		fc.freeFileHandles = fc.freeFileHandles[:len(fc.freeFileHandles)-1]
 	}
-	fc.FileHandles[fd] = &FileHandle{INode: inode, Offset: 0}
+	fc.FileHandles[fd] = &FileHandle{INode: inode, Offset: 0, Path: req.Path}
 
 	return &OpenResp{FD: fd}, nil
 }
@@ -162,12 +272,104 @@ func (fc *FileClient) Read(req *ReadReq) (*ReadResp, error) {
 		return nil, INVALID_HANDLE
 	}
 
-	buffer := make([]byte, req.Length)
-	n, err := fc.FileService.INodes.ReadFile(fh.INode, fh.Offset, buffer)
+	data, eof, err := fc.readAt(fh, fh.Offset, req.Length)
+	if err != nil {
+		return nil, err
+	}
+	fh.Offset += int64(len(data))
+
+	return &ReadResp{Data: data, EOF: eof}, nil
+}
+
+// readAt reads up to length bytes at offset, returning true if the read reached the end of the file
+func (fc *FileClient) readAt(fh *FileHandle, offset int64, length int) ([]byte, bool, error) {
+	if length < 0 {
+		return nil, false, INVALID_LENGTH
+	}
+
+	inodes := fc.FileService.INodes
+
+	// don't allocate more than is left in the file, however much was asked for
+	stat, err := inodes.Stat(fh.INode)
+	if err != nil {
+		return nil, false, err
+	}
+	remaining := stat.Size - offset
+	pastEnd := int64(length) > remaining
+	if pastEnd {
+		length = int(max(remaining, 0))
+	}
+
+	// if this read picks up where the last one left off, assume the
+	// reader is streaming through the file and start fetching the blocks
+	// after this read while this read is in progress
+	readEnd := offset + int64(length)
+	if offset == fh.lastReadEnd && fc.FileService.ReadaheadBlocks > 0 {
+		inodes.Prefetch(fh.INode, readEnd, int64(fc.FileService.ReadaheadBlocks)*inodes.blockSize)
+	}
+
+	buffer := make([]byte, length)
+	n, err := inodes.ReadFile(fh.INode, offset, buffer)
 	if err != nil && err != io.EOF {
+		return nil, false, err
+	}
+	fh.lastReadEnd = offset + int64(n)
+
+	return buffer[:n], err == io.EOF || pastEnd, nil
+}
+
+// PRead reads at the given offset without changing the offset of the file handle
+func (fc *FileClient) PRead(req *PReadReq) (*ReadResp, error) {
+	fh, ok := fc.FileHandles[req.FD]
+	if !ok {
+		return nil, INVALID_HANDLE
+	}
+
+	if req.Offset < 0 {
+		return nil, INVALID_OFFSET
+	}
+
+	data, eof, err := fc.readAt(fh, req.Offset, req.Length)
+	if err != nil {
 		return nil, err
 	}
-	fh.Offset += int64(n)
 
-	return &ReadResp{Data: buffer[:n]}, nil
+	return &ReadResp{Data: data, EOF: eof}, nil
+}
+
+const (
+	SEEK_SET = "SEEK_SET"
+	SEEK_CUR = "SEEK_CUR"
+	SEEK_END = "SEEK_END"
+)
+
+func (fc *FileClient) Seek(req *SeekReq) (*SeekResp, error) {
+	fh, ok := fc.FileHandles[req.FD]
+	if !ok {
+		return nil, INVALID_HANDLE
+	}
+
+	var base int64
+	switch req.Whence {
+	case SEEK_SET, "":
+		base = 0
+	case SEEK_CUR:
+		base = fh.Offset
+	case SEEK_END:
+		stat, err := fc.FileService.INodes.Stat(fh.INode)
+		if err != nil {
+			return nil, err
+		}
+		base = stat.Size
+	default:
+		return nil, INVALID_WHENCE
+	}
+
+	offset := base + int64(req.Offset)
+	if offset < 0 {
+		return nil, INVALID_OFFSET
+	}
+	fh.Offset = offset
+
+	return &SeekResp{Offset: int(offset)}, nil
 }
@@ -2,13 +2,16 @@ package treeply
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"io"
 	"log"
+	"net/http"
 	"regexp"
 	"strconv"
 
 	"cloud.google.com/go/storage"
+	"google.golang.org/api/googleapi"
 	"google.golang.org/api/iterator"
 )
 
@@ -17,12 +20,25 @@ type GCSRemoteProvider struct {
 	root   string
 }
 
-func NewGCSRemoteProvider(ctx context.Context, root string) *GCSRemoteProvider {
+func NewGCSRemoteProvider(ctx context.Context, root string) (*GCSRemoteProvider, error) {
 	client, err := storage.NewClient(ctx)
 	if err != nil {
-		log.Fatal(err)
+		return nil, err
 	}
-	return &GCSRemoteProvider{client: client, root: root}
+	return &GCSRemoteProvider{client: client, root: root}, nil
+}
+
+func init() {
+	registerRemoteErrno(func(err error) (string, bool) {
+		if errors.Is(err, storage.ErrObjectNotExist) || errors.Is(err, storage.ErrBucketNotExist) {
+			return ENOENT, true
+		}
+		var apiError *googleapi.Error
+		if errors.As(err, &apiError) {
+			return statusCodeErrno(apiError.Code)
+		}
+		return "", false
+	})
 }
 
 var GCSPathRegEx = regexp.MustCompile("gs://([^/]+)/(.*)$")
@@ -72,24 +88,37 @@ func (g *GCSRemoteProvider) GetDirListing(ctx context.Context, path string) ([]R
 
 			name = name[len(prefix):]
 
+			// composite objects only have a CRC32C
+			var checksum string
+			if len(objAttr.MD5) > 0 {
+				checksum = FormatChecksum(ChecksumMD5, objAttr.MD5)
+			} else if !isDir {
+				checksum = formatCRC32Checksum(ChecksumCRC32C, objAttr.CRC32C)
+			}
+
 			result = append(result, RemoteFile{
-				Name:  name,
-				IsDir: isDir,
-				ETag:  fmt.Sprintf("%d", objAttr.Generation),
-				Size:  objAttr.Size,
+				Name:     name,
+				IsDir:    isDir,
+				ETag:     fmt.Sprintf("%d", objAttr.Generation),
+				Size:     objAttr.Size,
+				Checksum: checksum,
 			})
 		}
 		if err == iterator.Done {
 			log.Printf("Reached end of iterator")
 			break
 		}
+		if err != nil {
+			return nil, err
+		}
 	}
 	return result, nil
 }
 func (g *GCSRemoteProvider) GetReader(ctx context.Context, path string, ETag string, Offset int64, Length int64) (io.Reader, error) {
 	generationID, err := strconv.ParseInt(ETag, 10, 64)
 	if err != nil {
-		panic("Could not convert etag to int")
+		// not a generation, so it can't be a version of any object in GCS
+		return nil, FILE_CHANGED
 	}
 
 	bucketName, key, err := parseGCSPath(pathConcat(g.root, path))
@@ -100,6 +129,11 @@ func (g *GCSRemoteProvider) GetReader(ctx context.Context, path string, ETag str
 	obj := bucket.Object(key)
 	reader, err := obj.If(storage.Conditions{GenerationMatch: generationID}).NewRangeReader(ctx, Offset, Length)
 	if err != nil {
+		// the object was deleted or replaced with a new generation
+		var apiError *googleapi.Error
+		if errors.Is(err, storage.ErrObjectNotExist) || (errors.As(err, &apiError) && apiError.Code == http.StatusPreconditionFailed) {
+			return nil, FILE_CHANGED
+		}
 		return nil, err
 	}
 	return reader, nil
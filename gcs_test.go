@@ -10,7 +10,8 @@ import (
 
 func TestGCS(t *testing.T) {
 	ctx := context.Background()
-	gcs := NewGCSRemoteProvider(ctx, "gs://")
+	gcs, err := NewGCSRemoteProvider(ctx, "gs://")
+	assert.Nil(t, err)
 	files, err := gcs.GetDirListing(ctx, "gcp-public-data-arco-era5/co/model-level-moisture.zarr-v2")
 	assert.Nil(t, err)
 	byName := make(map[string]*RemoteFile)
@@ -25,3 +26,10 @@ func TestGCS(t *testing.T) {
 
 	assert.False(t, byName[".zattrs"].IsDir)
 }
+
+func TestGCSReaderWithForeignETag(t *testing.T) {
+	// an ETag from another kind of remote is rejected before GCS is contacted
+	remote := &GCSRemoteProvider{root: "gs://bucket"}
+	_, err := remote.GetReader(context.Background(), "f1", "\"abc\"", 0, 10)
+	assert.Equal(t, FILE_CHANGED, err)
+}
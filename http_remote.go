@@ -0,0 +1,327 @@
+package treeply
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// the number of HEAD requests made at once to fill in a listing
+const HTTPHeadConcurrency = 8
+
+// HTTPRemoteProvider reads files from a plain web server using range
+// requests. Directory listings come from a JSON index file in each directory
+// if IndexFilename is set, and otherwise by parsing the server's
+// auto-generated index pages.
+type HTTPRemoteProvider struct {
+	client *http.Client
+	root   string
+	// the name of the file in each directory which holds a JSON list of
+	// RemoteFile records. If empty, listings are parsed from the html index.
+	IndexFilename string
+}
+
+type HTTPRemoteProviderDiagnostics struct {
+	Root          string
+	IndexFilename string
+}
+
+func NewHTTPRemoteProvider(root string, indexFilename string) *HTTPRemoteProvider {
+	return &HTTPRemoteProvider{client: &http.Client{}, root: strings.TrimSuffix(root, "/"),
+		IndexFilename: indexFilename}
+}
+
+func (h *HTTPRemoteProvider) GetDiagnostics() interface{} {
+	return &HTTPRemoteProviderDiagnostics{Root: h.root, IndexFilename: h.IndexFilename}
+}
+
+// getURL returns the url for the given path, escaping each path component
+func (h *HTTPRemoteProvider) getURL(path string) string {
+	if path == "" {
+		return h.root
+	}
+	components := strings.Split(path, "/")
+	for i, component := range components {
+		components[i] = url.PathEscape(component)
+	}
+	return pathConcat(h.root, strings.Join(components, "/"))
+}
+
+// checkHTTPResponse converts an unsuccessful response into an error, flagging
+// the ones which are worth retrying
+func checkHTTPResponse(resp *http.Response) error {
+	if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+		return nil
+	}
+	if resp.StatusCode == http.StatusNotFound {
+		return fmt.Errorf("GET %s failed: %w", resp.Request.URL, fs.ErrNotExist)
+	}
+	err := fmt.Errorf("GET %s failed with status %s", resp.Request.URL, resp.Status)
+	if resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= 500 {
+		return &TransientError{Err: err}
+	}
+	return err
+}
+
+func (h *HTTPRemoteProvider) get(ctx context.Context, url string) ([]byte, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := h.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	err = checkHTTPResponse(resp)
+	if err != nil {
+		return nil, err
+	}
+	return io.ReadAll(resp.Body)
+}
+
+func (h *HTTPRemoteProvider) GetDirListing(ctx context.Context, path string) ([]RemoteFile, error) {
+	var files []RemoteFile
+	var err error
+	if h.IndexFilename != "" {
+		files, err = h.readIndexFile(ctx, path)
+	} else {
+		files, err = h.readAutoIndex(ctx, path)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	// fill in anything the listing didn't tell us by asking for the file's headers
+	var wg sync.WaitGroup
+	slots := make(chan bool, HTTPHeadConcurrency)
+	errs := make([]error, len(files))
+	for i := range files {
+		file := &files[i]
+		if file.IsDir || file.ETag != "" {
+			continue
+		}
+		slots <- true
+		wg.Add(1)
+		go (func(i int) {
+			defer wg.Done()
+			file.ETag, file.Size, errs[i] = h.head(ctx, pathConcat(path, file.Name))
+			<-slots
+		})(i)
+	}
+	wg.Wait()
+	for _, err := range errs {
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return files, nil
+}
+
+func (h *HTTPRemoteProvider) readIndexFile(ctx context.Context, path string) ([]RemoteFile, error) {
+	body, err := h.get(ctx, h.getURL(pathConcat(path, h.IndexFilename)))
+	if err != nil {
+		return nil, err
+	}
+
+	var entries []RemoteFile
+	err = json.Unmarshal(body, &entries)
+	if err != nil {
+		return nil, fmt.Errorf("Could not parse %s in %s: %s", h.IndexFilename, path, err)
+	}
+
+	files := make([]RemoteFile, 0, len(entries))
+	seen := make(map[string]bool)
+	for _, file := range entries {
+		if !isValidEntryName(file.Name) || seen[file.Name] {
+			log.Printf("Skipping invalid entry %q in %s in %s", file.Name, h.IndexFilename, path)
+			continue
+		}
+		seen[file.Name] = true
+		files = append(files, file)
+	}
+	return files, nil
+}
+
+// isValidEntryName returns false for names which can't be a direct child of a directory
+func isValidEntryName(name string) bool {
+	return name != "" && name != "." && name != ".." && !strings.Contains(name, "/")
+}
+
+var hrefRegEx = regexp.MustCompile(`(?i)<a\s[^>]*href\s*=\s*"([^"]*)"`)
+
+// parseAutoIndex extracts the entries from an index page as generated by
+// nginx, apache, or Go's http.FileServer. Only relative links to direct
+// children are considered entries, and those ending in "/" are directories.
+func parseAutoIndex(page string) []RemoteFile {
+	files := make([]RemoteFile, 0)
+	seen := make(map[string]bool)
+	for _, match := range hrefRegEx.FindAllStringSubmatch(page, -1) {
+		href := strings.TrimPrefix(match[1], "./")
+		if href == "" || strings.ContainsAny(href, "?#:") || strings.HasPrefix(href, "/") || strings.HasPrefix(href, "..") {
+			// sort links, parent dir, or links elsewhere
+			continue
+		}
+
+		isDir := strings.HasSuffix(href, "/")
+		name, err := url.PathUnescape(strings.TrimSuffix(href, "/"))
+		if err != nil || !isValidEntryName(name) || seen[name] {
+			continue
+		}
+		seen[name] = true
+		files = append(files, RemoteFile{Name: name, IsDir: isDir})
+	}
+	return files
+}
+
+func (h *HTTPRemoteProvider) readAutoIndex(ctx context.Context, path string) ([]RemoteFile, error) {
+	body, err := h.get(ctx, h.getURL(path)+"/")
+	if err != nil {
+		return nil, err
+	}
+	log.Printf("Parsing index page for %s", path)
+	return parseAutoIndex(string(body)), nil
+}
+
+// head returns the ETag and size of a file
+func (h *HTTPRemoteProvider) head(ctx context.Context, path string) (string, int64, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodHead, h.getURL(path), nil)
+	if err != nil {
+		return "", 0, err
+	}
+	resp, err := h.client.Do(req)
+	if err != nil {
+		return "", 0, err
+	}
+	resp.Body.Close()
+
+	err = checkHTTPResponse(resp)
+	if err != nil {
+		return "", 0, err
+	}
+	if resp.ContentLength < 0 {
+		return "", 0, fmt.Errorf("Server did not report the size of %s", path)
+	}
+
+	etag := resp.Header.Get("ETag")
+	if etag == "" {
+		// without an ETag, fall back to detecting changes by the modification time
+		etag = fmt.Sprintf("%d %s", resp.ContentLength, resp.Header.Get("Last-Modified"))
+	}
+	return etag, resp.ContentLength, nil
+}
+
+func isHTTPETag(etag string) bool {
+	return strings.HasSuffix(etag, "\"")
+}
+
+// parseFallbackETag splits an ETag made by head for a server which doesn't
+// send ETags into the file's size and Last-Modified header
+func parseFallbackETag(etag string) (int64, string, bool) {
+	sizeText, lastModified, ok := strings.Cut(etag, " ")
+	if !ok {
+		return 0, "", false
+	}
+	size, err := strconv.ParseInt(sizeText, 10, 64)
+	if err != nil {
+		return 0, "", false
+	}
+	if lastModified != "" {
+		_, err = http.ParseTime(lastModified)
+		if err != nil {
+			return 0, "", false
+		}
+	}
+	return size, lastModified, true
+}
+
+// getResponseFileSize returns the size of the whole file a GET response is
+// for, or -1 if the server didn't say
+func getResponseFileSize(resp *http.Response) int64 {
+	if resp.StatusCode != http.StatusPartialContent {
+		return resp.ContentLength
+	}
+	_, total, ok := strings.Cut(resp.Header.Get("Content-Range"), "/")
+	if !ok {
+		return -1
+	}
+	size, err := strconv.ParseInt(total, 10, 64)
+	if err != nil {
+		return -1
+	}
+	return size
+}
+
+func (h *HTTPRemoteProvider) GetReader(ctx context.Context, path string, ETag string, Offset int64, Length int64) (io.Reader, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, h.getURL(path), nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Range", fmt.Sprintf("bytes=%d-%d", Offset, Offset+Length-1))
+	// If-Match only works with strong ETags, so weak ones are checked against the response instead
+	if isHTTPETag(ETag) && !strings.HasPrefix(ETag, "W/") {
+		req.Header.Set("If-Match", ETag)
+	}
+	fallbackSize, fallbackLastModified, isFallbackETag := parseFallbackETag(ETag)
+	if isFallbackETag && fallbackLastModified != "" {
+		req.Header.Set("If-Unmodified-Since", fallbackLastModified)
+	}
+
+	resp, err := h.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+
+	switch resp.StatusCode {
+	case http.StatusPreconditionFailed, http.StatusNotFound, http.StatusGone:
+		resp.Body.Close()
+		return nil, FILE_CHANGED
+	case http.StatusRequestedRangeNotSatisfiable:
+		// the range starts past the end of the file
+		resp.Body.Close()
+		return strings.NewReader(""), nil
+	}
+	err = checkHTTPResponse(resp)
+	if err != nil {
+		resp.Body.Close()
+		return nil, err
+	}
+
+	if isHTTPETag(ETag) && resp.Header.Get("ETag") != "" && resp.Header.Get("ETag") != ETag {
+		resp.Body.Close()
+		return nil, FILE_CHANGED
+	}
+	// without an ETag, the size and modification time are all there is to go on
+	if isFallbackETag {
+		size := getResponseFileSize(resp)
+		if (size >= 0 && size != fallbackSize) || resp.Header.Get("Last-Modified") != fallbackLastModified {
+			resp.Body.Close()
+			return nil, FILE_CHANGED
+		}
+	}
+
+	if resp.StatusCode == http.StatusOK {
+		// the server ignored the range, so skip to the part we asked for
+		_, err = io.CopyN(io.Discard, resp.Body, Offset)
+		if err != nil && err != io.EOF {
+			resp.Body.Close()
+			return nil, err
+		}
+	}
+
+	return &closeOnEOFReader{body: struct {
+		io.Reader
+		io.Closer
+	}{io.LimitReader(resp.Body, Length), resp.Body}}, nil
+}
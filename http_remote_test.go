@@ -0,0 +1,266 @@
+package treeply
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// newTestHTTPServer serves the files in root with ETags and range support,
+// and uses http.FileServer to generate index pages for directories
+func newTestHTTPServer(root string) *httptest.Server {
+	fileServer := http.FileServer(http.Dir(root))
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fi, err := os.Stat(filepath.Join(root, r.URL.Path))
+		if err != nil || fi.IsDir() {
+			fileServer.ServeHTTP(w, r)
+			return
+		}
+
+		f, err := os.Open(filepath.Join(root, r.URL.Path))
+		if err != nil {
+			panic(err)
+		}
+		defer f.Close()
+		w.Header().Set("ETag", fmt.Sprintf("\"%d-%d\"", fi.Size(), fi.ModTime().UnixNano()))
+		http.ServeContent(w, r, fi.Name(), fi.ModTime(), f)
+	}))
+}
+
+func sortedNames(files []RemoteFile) []string {
+	names := make([]string, 0, len(files))
+	for _, file := range files {
+		if file.IsDir {
+			names = append(names, file.Name+"/")
+		} else {
+			names = append(names, file.Name)
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+func TestParseAutoIndex(t *testing.T) {
+	// roughly what nginx generates
+	page := `<html><head><title>Index of /data/</title></head><body>
+<h1>Index of /data/</h1><hr><pre><a href="../">../</a>
+<a href="?C=N;O=D">Name</a>
+<a href="d1/">d1/</a>                                               01-Jan-2024 00:00       -
+<a href="f%201.txt">f 1.txt</a>                                     01-Jan-2024 00:00      20
+<a href="http://example.com/">elsewhere</a>
+</pre><hr></body></html>`
+	assert.Equal(t, []RemoteFile{{Name: "d1", IsDir: true}, {Name: "f 1.txt"}}, parseAutoIndex(page))
+}
+
+func TestHTTPRemoteProvider(t *testing.T) {
+	tmpDir, err := os.MkdirTemp(os.TempDir(), "test")
+	if err != nil {
+		panic(err)
+	}
+
+	writeFile(tmpDir+"/f1", "f1", 10)
+	writeFile(tmpDir+"/d1/f 2", "d1f2", 30)
+
+	server := newTestHTTPServer(tmpDir)
+	defer server.Close()
+
+	ctx := context.Background()
+	remote := NewHTTPRemoteProvider(server.URL+"/", "")
+
+	files, err := remote.GetDirListing(ctx, "")
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"d1/", "f1"}, sortedNames(files))
+
+	files, err = remote.GetDirListing(ctx, "d1")
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(files))
+	assert.Equal(t, "f 2", files[0].Name)
+	assert.Equal(t, int64(120), files[0].Size)
+
+	reader, err := remote.GetReader(ctx, "d1/f 2", files[0].ETag, 4, 8)
+	assert.Nil(t, err)
+	buffer, err := io.ReadAll(reader)
+	assert.Nil(t, err)
+	assert.Equal(t, "d1f2d1f2", string(buffer))
+
+	// once the file is replaced, reads of the old version should fail
+	writeFile(tmpDir+"/d1/f 2", "changed", 1)
+	_, err = remote.GetReader(ctx, "d1/f 2", files[0].ETag, 0, 8)
+	assert.Equal(t, FILE_CHANGED, err)
+
+	_, err = remote.GetDirListing(ctx, "missing")
+	assert.NotNil(t, err)
+}
+
+func TestHTTPRemoteProviderWithoutETags(t *testing.T) {
+	tmpDir, err := os.MkdirTemp(os.TempDir(), "test")
+	if err != nil {
+		panic(err)
+	}
+
+	modTime := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+	writeFile(tmpDir+"/f1", "f1", 10)
+	err = os.Chtimes(tmpDir+"/f1", modTime, modTime)
+	if err != nil {
+		panic(err)
+	}
+
+	// http.FileServer only sends Last-Modified
+	server := httptest.NewServer(http.FileServer(http.Dir(tmpDir)))
+	defer server.Close()
+
+	ctx := context.Background()
+	remote := NewHTTPRemoteProvider(server.URL, "")
+
+	files, err := remote.GetDirListing(ctx, "")
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(files))
+	assert.Equal(t, "20 Tue, 02 Jan 2024 03:04:05 GMT", files[0].ETag)
+
+	reader, err := remote.GetReader(ctx, "f1", files[0].ETag, 2, 4)
+	assert.Nil(t, err)
+	buffer, err := io.ReadAll(reader)
+	assert.Nil(t, err)
+	assert.Equal(t, "f1f1", string(buffer))
+
+	// a file of another size with the same modification time has changed
+	writeFile(tmpDir+"/f1", "f1", 11)
+	err = os.Chtimes(tmpDir+"/f1", modTime, modTime)
+	if err != nil {
+		panic(err)
+	}
+	_, err = remote.GetReader(ctx, "f1", files[0].ETag, 2, 4)
+	assert.Equal(t, FILE_CHANGED, err)
+
+	// as has a file of the same size which was modified later
+	writeFile(tmpDir+"/f1", "f2", 10)
+	err = os.Chtimes(tmpDir+"/f1", modTime.Add(time.Hour), modTime.Add(time.Hour))
+	if err != nil {
+		panic(err)
+	}
+	_, err = remote.GetReader(ctx, "f1", files[0].ETag, 2, 4)
+	assert.Equal(t, FILE_CHANGED, err)
+}
+
+func TestHTTPRemoteProviderWithIndexFile(t *testing.T) {
+	tmpDir, err := os.MkdirTemp(os.TempDir(), "test")
+	if err != nil {
+		panic(err)
+	}
+
+	writeFile(tmpDir+"/f1", "f1", 10)
+	writeFile(tmpDir+"/f2", "f2", 20)
+	writeFile(tmpDir+"/unlisted", "x", 1)
+	// the ETag and size of f2 are left out so must be looked up
+	index, err := json.Marshal([]RemoteFile{{Name: "f1", ETag: "v1", Size: 20}, {Name: "f2"}, {Name: "d1", IsDir: true}})
+	if err != nil {
+		panic(err)
+	}
+	writeFile(tmpDir+"/index.json", string(index), 1)
+
+	server := newTestHTTPServer(tmpDir)
+	defer server.Close()
+
+	workDir, err := os.MkdirTemp(os.TempDir(), "test")
+	if err != nil {
+		panic(err)
+	}
+
+	remote := NewHTTPRemoteProvider(server.URL, "index.json")
+	fs, err := NewFileService(remote, workDir, 8)
+	if err != nil {
+		panic(err)
+	}
+	client := NewFileClient(fs)
+
+	resp, err := client.ListDir(&ListDirReq{Path: "."})
+	assert.Nil(t, err)
+	names := make([]string, 0, len(resp.Entries))
+	for _, entry := range resp.Entries {
+		names = append(names, entry.Name)
+	}
+	sort.Strings(names)
+	assert.Equal(t, []string{".", "..", "d1", "f1", "f2"}, names)
+
+	statResp, err := client.Stat(&StatReq{Path: "f2"})
+	assert.Nil(t, err)
+	assert.Equal(t, int64(40), statResp.Size)
+
+	openResp, err := client.Open(&OpenReq{Path: "f2"})
+	assert.Nil(t, err)
+	readResp, err := client.Read(&ReadReq{FD: openResp.FD, Length: 40})
+	assert.Nil(t, err)
+	assert.Equal(t, strings.Repeat("f2", 20), string(readResp.Data))
+}
+
+func TestHTTPRemoteProviderWithInvalidIndexEntries(t *testing.T) {
+	tmpDir, err := os.MkdirTemp(os.TempDir(), "test")
+	if err != nil {
+		panic(err)
+	}
+
+	entries := []RemoteFile{{Name: ""}, {Name: "."}, {Name: ".."}, {Name: "../f0"}, {Name: "d1/f0"}}
+	expectedNames := make([]string, 0)
+	for i := 0; i < 20; i++ {
+		name := fmt.Sprintf("f%d", i)
+		writeFile(tmpDir+"/"+name, name, 10)
+		// the ETags are left out so each must be looked up
+		entries = append(entries, RemoteFile{Name: name}, RemoteFile{Name: name})
+		expectedNames = append(expectedNames, name)
+	}
+	sort.Strings(expectedNames)
+	index, err := json.Marshal(entries)
+	if err != nil {
+		panic(err)
+	}
+	writeFile(tmpDir+"/index.json", string(index), 1)
+
+	// track how many HEAD requests are in progress at once
+	var lock sync.Mutex
+	activeHeads := 0
+	maxActiveHeads := 0
+	fileServer := newTestHTTPServer(tmpDir)
+	defer fileServer.Close()
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodHead {
+			lock.Lock()
+			activeHeads++
+			maxActiveHeads = max(maxActiveHeads, activeHeads)
+			lock.Unlock()
+			time.Sleep(10 * time.Millisecond)
+			defer (func() {
+				lock.Lock()
+				activeHeads--
+				lock.Unlock()
+			})()
+		}
+		fileServer.Config.Handler.ServeHTTP(w, r)
+	}))
+	defer server.Close()
+
+	// names which aren't a direct child are dropped, rather than reaching pathConcat
+	remote := NewHTTPRemoteProvider(server.URL, "index.json")
+	files, err := remote.GetDirListing(context.Background(), "")
+	assert.Nil(t, err)
+	assert.Equal(t, expectedNames, sortedNames(files))
+	for _, file := range files {
+		assert.Equal(t, int64(len(file.Name)*10), file.Size)
+	}
+
+	lock.Lock()
+	defer lock.Unlock()
+	assert.Greater(t, maxActiveHeads, 1)
+	assert.LessOrEqual(t, maxActiveHeads, HTTPHeadConcurrency)
+}
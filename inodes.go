@@ -1,23 +1,31 @@
 package treeply
 
 import (
-	"fmt"
 	"io"
 	"log"
 	"os"
+	"time"
 )
 
+// The number of times ReadFile will request missing blocks without any of
+// them arriving before giving up
+const MaxBlockRequestAttempts = 3
+
 func NewINodes(workDir string, blockSize int) (*INodes, error) {
 	inodes := &INodes{inodeStates: make(map[INode]*INodeState), workDir: workDir,
 		blockSize: int64(blockSize),
-		blocks: &Blocks{nextBlockID: 1, blockStates: map[BlockID]*BlockState{},
-			dir: workDir + "/blocks", blockSize: uint64(blockSize)}}
+		blocks:    newBlocks(workDir+"/blocks", blockSize)}
 
 	err := os.MkdirAll(inodes.blocks.dir, 0777)
 	if err != nil {
 		return nil, err
 	}
 
+	err = inodes.blocks.loadIndex()
+	if err != nil {
+		return nil, err
+	}
+
 	return inodes, nil
 }
 
@@ -63,6 +71,10 @@ func (i *INodes) CreateLazyDir(parentINode INode, callback *LazyDirectoryCallbac
 	i.lock.Lock()
 	defer i.lock.Unlock()
 
+	return i.createLazyDirWithNoLock(parentINode, callback)
+}
+
+func (i *INodes) createLazyDirWithNoLock(parentINode INode, callback *LazyDirectoryCallback) INode {
 	inode := i.getNextINode()
 	if parentINode == 0 {
 		// special case: Root is it's own parent
@@ -76,16 +88,22 @@ func (i *INodes) CreateLazyDir(parentINode INode, callback *LazyDirectoryCallbac
 	return inode
 }
 
-func (i *INodes) CreateLazyFile(length int64, requestCallback RequestCallback) INode {
-	blocks := make([]BlockID, (length+i.blockSize-1)/i.blockSize)
-
+func (i *INodes) CreateLazyFile(length int64, etag string, requestCallback RequestCallback) INode {
 	i.lock.Lock()
 	defer i.lock.Unlock()
+
+	return i.createLazyFileWithNoLock(length, etag, requestCallback)
+}
+
+func (i *INodes) createLazyFileWithNoLock(length int64, etag string, requestCallback RequestCallback) INode {
+	blocks := make([]BlockID, (length+i.blockSize-1)/i.blockSize)
+
 	inode := i.getNextINode()
 	i.inodeStates[inode] = &INodeState{
 		refCount:        1,
 		requestCallback: requestCallback,
 		length:          length,
+		etag:            etag,
 		blocks:          blocks,
 		isDir:           false}
 	return inode
@@ -103,8 +121,10 @@ func (i *INodes) updateRefCountWithNoLock(inode INode, delta int) int {
 	} else if refCount == 0 {
 		log.Printf("inode %d refcount == 0, releasing...", inode)
 		// free inode
-		for _, blockID := range inodeState.blocks {
-			i.blocks.UpdateRefCount(blockID, -1)
+		for index, blockID := range inodeState.blocks {
+			if blockID != UNALLOCATED_BLOCK_ID {
+				i.blocks.releaseOwner(blockID, INodeBlock{INode: inode, BlockIndex: index})
+			}
 		}
 		delete(i.inodeStates, inode)
 	}
@@ -112,8 +132,11 @@ func (i *INodes) updateRefCountWithNoLock(inode INode, delta int) int {
 }
 
 type INodeStat struct {
-	Size  int64
-	IsDir bool
+	Size         int64
+	IsDir        bool
+	ETag         string
+	BlockCount   int
+	CachedBlocks int
 }
 
 func (i *INodes) Stat(inode INode) (*INodeStat, error) {
@@ -125,7 +148,18 @@ func (i *INodes) Stat(inode INode) (*INodeStat, error) {
 		return nil, INVALID_INODE
 	}
 
-	return &INodeStat{IsDir: inodeState.isDir}, nil
+	cachedBlocks := 0
+	for _, blockID := range inodeState.blocks {
+		if blockID != UNALLOCATED_BLOCK_ID {
+			cachedBlocks++
+		}
+	}
+
+	return &INodeStat{IsDir: inodeState.isDir,
+		Size:         inodeState.length,
+		ETag:         inodeState.etag,
+		BlockCount:   len(inodeState.blocks),
+		CachedBlocks: cachedBlocks}, nil
 }
 
 func (i *INodes) UpdateRefCount(inode INode, delta int) int {
@@ -136,52 +170,189 @@ func (i *INodes) UpdateRefCount(inode INode, delta int) int {
 	return refCount
 }
 
-func (in *INodes) SetDirEntry(inode INode, name string, _inode INode) {
+func (in *INodes) SetDirEntry(inode INode, name string, _inode INode) error {
 	in.lock.Lock()
 	defer in.lock.Unlock()
 
 	inodeState, ok := in.inodeStates[inode]
 	if !ok {
-		panic("no such inode")
+		return INVALID_INODE
 	}
 
 	inodeState.dirEntries.SetEntry(name, _inode)
+	return nil
+}
+
+// RemoveDirEntry removes the named entry from the directory. The caller is
+// responsible for releasing the reference the entry held.
+func (in *INodes) RemoveDirEntry(inode INode, name string) error {
+	in.lock.Lock()
+	defer in.lock.Unlock()
+
+	inodeState, ok := in.inodeStates[inode]
+	if !ok {
+		return INVALID_INODE
+	}
 
+	inodeState.dirEntries.RemoveEntry(name)
+	return nil
 }
 
-func (in *INodes) SetDirEntries(inode INode, dirEntries []DirEntry) {
+func (in *INodes) SetDirEntries(inode INode, dirEntries []DirEntry) error {
 	in.lock.Lock()
 	defer in.lock.Unlock()
 
 	inodeState, ok := in.inodeStates[inode]
 	if !ok {
-		panic("no such inode")
+		return INVALID_INODE
 	}
 
 	inodeState.dirEntries.Set(dirEntries)
 	inodeState.isDirPopulated = true
+	inodeState.listedAt = time.Now()
+	inodeState.dirListingFailed = nil
+	return nil
+}
+
+// MergeDirListing brings a populated directory up to date with a new listing
+// of it. Entries whose type, size and ETag are unchanged keep their inode, and
+// with it any blocks already fetched. Only entries which were added or changed
+// get new inodes, and entries which are no longer listed are removed.
+func (in *INodes) MergeDirListing(inode INode, files []RemoteFile, makeDirCallback func(name string) *LazyDirectoryCallback, makeFileCallback func(name string, etag string, checksum string) RequestCallback) error {
+	in.lock.Lock()
+	defer in.lock.Unlock()
+
+	inodeState, ok := in.inodeStates[inode]
+	if !ok {
+		return INVALID_INODE
+	}
+	if !inodeState.isDir {
+		return IS_NOT_DIR
+	}
+
+	listed := make(map[string]bool)
+	changed := 0
+	for _, file := range files {
+		listed[file.Name] = true
+
+		existing, err := inodeState.dirEntries.Lookup(file.Name)
+		if err == nil {
+			existingState, ok := in.inodeStates[existing]
+			if ok && existingState.isDir == file.IsDir && (file.IsDir || (existingState.etag == file.ETag && existingState.length == file.Size)) {
+				continue
+			}
+		}
+
+		var child INode
+		if file.IsDir {
+			child = in.createLazyDirWithNoLock(inode, makeDirCallback(file.Name))
+		} else {
+			child = in.createLazyFileWithNoLock(file.Size, file.ETag, makeFileCallback(file.Name, file.ETag, file.Checksum))
+		}
+		inodeState.dirEntries.SetEntry(file.Name, child)
+		if err == nil {
+			// anyone who already has the old version open keeps their own reference to it
+			in.updateRefCountWithNoLock(existing, -1)
+		}
+		changed++
+	}
+
+	for _, entry := range inodeState.dirEntries.Get() {
+		if entry.Name == "." || entry.Name == ".." || listed[entry.Name] {
+			continue
+		}
+		inodeState.dirEntries.RemoveEntry(entry.Name)
+		in.updateRefCountWithNoLock(entry.INode, -1)
+		changed++
+	}
+
+	log.Printf("Revalidated dir inode %d: %d entries changed", inode, changed)
+	inodeState.isDirPopulated = true
+	inodeState.listedAt = time.Now()
+	return nil
+}
+
+// revalidateIfStaleWithNoLock starts listing the directory again in the
+// background if its listing is older than its TTL. Until that completes,
+// the existing entries continue to be used.
+func (in *INodes) revalidateIfStaleWithNoLock(inode INode, inodeState *INodeState) {
+	callback := inodeState.lazyDirectoryCallback
+	if !inodeState.isDirPopulated || inodeState.revalidating || callback == nil || callback.RevalidateDirEntries == nil || callback.GetTTL == nil {
+		return
+	}
+	ttl := callback.GetTTL()
+	if ttl <= 0 || time.Since(inodeState.listedAt) < ttl {
+		return
+	}
+
+	inodeState.revalidating = true
+	// hold a reference so the inode isn't released while the listing is outstanding
+	in.updateRefCountWithNoLock(inode, 1)
+	go (func() {
+		err := callback.RevalidateDirEntries(inode)
+		if err != nil {
+			log.Printf("Revalidating dir inode %d failed, keeping the previous listing: %s", inode, err)
+		}
 
+		in.lock.Lock()
+		defer in.lock.Unlock()
+		inodeState.revalidating = false
+		if err != nil {
+			// wait another TTL before trying again, rather than retrying on every access
+			inodeState.listedAt = time.Now()
+		}
+		in.updateRefCountWithNoLock(inode, -1)
+	})()
 }
 
-func (in *INodes) MarkUnreadable(inode INode, failure error) {
+func (in *INodes) MarkUnreadable(inode INode, failure error) error {
 	in.lock.Lock()
 	defer in.lock.Unlock()
 
 	inodeState, ok := in.inodeStates[inode]
 	if !ok {
-		panic("no such inode")
+		return INVALID_INODE
 	}
 
 	inodeState.readFailed = failure
+	return nil
 }
 
-func (in *INodes) SetBlock(inode INode, index int, blockID BlockID) {
+// MarkDirListingFailed records that the listing of this directory could not be fetched
+func (in *INodes) MarkDirListingFailed(inode INode, failure error) error {
 	in.lock.Lock()
 	defer in.lock.Unlock()
 
 	inodeState, ok := in.inodeStates[inode]
 	if !ok {
-		panic("no such inode")
+		return INVALID_INODE
+	}
+
+	inodeState.dirListingFailed = failure
+	return nil
+}
+
+// GetDirListingError returns the error from the last failed attempt to list
+// this directory, or nil if it has not failed
+func (in *INodes) GetDirListingError(inode INode) error {
+	in.lock.Lock()
+	defer in.lock.Unlock()
+
+	inodeState, ok := in.inodeStates[inode]
+	if !ok {
+		return INVALID_INODE
+	}
+
+	return inodeState.dirListingFailed
+}
+
+func (in *INodes) SetBlock(inode INode, index int, blockID BlockID) error {
+	in.lock.Lock()
+	defer in.lock.Unlock()
+
+	inodeState, ok := in.inodeStates[inode]
+	if !ok {
+		return INVALID_INODE
 	}
 
 	// add extra blocks if index is past the end, suggesting the file has gotten longer
@@ -189,25 +360,282 @@ func (in *INodes) SetBlock(inode INode, index int, blockID BlockID) {
 		inodeState.blocks = append(inodeState.blocks, UNALLOCATED_BLOCK_ID)
 	}
 
+	owner := INodeBlock{INode: inode, BlockIndex: index}
+	prevBlockID := inodeState.blocks[index]
+	if prevBlockID == blockID {
+		// already set, which can happen when identical blocks are shared. Drop
+		// the reference which was taken for this owner, since it already holds one.
+		in.blocks.UpdateRefCount(blockID, -1)
+		return nil
+	}
 	inodeState.blocks[index] = blockID
+	inodeState.verified = false
+	in.blocks.addOwner(blockID, owner)
+	if inodeState.pinCount > 0 {
+		in.blocks.pin(blockID)
+	}
+	if prevBlockID != UNALLOCATED_BLOCK_ID {
+		if inodeState.pinCount > 0 {
+			in.blocks.unpin(prevBlockID)
+		}
+		in.blocks.releaseOwner(prevBlockID, owner)
+	}
+
+	in.evictWithNoLock(blockID)
+	return nil
+}
+
+// Pin keeps the file's blocks from being evicted until Unpin is called. Blocks
+// which aren't cached yet are pinned as they arrive. Pinning holds a reference
+// to the inode, so it stays valid even if it's removed from its directory.
+func (in *INodes) Pin(inode INode) error {
+	in.lock.Lock()
+	defer in.lock.Unlock()
+
+	inodeState, ok := in.inodeStates[inode]
+	if !ok {
+		return INVALID_INODE
+	}
+	if inodeState.isDir {
+		return IS_DIR
+	}
+
+	inodeState.pinCount++
+	if inodeState.pinCount == 1 {
+		in.updateRefCountWithNoLock(inode, 1)
+		for _, blockID := range inodeState.blocks {
+			if blockID != UNALLOCATED_BLOCK_ID {
+				in.blocks.pin(blockID)
+			}
+		}
+	}
+	return nil
+}
+
+// Unpin undoes one call to Pin
+func (in *INodes) Unpin(inode INode) error {
+	in.lock.Lock()
+	defer in.lock.Unlock()
+
+	inodeState, ok := in.inodeStates[inode]
+	if !ok || inodeState.pinCount <= 0 {
+		return INVALID_INODE
+	}
+
+	inodeState.pinCount--
+	if inodeState.pinCount == 0 {
+		for _, blockID := range inodeState.blocks {
+			if blockID != UNALLOCATED_BLOCK_ID {
+				in.blocks.unpin(blockID)
+			}
+		}
+		in.updateRefCountWithNoLock(inode, -1)
+	}
+	return nil
+}
+
+// NeedsVerification returns true if every block of the file is cached, but
+// they haven't been checked against the remote object's checksum yet
+func (in *INodes) NeedsVerification(inode INode) bool {
+	in.lock.Lock()
+	defer in.lock.Unlock()
+
+	inodeState, ok := in.inodeStates[inode]
+	if !ok || inodeState.isDir || inodeState.verified {
+		return false
+	}
+	for _, blockID := range inodeState.blocks {
+		if blockID == UNALLOCATED_BLOCK_ID {
+			return false
+		}
+	}
+	return true
+}
+
+// MarkVerified records that the file's blocks match the remote object
+func (in *INodes) MarkVerified(inode INode) {
+	in.lock.Lock()
+	defer in.lock.Unlock()
+
+	if inodeState, ok := in.inodeStates[inode]; ok {
+		inodeState.verified = true
+	}
+}
+
+// HashFile writes the contents of the file's blocks to w in order. Returns
+// false without writing anything if any block isn't cached.
+func (in *INodes) HashFile(inode INode, w io.Writer) (bool, error) {
+	in.lock.Lock()
+	inodeState, ok := in.inodeStates[inode]
+	if !ok {
+		in.lock.Unlock()
+		return false, INVALID_INODE
+	}
+	blockIDs := append([]BlockID(nil), inodeState.blocks...)
+	for _, blockID := range blockIDs {
+		if blockID == UNALLOCATED_BLOCK_ID {
+			in.lock.Unlock()
+			return false, nil
+		}
+	}
+	// hold the blocks so they can't be evicted while they're being read
+	for _, blockID := range blockIDs {
+		in.blocks.UpdateRefCount(blockID, 1)
+	}
+	in.lock.Unlock()
+
+	defer (func() {
+		for _, blockID := range blockIDs {
+			in.blocks.UpdateRefCount(blockID, -1)
+		}
+	})()
+
+	for _, blockID := range blockIDs {
+		err := in.blocks.copyBlock(blockID, w)
+		if err != nil {
+			return false, err
+		}
+	}
+	return true, nil
+}
+
+// DiscardBlocks drops every cached block of the file, so that the next read
+// fetches them from the remote again
+func (in *INodes) DiscardBlocks(inode INode) {
+	in.lock.Lock()
+	defer in.lock.Unlock()
+
+	inodeState, ok := in.inodeStates[inode]
+	if !ok {
+		return
+	}
+	for _, blockID := range inodeState.blocks {
+		if blockID != UNALLOCATED_BLOCK_ID {
+			in.discardBlockWithNoLock(blockID)
+		}
+	}
+}
+
+// DiscardBlock drops a single block from the cache and from every file which uses it
+func (in *INodes) DiscardBlock(blockID BlockID) {
+	in.lock.Lock()
+	defer in.lock.Unlock()
+
+	in.discardBlockWithNoLock(blockID)
+}
+
+// discardBlockWithNoLock removes the block from the cache and from every
+// inode which uses it. Returns the size of the block.
+func (in *INodes) discardBlockWithNoLock(blockID BlockID) int64 {
+	owners, size := in.blocks.discard(blockID)
+	for _, owner := range owners {
+		inodeState, ok := in.inodeStates[owner.INode]
+		if !ok || inodeState.blocks[owner.BlockIndex] != blockID {
+			panic("discarded block with invalid owner")
+		}
+		inodeState.blocks[owner.BlockIndex] = UNALLOCATED_BLOCK_ID
+		inodeState.verified = false
+		if inodeState.pinCount > 0 {
+			in.blocks.unpin(blockID)
+		}
+		in.blocks.releaseOwner(blockID, owner)
+	}
+	return size
+}
+
+// VerifyBlocks rehashes every cached block which has a recorded hash, and
+// discards the ones whose contents no longer match
+func (in *INodes) VerifyBlocks() *BlockVerification {
+	result := &BlockVerification{}
+	hashes, unhashed := in.blocks.getHashes()
+	result.Unverifiable = unhashed
+
+	for blockID, expected := range hashes {
+		if !in.blocks.refWithHash(blockID, expected) {
+			// evicted or discarded since we started
+			continue
+		}
+
+		actual, err := hashBlockFile(in.blocks.getFilename(blockID))
+		if err == nil && actual == expected {
+			result.Verified++
+			in.blocks.UpdateRefCount(blockID, -1)
+			continue
+		}
+
+		if err != nil {
+			log.Printf("Could not read block %d: %s", blockID, err)
+		} else {
+			log.Printf("Block %d has hash %s but expected %s", blockID, actual, expected)
+		}
+		in.lock.Lock()
+		size := in.discardBlockWithNoLock(blockID)
+		in.lock.Unlock()
+		// dropping our reference deletes the block
+		in.blocks.UpdateRefCount(blockID, -1)
+		result.Failed++
+		result.FailedBytes += size
+	}
+
+	log.Printf("Verified %d blocks, %d failed, %d without a hash", result.Verified, result.Failed, result.Unverifiable)
+	return result
+}
+
+// SetContentAddressed controls whether fetched blocks with identical contents,
+// such as those of the same file under two different paths, are only stored once
+func (in *INodes) SetContentAddressed(enabled bool) {
+	in.blocks.SetContentAddressed(enabled)
+}
+
+// SetMaxCacheBytes sets the number of bytes of blocks to keep on disk before
+// evicting blocks which are not in use. Zero means no limit.
+func (in *INodes) SetMaxCacheBytes(maxBytes int64) {
+	in.blocks.SetMaxBytes(maxBytes)
+}
+
+// Close writes out the block index, so the cached blocks can be reused by
+// the next run
+func (in *INodes) Close() error {
+	return in.blocks.closeIndex()
+}
 
+// evictWithNoLock drops least recently used blocks until the cache is under
+// quota. Evicted blocks are marked as unallocated on their inode so that the
+// next read will fetch them again.
+func (in *INodes) evictWithNoLock(keep BlockID) {
+	for _, blockID := range in.blocks.getEvictionCandidates(keep) {
+		owners, evicted := in.blocks.evict(blockID)
+		if !evicted {
+			continue
+		}
+		for _, owner := range owners {
+			inodeState, ok := in.inodeStates[owner.INode]
+			if !ok || inodeState.blocks[owner.BlockIndex] != blockID {
+				panic("evicted block with invalid owner")
+			}
+			inodeState.blocks[owner.BlockIndex] = UNALLOCATED_BLOCK_ID
+		}
+	}
 }
 
 func (in *INodes) GetBlockIDs(inode INode, startIndex int64, count int64) ([]BlockID, error) {
-	fmt.Printf("count=%d\n", count)
 	result := make([]BlockID, count)
 	in.lock.Lock()
 	defer in.lock.Unlock()
 
 	inodeState, ok := in.inodeStates[inode]
 	if !ok {
-		panic("no such inode")
+		return nil, INVALID_INODE
 	}
 
 	if inodeState.readFailed != nil {
 		return nil, inodeState.readFailed
 	}
 
+	if startIndex < 0 || startIndex+count > int64(len(inodeState.blocks)) {
+		return nil, INVALID_OFFSET
+	}
+
 	for i := int64(0); i < count; i += 1 {
 		blockID := inodeState.blocks[startIndex+i]
 		result[i] = blockID
@@ -219,12 +647,129 @@ func (in *INodes) GetBlockIDs(inode INode, startIndex int64, count int64) ([]Blo
 	return result, nil
 }
 
-func (inodes *INodes) RequestMissingBlocks(inode INode, blockIndices []int) {
+// pinMissingBlockIDs fills in any unallocated entries in blockIDs which have
+// since been populated, taking a reference on each. Returns the number filled in.
+func (in *INodes) pinMissingBlockIDs(inode INode, startIndex int64, blockIDs []BlockID) (int, error) {
+	in.lock.Lock()
+	defer in.lock.Unlock()
+
+	inodeState, ok := in.inodeStates[inode]
+	if !ok {
+		return 0, INVALID_INODE
+	}
+
+	if inodeState.readFailed != nil {
+		return 0, inodeState.readFailed
+	}
+
+	populated := 0
+	for i := range blockIDs {
+		if blockIDs[i] != UNALLOCATED_BLOCK_ID {
+			continue
+		}
+		blockID := inodeState.blocks[startIndex+int64(i)]
+		if blockID != UNALLOCATED_BLOCK_ID {
+			in.blocks.UpdateRefCount(blockID, 1)
+			blockIDs[i] = blockID
+			populated++
+		}
+	}
+
+	return populated, nil
+}
+
+// Prefetch asynchronously requests any blocks in the given range which are
+// not yet populated. Does not wait for the blocks to arrive. Does nothing if
+// an earlier prefetch of the inode is still outstanding.
+func (inodes *INodes) Prefetch(inode INode, offset int64, length int64) {
+	inodes.lock.Lock()
+	defer inodes.lock.Unlock()
+
+	state, ok := inodes.inodeStates[inode]
+	if !ok || state.isDir || state.readFailed != nil || state.prefetching {
+		return
+	}
+
+	if offset+length > state.length {
+		length = state.length - offset
+	}
+	if length <= 0 {
+		return
+	}
+
+	startIndex := offset / inodes.blockSize
+	endIndex := (offset + length + inodes.blockSize - 1) / inodes.blockSize
+	missingBlockIDs := make([]int, 0, endIndex-startIndex)
+	for i := startIndex; i < endIndex && i < int64(len(state.blocks)); i++ {
+		if state.blocks[i] == UNALLOCATED_BLOCK_ID {
+			missingBlockIDs = append(missingBlockIDs, int(i))
+		}
+	}
+
+	if len(missingBlockIDs) == 0 {
+		return
+	}
+
+	// hold a reference so the inode isn't released while the request is outstanding
+	inodes.updateRefCountWithNoLock(inode, 1)
+	state.prefetching = true
+	requestCallback := state.requestCallback
+	go (func() {
+		log.Printf("Prefetching %d blocks of inode %d", len(missingBlockIDs), inode)
+		err := requestCallback(inode, missingBlockIDs, PrefetchPriority)
+		if err != nil {
+			log.Printf("Prefetch of inode %d failed: %s", inode, err)
+		}
+		inodes.lock.Lock()
+		state.prefetching = false
+		inodes.lock.Unlock()
+		inodes.UpdateRefCount(inode, -1)
+	})()
+}
+
+func (inodes *INodes) RequestMissingBlocks(inode INode, blockIndices []int) error {
+	inodes.lock.Lock()
+	state, ok := inodes.inodeStates[inode]
+	if !ok {
+		inodes.lock.Unlock()
+		return INVALID_INODE
+	}
+	requestCallback := state.requestCallback
+	inodes.lock.Unlock()
+	return requestCallback(inode, blockIndices, BlockingPriority)
+}
+
+// FetchAllBlocks requests every block of the file which isn't already cached
+// and waits for them to arrive
+func (inodes *INodes) FetchAllBlocks(inode INode, priority Priority) error {
 	inodes.lock.Lock()
-	state := inodes.inodeStates[inode]
+	state, ok := inodes.inodeStates[inode]
+	if !ok {
+		inodes.lock.Unlock()
+		return INVALID_INODE
+	}
+	if state.isDir {
+		inodes.lock.Unlock()
+		return IS_DIR
+	}
+	if state.readFailed != nil {
+		inodes.lock.Unlock()
+		return state.readFailed
+	}
+
+	missingBlockIndices := make([]int, 0, len(state.blocks))
+	for i, blockID := range state.blocks {
+		if blockID == UNALLOCATED_BLOCK_ID {
+			missingBlockIndices = append(missingBlockIndices, i)
+		}
+	}
 	requestCallback := state.requestCallback
 	inodes.lock.Unlock()
-	requestCallback(inode, blockIndices)
+
+	if len(missingBlockIndices) == 0 {
+		return nil
+	}
+	return requestCallback(inode, missingBlockIndices, priority)
 }
 
 func (inodes *INodes) LookupInDirWithErr(dirINode INode, name string) (INode, error) {
@@ -243,6 +788,21 @@ func (inodes *INodes) LookupInDirWithErr(dirINode INode, name string) (INode, er
 		return 0, IS_NOT_DIR
 	}
 
+	inodes.revalidateIfStaleWithNoLock(dirINode, inodeState)
+
+	// if we don't know the contents of this directory yet, request the full listing
+	if !inodeState.isDirPopulated && !inodeState.dirEntries.IsPopulated(name) && inodeState.lazyDirectoryCallback != nil && inodeState.lazyDirectoryCallback.RequestDirEntries != nil {
+		inodes.lock.Unlock()
+		err := inodeState.lazyDirectoryCallback.RequestDirEntries(dirINode)
+		inodes.lock.Lock()
+		if err != nil {
+			return 0, err
+		}
+		if inodeState.readFailed != nil {
+			return 0, inodeState.readFailed
+		}
+	}
+
 	log.Printf("LookupInDirWithErr p3")
 	if !inodeState.dirEntries.IsPopulated(name) && inodeState.lazyDirectoryCallback != nil && inodeState.lazyDirectoryCallback.RequestDirEntry != nil {
 		log.Printf("LookupInDirWithErr p4")
@@ -250,7 +810,8 @@ func (inodes *INodes) LookupInDirWithErr(dirINode INode, name string) (INode, er
 		inodeState.lazyDirectoryCallback.RequestDirEntry(dirINode, name)
 		inodes.lock.Lock()
 		if !inodeState.dirEntries.IsPopulated(name) {
-			log.Fatalf("callback did not populate %s", name)
+			log.Printf("Callback did not populate %s in dir inode %d", name, dirINode)
+			return 0, DIR_NOT_POPULATED
 		}
 	}
 	log.Printf("LookupInDirWithErr p5")
@@ -295,10 +856,14 @@ func (inodes *INodes) ReadDirWithErr(inode INode) ([]ExtendedDirEntry, error) {
 	// if we're a directory but not populated, use callback to request it be populated
 	if !inodeState.isDirPopulated && inodeState.lazyDirectoryCallback.RequestDirEntries != nil {
 		inodes.lock.Unlock()
-		inodeState.lazyDirectoryCallback.RequestDirEntries(inode)
+		err := inodeState.lazyDirectoryCallback.RequestDirEntries(inode)
 		inodes.lock.Lock()
+		if err != nil {
+			return nil, err
+		}
 		if !inodeState.isDirPopulated && inodeState.readFailed == nil {
-			panic("requestCallback did not populate dir")
+			log.Printf("Callback did not populate dir inode %d", inode)
+			return nil, DIR_NOT_POPULATED
 		}
 	}
 
@@ -306,6 +871,8 @@ func (inodes *INodes) ReadDirWithErr(inode INode) ([]ExtendedDirEntry, error) {
 		return nil, inodeState.readFailed
 	}
 
+	inodes.revalidateIfStaleWithNoLock(inode, inodeState)
+
 	result := inodeState.dirEntries.Get()
 	for i := range result {
 		dirEntryInodeState := inodes.inodeStates[result[i].INode]
@@ -324,37 +891,41 @@ func (inodes *INodes) ReadDir(inode INode) []ExtendedDirEntry {
 	return result
 }
 
-func (inodes *INodes) IsDirPopulated(inode INode) bool {
+func (inodes *INodes) IsDirPopulated(inode INode) (bool, error) {
 	inodes.lock.Lock()
 	defer inodes.lock.Unlock()
 
 	inodeState, ok := inodes.inodeStates[inode]
 	if !ok {
-		panic("invalid inode")
+		return false, INVALID_INODE
 	}
 
 	if !inodeState.isDir {
-		panic("is not dir")
+		return false, IS_NOT_DIR
 	}
 
 	// if we're a directory but not populated, use callback to request it be populated
-	return inodeState.isDirPopulated
+	return inodeState.isDirPopulated, nil
 }
 
-func (inodes *INodes) IsBlockPopulated(inode INode, blockIndex int) bool {
+func (inodes *INodes) IsBlockPopulated(inode INode, blockIndex int) (bool, error) {
 	inodes.lock.Lock()
 	defer inodes.lock.Unlock()
 
 	state, ok := inodes.inodeStates[inode]
 	if !ok {
-		panic("invalid inode")
+		return false, INVALID_INODE
 	}
 
 	if state.isDir {
-		panic("is not dir")
+		return false, IS_DIR
 	}
 
-	return state.blocks[blockIndex] != UNALLOCATED_BLOCK_ID
+	if blockIndex < 0 || blockIndex >= len(state.blocks) {
+		return false, INVALID_OFFSET
+	}
+
+	return state.blocks[blockIndex] != UNALLOCATED_BLOCK_ID, nil
 }
 
 // func (inodes *INodes) Forget(inode INode) error {
@@ -380,7 +951,27 @@ func (inodes *INodes) IsBlockPopulated(inode INode, blockIndex int) bool {
 // 	inodes.c
 // }
 
+// ReadFile reads from the file at offset into buffer, fetching any blocks
+// which aren't cached. Reads are clamped to the length of the file, and if
+// that leaves buffer only partially filled, io.EOF is returned along with the
+// number of bytes read.
 func (inodes *INodes) ReadFile(inode INode, offset int64, buffer []byte) (int, error) {
+	stat, err := inodes.Stat(inode)
+	if err != nil {
+		return 0, err
+	}
+	if stat.IsDir {
+		return 0, IS_DIR
+	}
+	if offset >= stat.Size {
+		return 0, io.EOF
+	}
+	atEOF := false
+	if offset+int64(len(buffer)) > stat.Size {
+		buffer = buffer[:stat.Size-offset]
+		atEOF = true
+	}
+
 	startIndex := offset / inodes.blockSize
 	startOffsetWithinBlock := offset % inodes.blockSize
 	endIndex := (offset + int64(len(buffer)) + inodes.blockSize - 1) / inodes.blockSize
@@ -391,23 +982,6 @@ func (inodes *INodes) ReadFile(inode INode, offset int64, buffer []byte) (int, e
 		return 0, err
 	}
 
-	// iterate through block IDs, checking to see if any blocks are unallocated
-	missingBlockIDs := make([]int, 0, len(blockIDs))
-	for i, blockID := range blockIDs {
-		if blockID == UNALLOCATED_BLOCK_ID {
-			missingBlockIDs = append(missingBlockIDs, int(startIndex)+i)
-		}
-	}
-
-	if len(missingBlockIDs) > 0 {
-		inodes.RequestMissingBlocks(inode, missingBlockIDs)
-		// after the above has completed, we should be able to get the final version of the block IDs
-		blockIDs, err = inodes.GetBlockIDs(inode, startIndex, blockCount)
-		if err != nil {
-			return 0, err
-		}
-	}
-
 	defer (func() {
 		// now that we're done, release these blocks
 		for _, blockID := range blockIDs {
@@ -417,22 +991,72 @@ func (inodes *INodes) ReadFile(inode INode, offset int64, buffer []byte) (int, e
 		}
 	})()
 
+	// blocks we hold a reference to cannot be evicted, but the blocks we
+	// request may be evicted before we get a chance to take a reference to
+	// them. So keep requesting until we hold every block we need.
+	attemptsWithoutProgress := 0
+	for {
+		// iterate through block IDs, checking to see if any blocks are unallocated
+		missingBlockIDs := make([]int, 0, len(blockIDs))
+		for i, blockID := range blockIDs {
+			if blockID == UNALLOCATED_BLOCK_ID {
+				missingBlockIDs = append(missingBlockIDs, int(startIndex)+i)
+			}
+		}
+
+		if len(missingBlockIDs) == 0 {
+			break
+		}
+
+		if attemptsWithoutProgress >= MaxBlockRequestAttempts {
+			break
+		}
+
+		err = inodes.RequestMissingBlocks(inode, missingBlockIDs)
+		if err != nil {
+			return 0, err
+		}
+		// after the above has completed, we should be able to get the final version of the block IDs
+		populated, err := inodes.pinMissingBlockIDs(inode, startIndex, blockIDs)
+		if err != nil {
+			return 0, err
+		}
+
+		if populated == 0 {
+			attemptsWithoutProgress++
+		} else {
+			attemptsWithoutProgress = 0
+		}
+	}
+
 	// do the actual read
 	destOffset := 0
 	for blockIndex, blockID := range blockIDs {
 		if blockID == UNALLOCATED_BLOCK_ID {
-			log.Panicf("Block index %d was still not populated", blockIndex)
+			log.Printf("Block index %d of inode %d was still not populated after %d attempts", int(startIndex)+blockIndex, inode, MaxBlockRequestAttempts)
+			return 0, BLOCK_NOT_POPULATED
 		}
+		// every block must fill its part of the buffer, or the data after it would be shifted
 		readLength := len(buffer) - destOffset
+		if remainingInBlock := int(inodes.blockSize - startOffsetWithinBlock); readLength > remainingInBlock {
+			readLength = remainingInBlock
+		}
 		blockLength, err := inodes.blocks.ReadBlock(blockID, int64(startOffsetWithinBlock), buffer[destOffset:destOffset+readLength])
-		destOffset += blockLength
-
 		if err != nil && err != io.EOF {
 			return destOffset, err
 		}
+		if blockLength != readLength {
+			log.Printf("Block %d of inode %d only had %d of %d bytes, discarding it", blockID, inode, blockLength, readLength)
+			inodes.DiscardBlock(blockID)
+			return destOffset, BLOCK_TRUNCATED
+		}
+		destOffset += blockLength
 
 		startOffsetWithinBlock = 0
 	}
 
-	return int(destOffset), nil
+	if atEOF {
+		return destOffset, io.EOF
+	}
+	return destOffset, nil
 }
@@ -0,0 +1,140 @@
+package treeply
+
+import (
+	"context"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"hash/crc32"
+	"log"
+	"strings"
+	"time"
+)
+
+// Checksums of whole objects are written as "<algorithm>:<hex digest>" (ie:
+// "md5:d41d8cd98f00b204e9800998ecf8427e"). CRC values are written big endian.
+const (
+	ChecksumMD5    = "md5"
+	ChecksumSHA256 = "sha256"
+	ChecksumCRC32C = "crc32c"
+	ChecksumCRC32  = "crc32"
+)
+
+// ChecksumProvider is implemented by remotes which can compute the checksum
+// of an object on demand, for when it isn't included in the listing. Returns
+// FILE_CHANGED if the object no longer has the given ETag.
+type ChecksumProvider interface {
+	GetChecksum(ctx context.Context, path string, ETag string) (string, error)
+}
+
+// BlockVerification is the result of rescanning the cached blocks
+type BlockVerification struct {
+	// the blocks whose contents matched the hash recorded when they were fetched
+	Verified int
+	// the blocks which didn't match, and were dropped from the cache
+	Failed      int
+	FailedBytes int64
+	// blocks fetched before hashes were recorded, which can't be checked
+	Unverifiable int
+}
+
+func FormatChecksum(algorithm string, digest []byte) string {
+	return algorithm + ":" + hex.EncodeToString(digest)
+}
+
+func formatCRC32Checksum(algorithm string, crc uint32) string {
+	return fmt.Sprintf("%s:%08x", algorithm, crc)
+}
+
+// newChecksumHash parses a checksum, returning a hash which computes the same
+// kind of checksum and the expected digest. Returns false if the algorithm
+// isn't supported.
+func newChecksumHash(checksum string) (hash.Hash, string, bool) {
+	algorithm, digest, ok := strings.Cut(checksum, ":")
+	if !ok {
+		return nil, "", false
+	}
+
+	var h hash.Hash
+	switch algorithm {
+	case ChecksumMD5:
+		h = md5.New()
+	case ChecksumSHA256:
+		h = sha256.New()
+	case ChecksumCRC32C:
+		h = crc32.New(crc32.MakeTable(crc32.Castagnoli))
+	case ChecksumCRC32:
+		h = crc32.NewIEEE()
+	default:
+		return nil, "", false
+	}
+	return h, strings.ToLower(digest), true
+}
+
+// verifyFile checks the file's cached blocks against the checksum of the
+// remote object once every block is present. checksum is the one from the
+// listing, and if empty is requested from remote when it's a
+// ChecksumProvider. On a mismatch the blocks are dropped so the next read
+// fetches them again, and CHECKSUM_MISMATCH is returned. Files without a
+// checksum aren't checked.
+func (f *FileService) verifyFile(inode INode, remote RemoteProvider, path string, etag string, checksum string) error {
+	if !f.VerifyChecksums || !f.INodes.NeedsVerification(inode) {
+		return nil
+	}
+
+	if checksum == "" {
+		checksumProvider, ok := remote.(ChecksumProvider)
+		if !ok {
+			return nil
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+		var err error
+		checksum, err = checksumProvider.GetChecksum(ctx, path, etag)
+		cancel()
+		if err == FILE_CHANGED {
+			return err
+		}
+		if err != nil {
+			// try again after the next fetch, rather than failing the read
+			log.Printf("Could not get checksum of %s: %s", path, err)
+			return nil
+		}
+		if checksum == "" {
+			f.INodes.MarkVerified(inode)
+			return nil
+		}
+	}
+
+	h, expected, ok := newChecksumHash(checksum)
+	if !ok {
+		log.Printf("Not verifying %s, which has an unsupported checksum %s", path, checksum)
+		f.INodes.MarkVerified(inode)
+		return nil
+	}
+
+	complete, err := f.INodes.HashFile(inode, h)
+	if err != nil || !complete {
+		// some blocks were evicted in the meantime, so wait until they're all back
+		return err
+	}
+
+	actual := hex.EncodeToString(h.Sum(nil))
+	if actual != expected {
+		log.Printf("Checksum of %s is %s but expected %s, dropping its blocks", path, actual, checksum)
+		f.INodes.DiscardBlocks(inode)
+		return CHECKSUM_MISMATCH
+	}
+
+	log.Printf("Verified %s", path)
+	f.INodes.MarkVerified(inode)
+	return nil
+}
+
+// Verify rehashes every cached block, and drops the ones which no longer
+// match the hash recorded when they were fetched. Files which used a dropped
+// block will fetch it again on the next read.
+func (f *FileService) Verify() *BlockVerification {
+	return f.INodes.VerifyBlocks()
+}
@@ -0,0 +1,113 @@
+package treeply
+
+import (
+	"bytes"
+	"context"
+	"encoding/hex"
+	"io"
+	"os"
+	"sync/atomic"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// CorruptingRemoteProvider flips the first byte of every read while Corrupt is set
+type CorruptingRemoteProvider struct {
+	*DirRemoteProvider
+	Corrupt atomic.Bool
+}
+
+func (c *CorruptingRemoteProvider) GetReader(ctx context.Context, path string, ETag string, Offset int64, Length int64) (io.Reader, error) {
+	reader, err := c.DirRemoteProvider.GetReader(ctx, path, ETag, Offset, Length)
+	if err != nil || !c.Corrupt.Load() {
+		return reader, err
+	}
+	data, err := io.ReadAll(reader)
+	if err != nil {
+		return nil, err
+	}
+	if len(data) > 0 {
+		data[0] ^= 0xff
+	}
+	return bytes.NewReader(data), nil
+}
+
+func TestChecksumFormats(t *testing.T) {
+	h, expected, ok := newChecksumHash("crc32c:E3069283")
+	assert.True(t, ok)
+	h.Write([]byte("123456789"))
+	assert.Equal(t, expected, hex.EncodeToString(h.Sum(nil)))
+	assert.Equal(t, "crc32c:e3069283", formatCRC32Checksum(ChecksumCRC32C, 0xe3069283))
+
+	_, _, ok = newChecksumHash("sha1:abc")
+	assert.False(t, ok)
+
+	assert.Equal(t, "md5:d41d8cd98f00b204e9800998ecf8427e", getS3Checksum("D41D8CD98F00B204E9800998ECF8427E"))
+	assert.Equal(t, "", getS3Checksum("d41d8cd98f00b204e9800998ecf8427e-2"))
+}
+
+func TestVerifyChecksums(t *testing.T) {
+	workDir, err := os.MkdirTemp(os.TempDir(), "test")
+	if err != nil {
+		panic(err)
+	}
+
+	tmpDir, err := os.MkdirTemp(os.TempDir(), "test")
+	if err != nil {
+		panic(err)
+	}
+
+	writeFile(tmpDir+"/f", "0123456789", 2)
+
+	remote := &CorruptingRemoteProvider{DirRemoteProvider: &DirRemoteProvider{Root: tmpDir}}
+	fs, err := NewFileService(remote, workDir, 8)
+	if err != nil {
+		panic(err)
+	}
+	client := NewFileClient(fs)
+
+	openResp, err := client.Open(&OpenReq{Path: "f"})
+	assert.Nil(t, err)
+
+	// data which doesn't match the remote's checksum is reported and not kept
+	remote.Corrupt.Store(true)
+	_, err = client.PRead(&PReadReq{FD: openResp.FD, Offset: 0, Length: 20})
+	assert.Equal(t, CHECKSUM_MISMATCH, err)
+	stat, err := client.Stat(&StatReq{Path: "f"})
+	assert.Nil(t, err)
+	assert.Equal(t, 0, stat.CachedBlocks)
+
+	remote.Corrupt.Store(false)
+	readResp, err := client.PRead(&PReadReq{FD: openResp.FD, Offset: 0, Length: 20})
+	assert.Nil(t, err)
+	assert.Equal(t, "01234567890123456789", string(readResp.Data))
+
+	verification, err := client.Verify(&VerifyReq{})
+	assert.Nil(t, err)
+	assert.Equal(t, &BlockVerification{Verified: 3}, verification)
+
+	// corrupt the first block of the file on disk
+	blockIDs, err := fs.INodes.GetBlockIDs(client.FileHandles[openResp.FD].INode, 0, 1)
+	assert.Nil(t, err)
+	err = os.WriteFile(fs.INodes.blocks.getFilename(blockIDs[0]), []byte("garbage!"), 0666)
+	if err != nil {
+		panic(err)
+	}
+	fs.INodes.blocks.UpdateRefCount(blockIDs[0], -1)
+
+	verification, err = client.Verify(&VerifyReq{})
+	assert.Nil(t, err)
+	assert.Equal(t, &BlockVerification{Verified: 2, Failed: 1, FailedBytes: 8}, verification)
+	stat, err = client.Stat(&StatReq{Path: "f"})
+	assert.Nil(t, err)
+	assert.Equal(t, 2, stat.CachedBlocks)
+
+	// the dropped block is fetched again
+	readResp, err = client.PRead(&PReadReq{FD: openResp.FD, Offset: 0, Length: 20})
+	assert.Nil(t, err)
+	assert.Equal(t, "01234567890123456789", string(readResp.Data))
+	verification, err = client.Verify(&VerifyReq{})
+	assert.Nil(t, err)
+	assert.Equal(t, &BlockVerification{Verified: 3}, verification)
+}
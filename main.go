@@ -1,7 +1,10 @@
 package treeply
 
 import (
+	"container/list"
+	"os"
 	"sync"
+	"time"
 )
 
 type INode uint64
@@ -11,6 +14,25 @@ const UNALLOCATED_BLOCK_ID = 0
 
 type BlockState struct {
 	refCount int
+	size     int64
+
+	// the inode blocks which hold a reference to this block. Used to find
+	// which inodes need to be updated when this block is evicted
+	owners map[INodeBlock]bool
+
+	// which remote blocks this holds, if known. In content-addressed mode one
+	// block can hold the identical blocks of several files.
+	keys []BlockKey
+
+	// the number of references held by pinned inodes
+	pins int
+
+	// the sha256 of the contents, recorded when the block was fetched. Empty if
+	// hashing it failed, or it was cached by a version which didn't record hashes.
+	hash string
+
+	// position in Blocks.lru
+	lruElement *list.Element
 }
 
 type Blocks struct {
@@ -20,25 +42,82 @@ type Blocks struct {
 	freeBlockID []BlockID
 	dir         string
 	blockSize   uint64
+
+	// least recently used blocks are at the front
+	lru        *list.List
+	totalBytes int64
+	// if non-zero, the number of bytes we'll try to stay under by evicting blocks
+	maxBytes  int64
+	evictions int
+
+	pinnedBlocks int
+	pinnedBytes  int64
+
+	// if true, blocks with identical contents are only stored once
+	contentAddressed bool
+	byHash           map[string]BlockID
+	dedupedBlocks    int
+	dedupedBytes     int64
+
+	byKey map[BlockKey]BlockID
+	// the keys of each remote path, so the blocks of old versions can be found
+	byPath    map[string]*pathKeys
+	indexFile *os.File
+}
+
+type pathKeys struct {
+	keys map[BlockKey]bool
+	// the number of keys with each ETag
+	etags map[string]int
 }
 
-type RequestCallback func(inode INode, blockIndices []int)
+// Priority determines the order outstanding transfers are started in
+type Priority int
+
+const (
+	// blocks which are being fetched ahead of when they are needed
+	PrefetchPriority Priority = iota
+	// blocks which a thread is waiting on
+	BlockingPriority
+)
+
+// RequestCallback populates the given blocks of the inode, returning once they
+// have been populated or an error if they could not be
+type RequestCallback func(inode INode, blockIndices []int, priority Priority) error
 
 type LazyDirectoryCallback struct {
-	RequestDirEntries func(inode INode)
+	RequestDirEntries func(inode INode) error
 	RequestDirEntry   func(inode INode, name string)
+	// lists a directory which is already populated again, updating only the
+	// entries which changed. Called in the background once the listing is
+	// older than GetTTL().
+	RevalidateDirEntries func(inode INode) error
+	// how long a listing is trusted before it's revalidated. Zero or nil means forever.
+	GetTTL func() time.Duration
 }
 
 type INodeState struct {
 	refCount              int
 	length                int64
+	etag                  string
 	isDir                 bool
 	isDirPopulated        bool
+	listedAt              time.Time
+	revalidating          bool
 	readFailed            error
+	dirListingFailed      error
 	blocks                []BlockID
 	dirEntries            *DirEntries
 	requestCallback       RequestCallback
 	lazyDirectoryCallback *LazyDirectoryCallback
+
+	// the number of times this file has been pinned. While non-zero, its blocks can't be evicted.
+	pinCount int
+	// true once the blocks have been checked against the checksum of the remote
+	// object. Cleared whenever a block is replaced.
+	verified bool
+	// true while a readahead request is outstanding, so at most one runs at a time
+	prefetching bool
 }
 
 type INodes struct {
@@ -57,6 +136,17 @@ type BlocksDiagnostics struct {
 	BlocksInUse  int
 	FreeBlockIDs int
 	Dir          string
+	BytesInUse   int64
+	MaxBytes     int64
+	Evictions    int
+	PinnedBlocks int
+	PinnedBytes  int64
+	// the number of fetched blocks which were dropped in favor of an
+	// identical block already in the cache, and the bytes that saved
+	DedupedBlocks int
+	DedupedBytes  int64
+	// the bytes referenced by inodes divided by the bytes stored
+	DedupRatio float64
 }
 
 type INodesDiagnostics struct {
@@ -85,7 +175,31 @@ func (b *Blocks) GetDiagnostics() *BlocksDiagnostics {
 	b.lock.Lock()
 	defer b.lock.Unlock()
 
-	return &BlocksDiagnostics{BlocksInUse: len(b.blockStates), FreeBlockIDs: len(b.freeBlockID), Dir: b.dir}
+	// blocks not owned by any inode are still counted once, since they take up space
+	referencedBytes := int64(0)
+	for _, state := range b.blockStates {
+		owners := len(state.owners)
+		if owners == 0 {
+			owners = 1
+		}
+		referencedBytes += int64(owners) * state.size
+	}
+	dedupRatio := 1.0
+	if b.totalBytes > 0 {
+		dedupRatio = float64(referencedBytes) / float64(b.totalBytes)
+	}
+
+	return &BlocksDiagnostics{BlocksInUse: len(b.blockStates),
+		FreeBlockIDs:  len(b.freeBlockID),
+		Dir:           b.dir,
+		BytesInUse:    b.totalBytes,
+		MaxBytes:      b.maxBytes,
+		Evictions:     b.evictions,
+		PinnedBlocks:  b.pinnedBlocks,
+		PinnedBytes:   b.pinnedBytes,
+		DedupedBlocks: b.dedupedBlocks,
+		DedupedBytes:  b.dedupedBytes,
+		DedupRatio:    dedupRatio}
 }
 
 ////////////////////
@@ -138,6 +252,11 @@ func (d *DirEntries) SetEntry(name string, inode INode) {
 	d.populated[name] = true
 }
 
+func (d *DirEntries) RemoveEntry(name string) {
+	delete(d.byName, name)
+	delete(d.populated, name)
+}
+
 func (d *DirEntries) Set(entries []DirEntry) {
 	for _, entry := range entries {
 		d.SetEntry(entry.Name, entry.INode)
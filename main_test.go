@@ -41,7 +41,7 @@ func SkipTestLotsOfReadersFuzz(t *testing.T) {
 		sourceBytes[i] = byte(rand.Intn(256))
 	}
 
-	requestCallback := func(inode INode, blockIndices []int) {
+	requestCallback := func(inode INode, blockIndices []int, priority Priority) error {
 		for _, index := range blockIndices {
 			log.Printf("Request callback inode=%d, blockIndex=%d", inode, index)
 
@@ -64,12 +64,19 @@ func SkipTestLotsOfReadersFuzz(t *testing.T) {
 			f.Close()
 
 			// assocate a block ID with that file
-			blockID := inodes.blocks.Allocate(f.Name())
-			inodes.SetBlock(inode, index, blockID)
+			blockID, err := inodes.blocks.Allocate(f.Name())
+			if err != nil {
+				return err
+			}
+			err = inodes.SetBlock(inode, index, blockID)
+			if err != nil {
+				return err
+			}
 		}
+		return nil
 	}
 
-	sampleInode := inodes.CreateLazyFile(int64(sourceLength), requestCallback)
+	sampleInode := inodes.CreateLazyFile(int64(sourceLength), "", requestCallback)
 
 	var readyToStart sync.WaitGroup
 	var finished sync.WaitGroup
@@ -142,7 +149,7 @@ func SkipTestReadFromLazyDir(t *testing.T) {
 		panic(err)
 	}
 
-	requestBlocks := func(inode INode, blockIndices []int) {
+	requestBlocks := func(inode INode, blockIndices []int, priority Priority) error {
 		for _, index := range blockIndices {
 			log.Printf("Request callback inode=%d, blockIndex=%d", inode, index)
 
@@ -159,16 +166,24 @@ func SkipTestReadFromLazyDir(t *testing.T) {
 			f.Close()
 
 			// assocate a block ID with that file
-			blockID := inodes.blocks.Allocate(f.Name())
-			inodes.SetBlock(inode, index, blockID)
+			blockID, err := inodes.blocks.Allocate(f.Name())
+			if err != nil {
+				return err
+			}
+			err = inodes.SetBlock(inode, index, blockID)
+			if err != nil {
+				return err
+			}
 		}
+		return nil
 	}
 
-	var requestDir func(inode INode)
-	requestDir = func(inode INode) {
-		childFile := inodes.CreateLazyFile(10, requestBlocks)
+	var requestDir func(inode INode) error
+	requestDir = func(inode INode) error {
+		childFile := inodes.CreateLazyFile(10, "", requestBlocks)
 		childDir := inodes.CreateLazyDir(inode, &LazyDirectoryCallback{RequestDirEntries: requestDir})
 		inodes.SetDirEntries(inode, []DirEntry{{Name: "file", INode: childFile}, {Name: "dir", INode: childDir}})
+		return nil
 	}
 	sampleInode := inodes.CreateLazyDir(0, &LazyDirectoryCallback{RequestDirEntries: requestDir})
 
@@ -240,7 +255,7 @@ func TestReadFromLazyINode(t *testing.T) {
 		panic(err)
 	}
 
-	requestCallback := func(inode INode, blockIndices []int) {
+	requestCallback := func(inode INode, blockIndices []int, priority Priority) error {
 		for _, index := range blockIndices {
 			log.Printf("Request callback inode=%d, blockIndex=%d", inode, index)
 
@@ -257,11 +272,18 @@ func TestReadFromLazyINode(t *testing.T) {
 			f.Close()
 
 			// assocate a block ID with that file
-			blockID := inodes.blocks.Allocate(f.Name())
-			inodes.SetBlock(inode, index, blockID)
+			blockID, err := inodes.blocks.Allocate(f.Name())
+			if err != nil {
+				return err
+			}
+			err = inodes.SetBlock(inode, index, blockID)
+			if err != nil {
+				return err
+			}
 		}
+		return nil
 	}
-	sampleInode := inodes.CreateLazyFile(11, requestCallback)
+	sampleInode := inodes.CreateLazyFile(11, "", requestCallback)
 
 	// read the firs 10 bytes (span 3 pages, and one partial page)
 	buffer := make([]byte, 10)
@@ -312,7 +334,7 @@ func TestReadFromLazyINode(t *testing.T) {
 // 		panic(err)
 // 	}
 
-// 	requestBlocks := func(inode INode, blockIndices []int) {
+// 	requestBlocks := func(inode INode, blockIndices []int, priority Priority) {
 // 		panic("not impl")
 // 	}
 
@@ -321,7 +343,7 @@ func TestReadFromLazyINode(t *testing.T) {
 // 			log.Printf("populating missing")
 // 			inodes.SetDirEntry(inode, name, UNALLOCATED_BLOCK_ID)
 // 		} else {
-// 			childFile := inodes.CreateLazyFile(10, requestBlocks)
+// 			childFile := inodes.CreateLazyFile(10, "", requestBlocks)
 // 			log.Printf("populating %s -> %d", name, childFile)
 // 			inodes.SetDirEntry(inode, name, childFile)
 // 		}
@@ -0,0 +1,164 @@
+package treeply
+
+import (
+	"log"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Mount is a remote presented as a top-level directory of a FileService
+type Mount struct {
+	Name   string
+	Remote RemoteProvider
+	// the mount holds a reference to this inode until it's unmounted
+	Root INode
+	// how long directory listings are trusted. See FileService.DirTTL
+	DirTTL time.Duration
+}
+
+type MountDiagnostics struct {
+	Name   string
+	DirTTL time.Duration
+	Remote interface{}
+}
+
+func isValidMountName(name string) bool {
+	return name != "" && name != "." && name != ".." && !strings.Contains(name, "/")
+}
+
+// checkMountAllowed returns MOUNT_NOT_ALLOWED if address is a local directory
+// which isn't within one of MountableDirs. Symlinks are resolved first, so
+// they can't be used to reach anything outside of them.
+func (f *FileService) checkMountAllowed(address string) error {
+	if !isLocalAddress(address) {
+		return nil
+	}
+
+	dir, err := filepath.EvalSymlinks(address)
+	if err != nil {
+		return err
+	}
+	dir, err = filepath.Abs(dir)
+	if err != nil {
+		return err
+	}
+
+	for _, mountableDir := range f.MountableDirs {
+		mountableDir, err := filepath.EvalSymlinks(mountableDir)
+		if err != nil {
+			log.Printf("Could not resolve mountable dir: %s", err)
+			continue
+		}
+		mountableDir, err = filepath.Abs(mountableDir)
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(mountableDir, dir)
+		if err == nil && rel != ".." && !strings.HasPrefix(rel, "../") {
+			return nil
+		}
+	}
+
+	log.Printf("Refusing to mount %s, which isn't in %v", address, f.MountableDirs)
+	return MOUNT_NOT_ALLOWED
+}
+
+// requestMountEntries populates the root with the current mounts
+func (f *FileService) requestMountEntries(inode INode) error {
+	f.mountLock.Lock()
+	defer f.mountLock.Unlock()
+
+	entries := make([]DirEntry, 0, len(f.mounts))
+	for name, mount := range f.mounts {
+		entries = append(entries, DirEntry{Name: name, INode: mount.Root})
+	}
+	return f.INodes.SetDirEntries(inode, entries)
+}
+
+// Mount adds the remote as a directory with the given name under the root.
+// Only possible if the service was created without a Remote. Directory
+// listings are revalidated once they're older than dirTTL, or never if it's zero.
+func (f *FileService) Mount(name string, remote RemoteProvider, dirTTL time.Duration) error {
+	if f.Remote != nil {
+		return NOT_MOUNTABLE
+	}
+	if !isValidMountName(name) {
+		return INVALID_NAME
+	}
+
+	f.mountLock.Lock()
+	defer f.mountLock.Unlock()
+
+	if _, exists := f.mounts[name]; exists {
+		return MOUNT_EXISTS
+	}
+
+	// blocks are cached under the mount's name so mounts can share the cache
+	root := f.newRemoteDir(remote, name, f.Root, func() time.Duration { return dirTTL })
+	err := f.INodes.SetDirEntry(f.Root, name, root)
+	if err != nil {
+		f.INodes.UpdateRefCount(root, -1)
+		return err
+	}
+	f.mounts[name] = &Mount{Name: name, Remote: remote, Root: root, DirTTL: dirTTL}
+
+	log.Printf("Mounted %s", name)
+	return nil
+}
+
+// Unmount removes the named mount. Files which are already open remain readable.
+func (f *FileService) Unmount(name string) error {
+	f.mountLock.Lock()
+	defer f.mountLock.Unlock()
+
+	mount, exists := f.mounts[name]
+	if !exists {
+		return NO_SUCH_MOUNT
+	}
+
+	err := f.INodes.RemoveDirEntry(f.Root, name)
+	if err != nil {
+		return err
+	}
+	delete(f.mounts, name)
+	f.INodes.UpdateRefCount(mount.Root, -1)
+
+	log.Printf("Unmounted %s", name)
+	return nil
+}
+
+// replaceMountRoot is used by Forget to swap in a fresh directory for a
+// mount's root. Returns false if name isn't a mount.
+func (f *FileService) replaceMountRoot(name string, newINode INode) (bool, error) {
+	f.mountLock.Lock()
+	defer f.mountLock.Unlock()
+
+	mount, exists := f.mounts[name]
+	if !exists {
+		return false, nil
+	}
+
+	err := f.INodes.SetDirEntry(f.Root, name, newINode)
+	if err != nil {
+		return true, err
+	}
+	oldINode := mount.Root
+	mount.Root = newINode
+	f.INodes.UpdateRefCount(oldINode, -1)
+	return true, nil
+}
+
+// GetMounts returns the current mounts, ordered by name
+func (f *FileService) GetMounts() []Mount {
+	f.mountLock.Lock()
+	defer f.mountLock.Unlock()
+
+	mounts := make([]Mount, 0, len(f.mounts))
+	for _, mount := range f.mounts {
+		mounts = append(mounts, *mount)
+	}
+	sort.Slice(mounts, func(i, j int) bool { return mounts[i].Name < mounts[j].Name })
+	return mounts
+}
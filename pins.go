@@ -0,0 +1,220 @@
+package treeply
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"sort"
+	"strings"
+)
+
+// The file in the work directory which records the pinned paths, so they can
+// be pinned again by RestorePins after a restart
+const pinsFilename = "pins"
+
+func (f *FileService) getPinsFilename() string {
+	return f.workDir + "/" + pinsFilename
+}
+
+// isUnderPath returns true if path is dir or within it
+func isUnderPath(path string, dir string) bool {
+	return dir == "" || dir == "." || path == dir || strings.HasPrefix(path, dir+"/")
+}
+
+// loadPins reads the paths which were pinned by a previous run. They aren't
+// pinned again until RestorePins is called, but the cached blocks under them
+// are kept from being evicted in the meantime.
+func (f *FileService) loadPins() error {
+	buffer, err := os.ReadFile(f.getPinsFilename())
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	var paths []string
+	err = json.Unmarshal(buffer, &paths)
+	if err != nil {
+		return err
+	}
+	for i, path := range paths {
+		paths[i] = cleanPath(path)
+		f.pins[paths[i]] = nil
+	}
+
+	// blocks are cached under their path within the FileService, so this finds
+	// the blocks of the files which were pinned
+	f.restoredPinBlocks = f.INodes.blocks.pinKeys(func(key BlockKey) bool {
+		for _, path := range paths {
+			if isUnderPath(key.Path, path) {
+				return true
+			}
+		}
+		return false
+	})
+	return nil
+}
+
+// savePinsWithNoLock writes out the pinned paths, replacing the file atomically
+func (f *FileService) savePinsWithNoLock() error {
+	buffer, err := json.Marshal(f.getPinnedPathsWithNoLock())
+	if err != nil {
+		return err
+	}
+
+	tmpFilename := f.getPinsFilename() + ".tmp"
+	err = os.WriteFile(tmpFilename, buffer, 0666)
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmpFilename, f.getPinsFilename())
+}
+
+func (f *FileService) getPinnedPathsWithNoLock() []string {
+	paths := make([]string, 0, len(f.pins))
+	for path := range f.pins {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+	return paths
+}
+
+// GetPinnedPaths returns the pinned paths in sorted order
+func (f *FileService) GetPinnedPaths() []string {
+	f.pinLock.Lock()
+	defer f.pinLock.Unlock()
+
+	return f.getPinnedPathsWithNoLock()
+}
+
+// collectFiles appends every file under inode, taking a reference to each
+func (f *FileService) collectFiles(inode INode, files []INode) ([]INode, error) {
+	stat, err := f.INodes.Stat(inode)
+	if err != nil {
+		return files, err
+	}
+	if !stat.IsDir {
+		f.INodes.UpdateRefCount(inode, 1)
+		return append(files, inode), nil
+	}
+
+	dirEntries, err := f.INodes.ReadDirWithErr(inode)
+	if err != nil {
+		return files, err
+	}
+	for _, dirEntry := range dirEntries {
+		if dirEntry.Name == "." || dirEntry.Name == ".." {
+			continue
+		}
+		f.INodes.UpdateRefCount(dirEntry.INode, 1)
+		files, err = f.collectFiles(dirEntry.INode, files)
+		f.INodes.UpdateRefCount(dirEntry.INode, -1)
+		if err != nil {
+			return files, err
+		}
+	}
+	return files, nil
+}
+
+// Pin keeps every file under path in the cache, fetching any blocks which
+// aren't cached yet the same way Prefetch does. The files pinned are the
+// ones found at the time, so pinning the same path again picks up any new
+// ones. The pinned paths are saved in the work directory.
+func (f *FileService) Pin(path string, onProgress func(*PrefetchProgress)) (*PrefetchProgress, error) {
+	// pinned paths are compared with the paths of cached blocks, so they must be in the same form
+	path = cleanPath(path)
+	inode, err := f.GetINodeForPath(path)
+	if err != nil {
+		return nil, err
+	}
+
+	files, err := f.collectFiles(inode, make([]INode, 0))
+	f.INodes.UpdateRefCount(inode, -1)
+	defer (func() {
+		for _, file := range files {
+			f.INodes.UpdateRefCount(file, -1)
+		}
+	})()
+	if err != nil {
+		return nil, err
+	}
+
+	for i, file := range files {
+		err = f.INodes.Pin(file)
+		if err != nil {
+			for _, pinned := range files[:i] {
+				f.INodes.Unpin(pinned)
+			}
+			return nil, err
+		}
+	}
+
+	f.pinLock.Lock()
+	// release the previous pins only after the new ones are in place, so
+	// blocks pinned by both are never evictable in between
+	for _, file := range f.pins[path] {
+		f.INodes.Unpin(file)
+	}
+	f.pins[path] = files
+	err = f.savePinsWithNoLock()
+	f.pinLock.Unlock()
+	if err != nil {
+		return nil, err
+	}
+
+	log.Printf("Pinned %s", path)
+	return f.Prefetch(path, false, onProgress)
+}
+
+// Unpin allows the files pinned under path to be evicted again
+func (f *FileService) Unpin(path string) error {
+	path = cleanPath(path)
+	f.pinLock.Lock()
+	defer f.pinLock.Unlock()
+
+	files, exists := f.pins[path]
+	if !exists {
+		return NOT_PINNED
+	}
+
+	for _, file := range files {
+		f.INodes.Unpin(file)
+	}
+	delete(f.pins, path)
+
+	log.Printf("Unpinned %s", path)
+	return f.savePinsWithNoLock()
+}
+
+// RestorePins pins the paths which were pinned when the service last ran,
+// fetching anything which is no longer cached. Should be called once the
+// service is configured and any mounts have been added. Paths which can't
+// be pinned are kept so they're tried again on the next restart, and the
+// first such error is returned.
+func (f *FileService) RestorePins() error {
+	var firstErr error
+	for _, path := range f.GetPinnedPaths() {
+		progress, err := f.Pin(path, nil)
+		if err == nil && progress.ErrorCount > 0 {
+			err = fmt.Errorf("Could not fetch %d files under %s", progress.ErrorCount, path)
+		}
+		if err != nil {
+			log.Printf("Could not restore pin of %s: %s", path, err)
+			if firstErr == nil {
+				firstErr = err
+			}
+		}
+	}
+
+	// the blocks which are still needed are now pinned by their inodes
+	f.pinLock.Lock()
+	for _, blockID := range f.restoredPinBlocks {
+		f.INodes.blocks.unpin(blockID)
+	}
+	f.restoredPinBlocks = nil
+	f.pinLock.Unlock()
+
+	return firstErr
+}
@@ -0,0 +1,120 @@
+package treeply
+
+import (
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPins(t *testing.T) {
+	workDir, err := os.MkdirTemp(os.TempDir(), "test")
+	if err != nil {
+		panic(err)
+	}
+
+	tmpDir, err := os.MkdirTemp(os.TempDir(), "test")
+	if err != nil {
+		panic(err)
+	}
+
+	writeFile(tmpDir+"/ref/f1", "0123456789", 2)
+	writeFile(tmpDir+"/ref/f2", "abcdefghij", 2)
+	writeFile(tmpDir+"/other", "ABCDEFGHIJ", 2)
+
+	remote := &CountingRemoteProvider{RemoteProvider: &DirRemoteProvider{Root: tmpDir}}
+	fs, err := NewFileService(remote, workDir, 8)
+	if err != nil {
+		panic(err)
+	}
+	// only enough room for about one file
+	fs.INodes.SetMaxCacheBytes(24)
+	client := NewFileClient(fs)
+
+	progress, err := client.Pin(&PinReq{Path: "ref"})
+	assert.Nil(t, err)
+	assert.Equal(t, 2, progress.FilesDone)
+	assert.Equal(t, []string{"ref"}, fs.GetPinnedPaths())
+
+	diagnostics := fs.INodes.blocks.GetDiagnostics()
+	assert.Equal(t, 6, diagnostics.PinnedBlocks)
+	assert.Equal(t, int64(40), diagnostics.PinnedBytes)
+
+	// reading another file can't evict the pinned blocks, even though the cache is over quota
+	_, err = fs.Prefetch("other", false, nil)
+	assert.Nil(t, err)
+	for _, path := range []string{"ref/f1", "ref/f2"} {
+		stat, err := client.Stat(&StatReq{Path: path})
+		assert.Nil(t, err)
+		assert.Equal(t, 3, stat.CachedBlocks)
+	}
+
+	// the pins are restored by a new service using the same work dir, from the cache
+	remote = &CountingRemoteProvider{RemoteProvider: &DirRemoteProvider{Root: tmpDir}}
+	fs, err = NewFileService(remote, workDir, 8)
+	if err != nil {
+		panic(err)
+	}
+	fs.INodes.SetMaxCacheBytes(24)
+	client = NewFileClient(fs)
+	assert.Equal(t, []string{"ref"}, fs.GetPinnedPaths())
+	assert.Nil(t, fs.RestorePins())
+	assert.Equal(t, 0, int(remote.readerCount.Load()))
+	assert.Equal(t, int64(40), fs.INodes.blocks.GetDiagnostics().PinnedBytes)
+
+	// once unpinned, the blocks can be evicted again
+	_, err = client.Unpin(&UnpinReq{Path: "ref"})
+	assert.Nil(t, err)
+	assert.Equal(t, int64(0), fs.INodes.blocks.GetDiagnostics().PinnedBytes)
+	_, err = fs.Prefetch("other", false, nil)
+	assert.Nil(t, err)
+	assert.LessOrEqual(t, fs.INodes.blocks.GetDiagnostics().BytesInUse, int64(24))
+
+	_, err = client.Unpin(&UnpinReq{Path: "ref"})
+	assert.Equal(t, NOT_PINNED, err)
+
+	// and unpinning is persisted too
+	fs, err = NewFileService(remote, workDir, 8)
+	if err != nil {
+		panic(err)
+	}
+	assert.Equal(t, []string{}, fs.GetPinnedPaths())
+}
+
+func TestPinPathsAreCleaned(t *testing.T) {
+	workDir, err := os.MkdirTemp(os.TempDir(), "test")
+	if err != nil {
+		panic(err)
+	}
+
+	tmpDir, err := os.MkdirTemp(os.TempDir(), "test")
+	if err != nil {
+		panic(err)
+	}
+
+	writeFile(tmpDir+"/ref/f1", "0123456789", 2)
+
+	fs, err := NewFileService(&DirRemoteProvider{Root: tmpDir}, workDir, 8)
+	if err != nil {
+		panic(err)
+	}
+	client := NewFileClient(fs)
+
+	_, err = client.Pin(&PinReq{Path: "./ref/"})
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"ref"}, fs.GetPinnedPaths())
+	fs.Close()
+
+	// after a restart, the blocks are matched against the cleaned path
+	fs, err = NewFileService(&DirRemoteProvider{Root: tmpDir}, workDir, 8)
+	if err != nil {
+		panic(err)
+	}
+	client = NewFileClient(fs)
+	assert.Equal(t, int64(20), fs.INodes.blocks.GetDiagnostics().PinnedBytes)
+
+	// and the pin can be removed by any equivalent path
+	_, err = client.Unpin(&UnpinReq{Path: "ref"})
+	assert.Nil(t, err)
+	assert.Equal(t, []string{}, fs.GetPinnedPaths())
+}
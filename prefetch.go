@@ -0,0 +1,196 @@
+package treeply
+
+import (
+	"log"
+	"sync"
+	"time"
+)
+
+// The number of files whose blocks Prefetch requests at once. The transfer
+// service still limits how many transfers actually run.
+const PrefetchFileConcurrency = 16
+
+// How often Prefetch reports progress while it's running
+const PrefetchProgressInterval = time.Second
+
+// The most errors listed in PrefetchProgress. Any beyond that are only counted.
+const MaxPrefetchErrors = 100
+
+type PrefetchError struct {
+	Path    string
+	Message string
+}
+
+// PrefetchProgress is reported periodically while a prefetch is running, and
+// once more when it's done. Files and bytes are counted as they're found, so
+// the totals grow until the walk is complete.
+type PrefetchProgress struct {
+	Dirs  int
+	Files int
+	// the files whose blocks are all cached. Not counted when only prefetching metadata.
+	FilesDone  int
+	BytesTotal int64
+	BytesDone  int64
+	ErrorCount int
+	Errors     []PrefetchError
+	Done       bool
+}
+
+type prefetcher struct {
+	fs           *FileService
+	metadataOnly bool
+	onProgress   func(*PrefetchProgress)
+
+	lock         sync.Mutex
+	progress     PrefetchProgress
+	lastReported time.Time
+	// counts the copies of progress taken for reporting, so that a copy
+	// which loses the race to reportLock to a later one isn't sent after it
+	reportCount int
+
+	reportLock       sync.Mutex
+	lastReportNumber int
+
+	files sync.WaitGroup
+	slots chan bool
+}
+
+// Prefetch walks the tree under path, listing every directory and, unless
+// metadataOnly is set, fetching every block of every file into the cache at
+// PrefetchPriority so that later reads don't wait on the remote. Failures to
+// list a directory or fetch a file are recorded in the progress rather than
+// stopping the walk. onProgress may be nil.
+func (f *FileService) Prefetch(path string, metadataOnly bool, onProgress func(*PrefetchProgress)) (*PrefetchProgress, error) {
+	inode, err := f.GetINodeForPath(path)
+	if err != nil {
+		return nil, err
+	}
+
+	p := &prefetcher{fs: f, metadataOnly: metadataOnly, onProgress: onProgress,
+		progress: PrefetchProgress{Errors: make([]PrefetchError, 0)}, lastReported: time.Now(),
+		slots: make(chan bool, PrefetchFileConcurrency)}
+
+	// takes ownership of the reference on inode
+	p.visit(inode, "")
+	p.files.Wait()
+
+	p.lock.Lock()
+	p.progress.Done = true
+	result := p.copyProgressWithNoLock()
+	p.reportCount++
+	reportNumber := p.reportCount
+	p.lock.Unlock()
+
+	p.report(result, reportNumber)
+	return result, nil
+}
+
+// report passes progress to onProgress, unless a later copy has already been
+// reported. Called without holding p.lock so that a slow onProgress doesn't
+// hold up the walk.
+func (p *prefetcher) report(progress *PrefetchProgress, reportNumber int) {
+	if p.onProgress == nil {
+		return
+	}
+	p.reportLock.Lock()
+	defer p.reportLock.Unlock()
+
+	if reportNumber > p.lastReportNumber {
+		p.lastReportNumber = reportNumber
+		p.onProgress(progress)
+	}
+}
+
+func (p *prefetcher) copyProgressWithNoLock() *PrefetchProgress {
+	progress := p.progress
+	progress.Errors = make([]PrefetchError, len(p.progress.Errors))
+	copy(progress.Errors, p.progress.Errors)
+	return &progress
+}
+
+// update applies the change to the progress, and reports it if it's been a while since the last report
+func (p *prefetcher) update(change func(progress *PrefetchProgress)) {
+	p.lock.Lock()
+	change(&p.progress)
+	if p.onProgress == nil || time.Since(p.lastReported) < PrefetchProgressInterval {
+		p.lock.Unlock()
+		return
+	}
+	p.lastReported = time.Now()
+	progress := p.copyProgressWithNoLock()
+	p.reportCount++
+	reportNumber := p.reportCount
+	p.lock.Unlock()
+
+	p.report(progress, reportNumber)
+}
+
+func (p *prefetcher) recordError(path string, err error) {
+	log.Printf("Prefetch of %s failed: %s", path, err)
+	p.update(func(progress *PrefetchProgress) {
+		progress.ErrorCount++
+		if len(progress.Errors) < MaxPrefetchErrors {
+			progress.Errors = append(progress.Errors, PrefetchError{Path: path, Message: err.Error()})
+		}
+	})
+}
+
+// visit prefetches the file or directory, releasing the caller's reference to inode once done
+func (p *prefetcher) visit(inode INode, path string) {
+	stat, err := p.fs.INodes.Stat(inode)
+	if err != nil {
+		p.fs.INodes.UpdateRefCount(inode, -1)
+		p.recordError(path, err)
+		return
+	}
+
+	if stat.IsDir {
+		p.update(func(progress *PrefetchProgress) { progress.Dirs++ })
+		p.visitDir(inode, path)
+		p.fs.INodes.UpdateRefCount(inode, -1)
+		return
+	}
+
+	p.update(func(progress *PrefetchProgress) {
+		progress.Files++
+		progress.BytesTotal += stat.Size
+	})
+	if p.metadataOnly {
+		p.fs.INodes.UpdateRefCount(inode, -1)
+		return
+	}
+
+	p.slots <- true
+	p.files.Add(1)
+	go (func() {
+		defer p.files.Done()
+		err := p.fs.INodes.FetchAllBlocks(inode, PrefetchPriority)
+		p.fs.INodes.UpdateRefCount(inode, -1)
+		<-p.slots
+
+		if err != nil {
+			p.recordError(path, err)
+			return
+		}
+		p.update(func(progress *PrefetchProgress) {
+			progress.FilesDone++
+			progress.BytesDone += stat.Size
+		})
+	})()
+}
+
+func (p *prefetcher) visitDir(inode INode, dirPath string) {
+	dirEntries, err := p.fs.INodes.ReadDirWithErr(inode)
+	if err != nil {
+		p.recordError(dirPath, err)
+		return
+	}
+
+	for _, dirEntry := range dirEntries {
+		if dirEntry.Name == "." || dirEntry.Name == ".." {
+			continue
+		}
+		p.fs.INodes.UpdateRefCount(dirEntry.INode, 1)
+		p.visit(dirEntry.INode, pathConcat(dirPath, dirEntry.Name))
+	}
+}
@@ -0,0 +1,101 @@
+package treeply
+
+import (
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPrefetch(t *testing.T) {
+	workDir, err := os.MkdirTemp(os.TempDir(), "test")
+	if err != nil {
+		panic(err)
+	}
+
+	tmpDir, err := os.MkdirTemp(os.TempDir(), "test")
+	if err != nil {
+		panic(err)
+	}
+
+	writeFile(tmpDir+"/f1", "f1", 10000)
+	writeFile(tmpDir+"/d1/f2", "d1f2", 10)
+	writeFile(tmpDir+"/d1/d2/f3", "d1d2f3", 10)
+	writeFile(tmpDir+"/d1/changed", "before", 10)
+
+	remote := &CountingRemoteProvider{RemoteProvider: &DirRemoteProvider{Root: tmpDir}}
+	fs, err := NewFileService(remote, workDir, 10000)
+	if err != nil {
+		panic(err)
+	}
+	client := NewFileClient(fs)
+
+	// only listing the tree doesn't read any files
+	progress, err := client.Prefetch(&PrefetchReq{Path: "", MetadataOnly: true})
+	assert.Nil(t, err)
+	assert.Equal(t, &PrefetchProgress{Dirs: 3, Files: 4, BytesTotal: 20000 + 40 + 60 + 60,
+		Errors: []PrefetchError{}, Done: true}, progress)
+	assert.Equal(t, 0, int(remote.readerCount.Load()))
+	stat, err := client.Stat(&StatReq{Path: "f1"})
+	assert.Nil(t, err)
+	assert.Equal(t, 0, stat.CachedBlocks)
+
+	// a file which changed since it was listed is reported, without stopping the rest
+	writeFile(tmpDir+"/d1/changed", "after", 10)
+
+	progress, err = client.Prefetch(&PrefetchReq{Path: ""})
+	assert.Nil(t, err)
+	assert.Equal(t, 4, progress.Files)
+	assert.Equal(t, 3, progress.FilesDone)
+	assert.Equal(t, progress.BytesTotal-60, progress.BytesDone)
+	assert.Equal(t, 1, progress.ErrorCount)
+	assert.Equal(t, []PrefetchError{{Path: "d1/changed", Message: FILE_CHANGED.Error()}}, progress.Errors)
+
+	stat, err = client.Stat(&StatReq{Path: "f1"})
+	assert.Nil(t, err)
+	assert.Equal(t, 2, stat.CachedBlocks)
+	assert.Equal(t, stat.BlockCount, stat.CachedBlocks)
+
+	// everything is now read from the cache
+	readerCount := remote.readerCount.Load()
+	openResp, err := client.Open(&OpenReq{Path: "d1/d2/f3"})
+	assert.Nil(t, err)
+	readResp, err := client.Read(&ReadReq{FD: openResp.FD, Length: 6})
+	assert.Nil(t, err)
+	assert.Equal(t, "d1d2f3", string(readResp.Data))
+	assert.Equal(t, readerCount, remote.readerCount.Load())
+
+	// prefetching a single file works too
+	progress, err = client.Prefetch(&PrefetchReq{Path: "d1/f2"})
+	assert.Nil(t, err)
+	assert.Equal(t, 1, progress.Files)
+	assert.Equal(t, 1, progress.FilesDone)
+
+	_, err = client.Prefetch(&PrefetchReq{Path: "missing"})
+	assert.NotNil(t, err)
+}
+
+func TestPrefetchProgressReportedWithoutLock(t *testing.T) {
+	var p *prefetcher
+	var reports []*PrefetchProgress
+	// onProgress is free to look at the prefetcher, since it's called without holding its lock
+	p = &prefetcher{onProgress: func(progress *PrefetchProgress) {
+		reports = append(reports, progress)
+		p.update(func(progress *PrefetchProgress) { progress.Files++ })
+	}}
+
+	updated := make(chan bool)
+	go (func() {
+		p.update(func(progress *PrefetchProgress) { progress.Dirs++ })
+		updated <- true
+	})()
+	select {
+	case <-updated:
+	case <-time.After(time.Second):
+		t.Fatal("update did not return")
+	}
+
+	assert.Equal(t, []*PrefetchProgress{{Dirs: 1, Errors: []PrefetchError{}}}, reports)
+	assert.Equal(t, PrefetchProgress{Dirs: 1, Files: 1}, p.progress)
+}
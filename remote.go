@@ -2,10 +2,12 @@ package treeply
 
 import (
 	"context"
+	"crypto/sha256"
 	"fmt"
 	"io"
 	"log"
 	"os"
+	"strings"
 	"time"
 )
 
@@ -14,6 +16,9 @@ type RemoteFile struct {
 	IsDir bool
 	ETag  string
 	Size  int64
+	// the checksum of the object's contents if the remote lists one, in the
+	// form "<algorithm>:<hex digest>" (ie: "md5:...")
+	Checksum string `json:",omitempty"`
 }
 
 type RemoteProvider interface {
@@ -123,5 +128,74 @@ func (d *DirRemoteProvider) GetReader(ctx context.Context, path string, ETag str
 	if err != nil {
 		return nil, err
 	}
+	_, err = f.Seek(Offset, io.SeekStart)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
 	return &BoundedReader{reader: f, bytesRemaining: Length}, nil
 }
+
+func (d *DirRemoteProvider) GetChecksum(ctx context.Context, path string, ETag string) (string, error) {
+	if path == "" {
+		path = d.Root
+	} else {
+		path = d.Root + "/" + path
+	}
+
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return "", FILE_CHANGED
+	}
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	fi, err := f.Stat()
+	if err != nil {
+		return "", err
+	}
+	if getLocalFileFakeEtag(fi) != ETag {
+		return "", FILE_CHANGED
+	}
+
+	h := sha256.New()
+	_, err = io.Copy(h, f)
+	if err != nil {
+		return "", err
+	}
+	return FormatChecksum(ChecksumSHA256, h.Sum(nil)), nil
+}
+
+// isLocalAddress returns true if NewRemoteProviderForAddress would treat
+// address as a local directory
+func isLocalAddress(address string) bool {
+	for _, scheme := range []string{"gs://", "s3://", "http://", "https://"} {
+		if strings.HasPrefix(address, scheme) {
+			return false
+		}
+	}
+	return true
+}
+
+// NewRemoteProviderForAddress picks the provider based on the scheme of the
+// address: gs://, s3://, http(s)://, or otherwise a local directory.
+// httpIndex is passed to NewHTTPRemoteProvider.
+func NewRemoteProviderForAddress(address string, httpIndex string) (RemoteProvider, error) {
+	if address == "" {
+		return nil, INVALID_NAME
+	}
+	if strings.HasPrefix(address, "gs://") {
+		gcs, err := NewGCSRemoteProvider(context.Background(), address)
+		if err != nil {
+			return nil, err
+		}
+		return gcs, nil
+	} else if strings.HasPrefix(address, "s3://") {
+		return NewS3RemoteProvider(address, S3ConfigFromEnv()), nil
+	} else if strings.HasPrefix(address, "http://") || strings.HasPrefix(address, "https://") {
+		return NewHTTPRemoteProvider(address, httpIndex), nil
+	}
+	return &DirRemoteProvider{Root: address}, nil
+}
@@ -0,0 +1,131 @@
+package treeply
+
+import (
+	"context"
+	"errors"
+	"io"
+	"math/rand"
+	"net"
+	"syscall"
+	"time"
+
+	"google.golang.org/api/googleapi"
+)
+
+type RetryPolicy struct {
+	// the total number of attempts made before giving up. Values <= 1 disable retries.
+	MaxAttempts int
+	// how long to wait before the first retry. Doubles after each attempt, up to MaxBackoff.
+	InitialBackoff time.Duration
+	MaxBackoff     time.Duration
+	// the deadline for each individual remote request. Zero means no deadline.
+	RequestTimeout time.Duration
+}
+
+var DefaultRetryPolicy = RetryPolicy{
+	MaxAttempts:    5,
+	InitialBackoff: 100 * time.Millisecond,
+	MaxBackoff:     10 * time.Second,
+	RequestTimeout: 5 * time.Minute,
+}
+
+// TransientError can be used by a RemoteProvider to flag an error as one
+// which is worth retrying
+type TransientError struct {
+	Err error
+}
+
+func (e *TransientError) Error() string {
+	return e.Err.Error()
+}
+
+func (e *TransientError) Unwrap() error {
+	return e.Err
+}
+
+// IsTransientError returns true if the error is likely to go away if the
+// request is retried (ie: timeouts, connection failures, server errors)
+func IsTransientError(err error) bool {
+	if err == nil || errors.Is(err, FILE_CHANGED) {
+		return false
+	}
+
+	var transientError *TransientError
+	if errors.As(err, &transientError) {
+		return true
+	}
+
+	if errors.Is(err, context.DeadlineExceeded) || errors.Is(err, io.ErrUnexpectedEOF) ||
+		errors.Is(err, syscall.ECONNRESET) || errors.Is(err, syscall.ECONNREFUSED) || errors.Is(err, syscall.EPIPE) {
+		return true
+	}
+
+	var netError net.Error
+	if errors.As(err, &netError) && netError.Timeout() {
+		return true
+	}
+
+	var apiError *googleapi.Error
+	if errors.As(err, &apiError) {
+		return apiError.Code == 429 || apiError.Code >= 500
+	}
+
+	return false
+}
+
+// IsPreconditionFailure returns true if the error means the remote object no
+// longer matches what we expect, so retrying will never succeed
+func IsPreconditionFailure(err error) bool {
+	return errors.Is(err, FILE_CHANGED)
+}
+
+// backoff returns how long to wait before the given retry (1 being the first retry)
+func (p *RetryPolicy) backoff(retry int) time.Duration {
+	backoff := p.InitialBackoff
+	for i := 1; i < retry && backoff < p.MaxBackoff; i++ {
+		backoff *= 2
+	}
+	if p.MaxBackoff > 0 && backoff > p.MaxBackoff {
+		backoff = p.MaxBackoff
+	}
+	if backoff <= 0 {
+		return 0
+	}
+	// use "full jitter" so that many clients failing at once don't retry in lockstep
+	return time.Duration(rand.Int63n(int64(backoff)))
+}
+
+// shouldRetry waits out the backoff and returns true if another attempt
+// should be made after the given attempt (1 being the first) failed with err
+func (p *RetryPolicy) shouldRetry(ctx context.Context, attempt int, err error) bool {
+	if attempt >= p.MaxAttempts || !IsTransientError(err) {
+		return false
+	}
+
+	select {
+	case <-time.After(p.backoff(attempt)):
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+func (p *RetryPolicy) withTimeout(ctx context.Context) (context.Context, context.CancelFunc) {
+	if p.RequestTimeout <= 0 {
+		return context.WithCancel(ctx)
+	}
+	return context.WithTimeout(ctx, p.RequestTimeout)
+}
+
+// Retry calls op until it succeeds, fails with an error which isn't
+// transient, or the policy's attempts are used up
+func (p *RetryPolicy) Retry(ctx context.Context, op func(ctx context.Context) error) error {
+	for attempt := 1; ; attempt++ {
+		attemptCtx, cancel := p.withTimeout(ctx)
+		err := op(attemptCtx)
+		cancel()
+		if err == nil || !p.shouldRetry(ctx, attempt, err) {
+			return err
+		}
+	}
+}
@@ -0,0 +1,429 @@
+package treeply
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+)
+
+// S3Config holds the settings needed to talk to S3 or an S3-compatible
+// service such as MinIO
+type S3Config struct {
+	// the base url of the service (ie: "http://localhost:9000"). If empty,
+	// AWS's endpoint for Region is used.
+	Endpoint string
+	Region   string
+	// if AccessKeyID is empty, requests are sent unsigned
+	AccessKeyID     string
+	SecretAccessKey string
+	SessionToken    string
+}
+
+// S3ConfigFromEnv reads the config from the standard AWS environment variables
+func S3ConfigFromEnv() *S3Config {
+	region := os.Getenv("AWS_REGION")
+	if region == "" {
+		region = os.Getenv("AWS_DEFAULT_REGION")
+	}
+	if region == "" {
+		region = "us-east-1"
+	}
+	endpoint := os.Getenv("AWS_ENDPOINT_URL_S3")
+	if endpoint == "" {
+		endpoint = os.Getenv("AWS_ENDPOINT_URL")
+	}
+	return &S3Config{Endpoint: endpoint, Region: region,
+		AccessKeyID:     os.Getenv("AWS_ACCESS_KEY_ID"),
+		SecretAccessKey: os.Getenv("AWS_SECRET_ACCESS_KEY"),
+		SessionToken:    os.Getenv("AWS_SESSION_TOKEN")}
+}
+
+type S3RemoteProvider struct {
+	client *http.Client
+	config S3Config
+	root   string
+}
+
+type S3RemoteProviderDiagnostics struct {
+	Root     string
+	Endpoint string
+}
+
+func NewS3RemoteProvider(root string, config *S3Config) *S3RemoteProvider {
+	s3Config := *config
+	if s3Config.Endpoint == "" {
+		s3Config.Endpoint = fmt.Sprintf("https://s3.%s.amazonaws.com", s3Config.Region)
+	}
+	s3Config.Endpoint = strings.TrimSuffix(s3Config.Endpoint, "/")
+	return &S3RemoteProvider{client: &http.Client{}, config: s3Config, root: root}
+}
+
+var S3PathRegEx = regexp.MustCompile("s3://([^/]+)/?(.*)$")
+
+func parseS3Path(path string) (string, string, error) {
+	matches := S3PathRegEx.FindStringSubmatch(path)
+	if matches == nil {
+		return "", "", fmt.Errorf("Invalid s3 path")
+	}
+	bucket := matches[1]
+	key := matches[2]
+	return bucket, key, nil
+}
+
+// S3Error is the error document returned by S3 when a request fails
+type S3Error struct {
+	StatusCode int    `xml:"-"`
+	Code       string `xml:"Code"`
+	Message    string `xml:"Message"`
+}
+
+func (e *S3Error) Error() string {
+	return fmt.Sprintf("S3 request failed with status %d: %s %s", e.StatusCode, e.Code, e.Message)
+}
+
+func init() {
+	registerRemoteErrno(func(err error) (string, bool) {
+		var s3Error *S3Error
+		if errors.As(err, &s3Error) {
+			return statusCodeErrno(s3Error.StatusCode)
+		}
+		return "", false
+	})
+}
+
+type s3ListBucketResult struct {
+	IsTruncated           bool   `xml:"IsTruncated"`
+	NextContinuationToken string `xml:"NextContinuationToken"`
+	Contents              []struct {
+		Key  string `xml:"Key"`
+		ETag string `xml:"ETag"`
+		Size int64  `xml:"Size"`
+	} `xml:"Contents"`
+	CommonPrefixes []struct {
+		Prefix string `xml:"Prefix"`
+	} `xml:"CommonPrefixes"`
+}
+
+// readS3Error converts an unsuccessful response into an error, flagging the
+// ones which are worth retrying
+func readS3Error(resp *http.Response) error {
+	s3Error := &S3Error{StatusCode: resp.StatusCode}
+	body, err := io.ReadAll(resp.Body)
+	if err == nil {
+		// not every error (ie: responses to HEAD) has a body, so ignore parse failures
+		xml.Unmarshal(body, s3Error)
+	}
+	if resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= 500 {
+		return &TransientError{Err: s3Error}
+	}
+	return s3Error
+}
+
+// ETags of objects uploaded in a single part are the MD5 of their contents.
+// Multipart uploads have a "-<part count>" suffix and aren't. Neither are the
+// ETags of objects encrypted with SSE-KMS or SSE-C, which can only be told
+// apart by the headers returned for the object itself.
+var s3MD5ETagPattern = regexp.MustCompile("^[0-9a-fA-F]{32}$")
+
+func getS3Checksum(etag string) string {
+	if !s3MD5ETagPattern.MatchString(etag) {
+		return ""
+	}
+	return ChecksumMD5 + ":" + strings.ToLower(etag)
+}
+
+func (s *S3RemoteProvider) GetDirListing(ctx context.Context, path string) ([]RemoteFile, error) {
+	bucket, key, err := parseS3Path(pathConcat(s.root, path))
+	if err != nil {
+		return nil, err
+	}
+
+	var prefix string
+	if key == "" {
+		prefix = ""
+	} else {
+		prefix = key + "/"
+	}
+	log.Printf("listing objects in %s, with prefix %s (root=%s, path=%s)", bucket, prefix, s.root, path)
+
+	result := make([]RemoteFile, 0, 100)
+	continuationToken := ""
+	for {
+		query := url.Values{}
+		query.Set("list-type", "2")
+		query.Set("delimiter", "/")
+		query.Set("prefix", prefix)
+		if continuationToken != "" {
+			query.Set("continuation-token", continuationToken)
+		}
+
+		req, err := s.newRequest(ctx, http.MethodGet, bucket, "", query)
+		if err != nil {
+			return nil, err
+		}
+		resp, err := s.client.Do(req)
+		if err != nil {
+			return nil, err
+		}
+
+		var listing s3ListBucketResult
+		if resp.StatusCode != http.StatusOK {
+			err = readS3Error(resp)
+		} else {
+			err = xml.NewDecoder(resp.Body).Decode(&listing)
+		}
+		resp.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+
+		for _, object := range listing.Contents {
+			if object.Key == prefix {
+				// placeholder object some tools create to represent the directory itself
+				continue
+			}
+			result = append(result, RemoteFile{
+				Name:  object.Key[len(prefix):],
+				IsDir: false,
+				ETag:  strings.Trim(object.ETag, "\""),
+				Size:  object.Size,
+			})
+		}
+		for _, commonPrefix := range listing.CommonPrefixes {
+			name := commonPrefix.Prefix[len(prefix) : len(commonPrefix.Prefix)-1]
+			result = append(result, RemoteFile{Name: name, IsDir: true})
+		}
+
+		if !listing.IsTruncated {
+			break
+		}
+		continuationToken = listing.NextContinuationToken
+	}
+	return result, nil
+}
+
+func (s *S3RemoteProvider) GetReader(ctx context.Context, path string, ETag string, Offset int64, Length int64) (io.Reader, error) {
+	bucket, key, err := parseS3Path(pathConcat(s.root, path))
+	if err != nil {
+		return nil, err
+	}
+
+	req, err := s.newRequest(ctx, http.MethodGet, bucket, key, url.Values{})
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Range", fmt.Sprintf("bytes=%d-%d", Offset, Offset+Length-1))
+	req.Header.Set("If-Match", "\""+ETag+"\"")
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+
+	switch resp.StatusCode {
+	case http.StatusPartialContent:
+		return &closeOnEOFReader{resp.Body}, nil
+	case http.StatusOK:
+		// the server ignored the range, so skip to the part we asked for
+		_, err = io.CopyN(io.Discard, resp.Body, Offset)
+		if err != nil && err != io.EOF {
+			resp.Body.Close()
+			return nil, err
+		}
+		return &closeOnEOFReader{body: struct {
+			io.Reader
+			io.Closer
+		}{io.LimitReader(resp.Body, Length), resp.Body}}, nil
+	case http.StatusRequestedRangeNotSatisfiable:
+		// the range starts past the end of the object
+		resp.Body.Close()
+		return strings.NewReader(""), nil
+	}
+
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusPreconditionFailed || resp.StatusCode == http.StatusNotFound {
+		// the object was deleted or replaced
+		return nil, FILE_CHANGED
+	}
+	return nil, readS3Error(resp)
+}
+
+// GetChecksum returns the MD5 of the object when its ETag is one. This needs a
+// HEAD request, as the listing doesn't say how the object is encrypted.
+func (s *S3RemoteProvider) GetChecksum(ctx context.Context, path string, ETag string) (string, error) {
+	bucket, key, err := parseS3Path(pathConcat(s.root, path))
+	if err != nil {
+		return "", err
+	}
+
+	req, err := s.newRequest(ctx, http.MethodHead, bucket, key, url.Values{})
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("If-Match", "\""+ETag+"\"")
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusPreconditionFailed || resp.StatusCode == http.StatusNotFound {
+		return "", FILE_CHANGED
+	}
+	if resp.StatusCode != http.StatusOK {
+		return "", readS3Error(resp)
+	}
+
+	encryption := resp.Header.Get("X-Amz-Server-Side-Encryption")
+	if strings.HasPrefix(encryption, "aws:kms") || resp.Header.Get("X-Amz-Server-Side-Encryption-Customer-Algorithm") != "" {
+		return "", nil
+	}
+	return getS3Checksum(ETag), nil
+}
+
+func (s *S3RemoteProvider) GetDiagnostics() interface{} {
+	return &S3RemoteProviderDiagnostics{Root: s.root, Endpoint: s.config.Endpoint}
+}
+
+// closeOnEOFReader closes the response body once it has been fully read, since
+// the RemoteProvider interface only hands out an io.Reader
+type closeOnEOFReader struct {
+	body io.ReadCloser
+}
+
+func (r *closeOnEOFReader) Read(p []byte) (int, error) {
+	n, err := r.body.Read(p)
+	if err != nil {
+		r.body.Close()
+	}
+	return n, err
+}
+
+// newRequest creates a request for the given key, using path-style addressing
+// so that it works the same against AWS and S3-compatible services
+func (s *S3RemoteProvider) newRequest(ctx context.Context, method string, bucket string, key string, query url.Values) (*http.Request, error) {
+	u, err := url.Parse(s.config.Endpoint)
+	if err != nil {
+		return nil, err
+	}
+	u.Path = u.Path + "/" + bucket
+	if key != "" {
+		u.Path = u.Path + "/" + key
+	}
+	u.RawPath = s3EscapePath(u.Path)
+	u.RawQuery = s3CanonicalQuery(query)
+
+	req, err := http.NewRequestWithContext(ctx, method, u.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+
+	if s.config.AccessKeyID != "" {
+		s.sign(req, time.Now().UTC())
+	}
+	return req, nil
+}
+
+// sign adds an AWS Signature Version 4 authorization header to the request
+func (s *S3RemoteProvider) sign(req *http.Request, now time.Time) {
+	const unsignedPayload = "UNSIGNED-PAYLOAD"
+
+	amzDate := now.Format("20060102T150405Z")
+	date := now.Format("20060102")
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", unsignedPayload)
+	if s.config.SessionToken != "" {
+		req.Header.Set("X-Amz-Security-Token", s.config.SessionToken)
+	}
+
+	headers := map[string]string{"host": req.URL.Host}
+	for name, values := range req.Header {
+		lowerName := strings.ToLower(name)
+		if strings.HasPrefix(lowerName, "x-amz-") {
+			headers[lowerName] = strings.TrimSpace(strings.Join(values, ","))
+		}
+	}
+	headerNames := make([]string, 0, len(headers))
+	for name := range headers {
+		headerNames = append(headerNames, name)
+	}
+	sort.Strings(headerNames)
+
+	var canonicalHeaders strings.Builder
+	for _, name := range headerNames {
+		canonicalHeaders.WriteString(name + ":" + headers[name] + "\n")
+	}
+	signedHeaders := strings.Join(headerNames, ";")
+
+	canonicalRequest := strings.Join([]string{req.Method, req.URL.EscapedPath(), req.URL.RawQuery,
+		canonicalHeaders.String(), signedHeaders, unsignedPayload}, "\n")
+	canonicalRequestHash := sha256.Sum256([]byte(canonicalRequest))
+
+	scope := date + "/" + s.config.Region + "/s3/aws4_request"
+	stringToSign := strings.Join([]string{"AWS4-HMAC-SHA256", amzDate, scope,
+		hex.EncodeToString(canonicalRequestHash[:])}, "\n")
+
+	key := []byte("AWS4" + s.config.SecretAccessKey)
+	for _, part := range []string{date, s.config.Region, "s3", "aws4_request"} {
+		key = hmacSHA256(key, part)
+	}
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		s.config.AccessKeyID, scope, signedHeaders, signature))
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
+
+// s3Escape percent-encodes everything except the unreserved characters, as
+// required for the canonical request
+func s3Escape(s string, keepSlash bool) string {
+	var b strings.Builder
+	for _, c := range []byte(s) {
+		if ('A' <= c && c <= 'Z') || ('a' <= c && c <= 'z') || ('0' <= c && c <= '9') ||
+			c == '-' || c == '_' || c == '.' || c == '~' || (keepSlash && c == '/') {
+			b.WriteByte(c)
+		} else {
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
+
+func s3EscapePath(path string) string {
+	return s3Escape(path, true)
+}
+
+func s3CanonicalQuery(query url.Values) string {
+	keys := make([]string, 0, len(query))
+	for key := range query {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	params := make([]string, 0, len(keys))
+	for _, key := range keys {
+		for _, value := range query[key] {
+			params = append(params, s3Escape(key, false)+"="+s3Escape(value, false))
+		}
+	}
+	return strings.Join(params, "&")
+}
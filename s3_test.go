@@ -0,0 +1,281 @@
+package treeply
+
+import (
+	"context"
+	"crypto/md5"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// fakeS3Server implements just enough of the S3 API (ListObjectsV2 and
+// ranged GETs) to exercise S3RemoteProvider
+type fakeS3Server struct {
+	lock    sync.Mutex
+	objects map[string][]byte // keyed by "bucket/key"
+	// the most keys returned by a single listing, to exercise pagination
+	maxKeys      int
+	unsignedReqs int
+	// if set, objects are reported as encrypted with SSE-KMS
+	sseKMS bool
+	// if set, the whole object is returned regardless of the requested range
+	ignoreRange bool
+}
+
+func (f *fakeS3Server) putObject(bucketAndKey string, content string) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	f.objects[bucketAndKey] = []byte(content)
+}
+
+func (f *fakeS3Server) setSSEKMS(sseKMS bool) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	f.sseKMS = sseKMS
+}
+
+func (f *fakeS3Server) setIgnoreRange(ignoreRange bool) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	f.ignoreRange = ignoreRange
+}
+
+func fakeETag(content []byte) string {
+	sum := md5.Sum(content)
+	return hex.EncodeToString(sum[:])
+}
+
+func (f *fakeS3Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	if !strings.HasPrefix(r.Header.Get("Authorization"), "AWS4-HMAC-SHA256 Credential=") {
+		f.unsignedReqs++
+	}
+
+	path := strings.TrimPrefix(r.URL.Path, "/")
+	if !strings.Contains(path, "/") {
+		f.listObjects(w, r, path)
+	} else {
+		f.getObject(w, r, path)
+	}
+}
+
+func (f *fakeS3Server) listObjects(w http.ResponseWriter, r *http.Request, bucket string) {
+	query := r.URL.Query()
+	prefix := query.Get("prefix")
+
+	// collect the objects and common prefixes in order
+	names := make([]string, 0)
+	commonPrefixes := make(map[string]bool)
+	for bucketAndKey := range f.objects {
+		key, ok := strings.CutPrefix(bucketAndKey, bucket+"/")
+		if !ok || !strings.HasPrefix(key, prefix) {
+			continue
+		}
+		if i := strings.Index(key[len(prefix):], "/"); i >= 0 {
+			key = key[:len(prefix)+i+1]
+			if commonPrefixes[key] {
+				continue
+			}
+			commonPrefixes[key] = true
+		}
+		names = append(names, key)
+	}
+	sort.Strings(names)
+
+	start := 0
+	if token := query.Get("continuation-token"); token != "" {
+		start, _ = strconv.Atoi(token)
+	}
+	end := len(names)
+	if end-start > f.maxKeys {
+		end = start + f.maxKeys
+	}
+
+	var result s3ListBucketResult
+	for _, name := range names[start:end] {
+		if commonPrefixes[name] {
+			result.CommonPrefixes = append(result.CommonPrefixes, struct {
+				Prefix string `xml:"Prefix"`
+			}{Prefix: name})
+		} else {
+			content := f.objects[bucket+"/"+name]
+			result.Contents = append(result.Contents, struct {
+				Key  string `xml:"Key"`
+				ETag string `xml:"ETag"`
+				Size int64  `xml:"Size"`
+			}{Key: name, ETag: "\"" + fakeETag(content) + "\"", Size: int64(len(content))})
+		}
+	}
+	if end < len(names) {
+		result.IsTruncated = true
+		result.NextContinuationToken = strconv.Itoa(end)
+	}
+
+	w.Header().Set("Content-Type", "application/xml")
+	xml.NewEncoder(w).Encode(&result)
+}
+
+func (f *fakeS3Server) getObject(w http.ResponseWriter, r *http.Request, bucketAndKey string) {
+	content, ok := f.objects[bucketAndKey]
+	if !ok {
+		w.WriteHeader(http.StatusNotFound)
+		fmt.Fprintf(w, "<Error><Code>NoSuchKey</Code><Message>not found</Message></Error>")
+		return
+	}
+	if ifMatch := r.Header.Get("If-Match"); ifMatch != "" && ifMatch != "\""+fakeETag(content)+"\"" {
+		w.WriteHeader(http.StatusPreconditionFailed)
+		fmt.Fprintf(w, "<Error><Code>PreconditionFailed</Code><Message>etag mismatch</Message></Error>")
+		return
+	}
+	if f.sseKMS {
+		w.Header().Set("X-Amz-Server-Side-Encryption", "aws:kms")
+	}
+
+	var start, end int
+	_, err := fmt.Sscanf(r.Header.Get("Range"), "bytes=%d-%d", &start, &end)
+	if err != nil || f.ignoreRange {
+		w.Write(content)
+		return
+	}
+	if start >= len(content) {
+		w.WriteHeader(http.StatusRequestedRangeNotSatisfiable)
+		return
+	}
+	if end >= len(content) {
+		end = len(content) - 1
+	}
+	w.Header().Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", start, end, len(content)))
+	w.WriteHeader(http.StatusPartialContent)
+	w.Write(content[start : end+1])
+}
+
+func newFakeS3Server() (*fakeS3Server, *httptest.Server) {
+	fake := &fakeS3Server{objects: make(map[string][]byte), maxKeys: 2}
+	return fake, httptest.NewServer(fake)
+}
+
+func TestS3RemoteProvider(t *testing.T) {
+	fake, server := newFakeS3Server()
+	defer server.Close()
+
+	fake.putObject("bucket/data/f1", strings.Repeat("f1", 10))
+	fake.putObject("bucket/data/f2", strings.Repeat("f2", 20))
+	fake.putObject("bucket/data/d1/", "")
+	fake.putObject("bucket/data/d1/f1", strings.Repeat("d1f1", 30))
+	fake.putObject("bucket/other", "other")
+
+	ctx := context.Background()
+	s3 := NewS3RemoteProvider("s3://bucket/data", &S3Config{Endpoint: server.URL, Region: "us-east-1",
+		AccessKeyID: "key", SecretAccessKey: "secret"})
+
+	// the listing spans two pages
+	files, err := s3.GetDirListing(ctx, "")
+	assert.Nil(t, err)
+	sort.Slice(files, func(i, j int) bool { return files[i].Name < files[j].Name })
+	assert.Equal(t, []RemoteFile{
+		{Name: "d1", IsDir: true},
+		{Name: "f1", ETag: fakeETag([]byte(strings.Repeat("f1", 10))), Size: 20},
+		{Name: "f2", ETag: fakeETag([]byte(strings.Repeat("f2", 20))), Size: 40}}, files)
+
+	// the ETag is only used as a checksum for objects which aren't encrypted with SSE-KMS
+	checksum, err := s3.GetChecksum(ctx, "f1", files[1].ETag)
+	assert.Nil(t, err)
+	assert.Equal(t, "md5:"+files[1].ETag, checksum)
+	fake.setSSEKMS(true)
+	checksum, err = s3.GetChecksum(ctx, "f1", files[1].ETag)
+	assert.Nil(t, err)
+	assert.Equal(t, "", checksum)
+	fake.setSSEKMS(false)
+	_, err = s3.GetChecksum(ctx, "f1", files[2].ETag)
+	assert.Equal(t, FILE_CHANGED, err)
+
+	// the placeholder for the directory itself should not be listed
+	files, err = s3.GetDirListing(ctx, "d1")
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(files))
+	assert.Equal(t, "f1", files[0].Name)
+
+	reader, err := s3.GetReader(ctx, "d1/f1", files[0].ETag, 4, 8)
+	assert.Nil(t, err)
+	buffer, err := io.ReadAll(reader)
+	assert.Nil(t, err)
+	assert.Equal(t, "d1f1d1f1", string(buffer))
+
+	// servers which don't support ranges return the whole object, which must be trimmed to the range
+	fake.setIgnoreRange(true)
+	reader, err = s3.GetReader(ctx, "d1/f1", files[0].ETag, 6, 4)
+	assert.Nil(t, err)
+	buffer, err = io.ReadAll(reader)
+	assert.Nil(t, err)
+	assert.Equal(t, "f1d1", string(buffer))
+
+	// once the object is replaced, reads of the old version should fail
+	fake.putObject("bucket/data/d1/f1", "new content")
+	_, err = s3.GetReader(ctx, "d1/f1", files[0].ETag, 0, 8)
+	assert.Equal(t, FILE_CHANGED, err)
+
+	assert.Equal(t, 0, fake.unsignedReqs)
+}
+
+func TestS3RemoteProviderWithFileService(t *testing.T) {
+	fake, server := newFakeS3Server()
+	defer server.Close()
+
+	fake.putObject("bucket/f1", strings.Repeat("0123456789", 3))
+	fake.putObject("bucket/d1/f2", "abc")
+
+	workDir, err := os.MkdirTemp(os.TempDir(), "test")
+	if err != nil {
+		panic(err)
+	}
+
+	// without credentials requests are sent unsigned
+	s3 := NewS3RemoteProvider("s3://bucket", &S3Config{Endpoint: server.URL, Region: "us-east-1"})
+	fs, err := NewFileService(s3, workDir, 8)
+	if err != nil {
+		panic(err)
+	}
+	client := NewFileClient(fs)
+
+	openResp, err := client.Open(&OpenReq{Path: "f1"})
+	assert.Nil(t, err)
+	readResp, err := client.Read(&ReadReq{FD: openResp.FD, Length: 30})
+	assert.Nil(t, err)
+	assert.Equal(t, strings.Repeat("0123456789", 3), string(readResp.Data))
+
+	statResp, err := client.Stat(&StatReq{Path: "d1/f2"})
+	assert.Nil(t, err)
+	assert.Equal(t, int64(3), statResp.Size)
+
+	assert.Less(t, 0, fake.unsignedReqs)
+}
+
+func TestS3Sign(t *testing.T) {
+	s3 := NewS3RemoteProvider("s3://bucket", &S3Config{Endpoint: "http://localhost:9000", Region: "us-east-1",
+		AccessKeyID: "AKIDEXAMPLE", SecretAccessKey: "wJalrXUtnFEMI/K7MDENG+bPxRfiCYEXAMPLEKEY"})
+	query := map[string][]string{"list-type": {"2"}, "prefix": {"a b/"}, "delimiter": {"/"}}
+	req, err := s3.newRequest(context.Background(), http.MethodGet, "bucket", "", query)
+	assert.Nil(t, err)
+	assert.Equal(t, "delimiter=%2F&list-type=2&prefix=a%20b%2F", req.URL.RawQuery)
+
+	now, err := time.Parse("20060102T150405Z", "20150830T123600Z")
+	assert.Nil(t, err)
+	s3.sign(req, now)
+	auth := req.Header.Get("Authorization")
+	assert.True(t, strings.HasPrefix(auth, "AWS4-HMAC-SHA256 Credential=AKIDEXAMPLE/20150830/us-east-1/s3/aws4_request, "+
+		"SignedHeaders=host;x-amz-content-sha256;x-amz-date, Signature="))
+}
@@ -2,36 +2,155 @@ package main
 
 import (
 	"context"
+	"encoding/json"
+	"fmt"
 	"log"
+	"net"
 	"os"
 	"strings"
+	"time"
 
 	"github.com/urfave/cli/v2"
 
 	"github.com/pgm/treeply"
 )
 
-func start(remoteAddr string, socketAddr string) error {
+func newRemoteProvider(remoteAddr string, httpIndex string) treeply.RemoteProvider {
+	remote, err := treeply.NewRemoteProviderForAddress(remoteAddr, httpIndex)
+	if err != nil {
+		panic(err)
+	}
+	return remote
+}
+
+// startOptions holds the settings of the service, from the command line
+type startOptions struct {
+	remoteAddrs         []string
+	mounts              []string
+	mountableDirs       []string
+	socketAddr          string
+	workDir             string
+	maxCacheBytes       int64
+	readaheadBlocks     int
+	maxTransfers        int
+	maxDirListings      int
+	maxAttempts         int
+	retryFailedListings bool
+	httpIndex           string
+	archivePath         string
+	manifestPath        string
+	dirTTL              time.Duration
+	dedupBlocks         bool
+	verifyChecksums     bool
+}
+
+func newStartOptions(ctx *cli.Context) *startOptions {
+	return &startOptions{
+		remoteAddrs:         ctx.Args().Slice(),
+		mounts:              ctx.StringSlice("mount"),
+		mountableDirs:       ctx.StringSlice("mountable-dir"),
+		socketAddr:          ctx.String("listen"),
+		workDir:             ctx.String("work-dir"),
+		maxCacheBytes:       ctx.Int64("max-cache-bytes"),
+		readaheadBlocks:     ctx.Int("readahead-blocks"),
+		maxTransfers:        ctx.Int("max-transfers"),
+		maxDirListings:      ctx.Int("max-dir-listings"),
+		maxAttempts:         ctx.Int("max-attempts"),
+		retryFailedListings: ctx.Bool("retry-failed-listings"),
+		httpIndex:           ctx.String("http-index"),
+		archivePath:         ctx.String("archive"),
+		manifestPath:        ctx.String("manifest"),
+		dirTTL:              ctx.Duration("dir-ttl"),
+		dedupBlocks:         ctx.Bool("dedup-blocks"),
+		verifyChecksums:     ctx.Bool("verify-checksums"),
+	}
+}
+
+func start(options *startOptions) error {
 	log.Printf("starting...")
-	workDir, err := os.MkdirTemp(os.TempDir(), "test")
+	if len(options.remoteAddrs) > 0 && len(options.mounts) > 0 {
+		return fmt.Errorf("Remotes can either be given as arguments or via --mount, but not both")
+	}
+	httpIndex := options.httpIndex
+
+	var err error
+	workDir := options.workDir
+	if workDir == "" {
+		workDir, err = os.MkdirTemp(os.TempDir(), "test")
+	} else {
+		// reuse the blocks cached in this directory by a previous run
+		err = os.MkdirAll(workDir, 0777)
+	}
 	if err != nil {
 		panic(err)
 	}
 
+	// with no remote, the root only holds the mounts
 	var remote treeply.RemoteProvider
-	if strings.HasPrefix(remoteAddr, "gs://") {
-		ctx := context.Background()
-		remote = treeply.NewGCSRemoteProvider(ctx, remoteAddr)
+	if len(options.remoteAddrs) == 0 {
+		remote = nil
+	} else if len(options.remoteAddrs) == 1 {
+		remote = newRemoteProvider(options.remoteAddrs[0], httpIndex)
 	} else {
-		remote = &treeply.DirRemoteProvider{Root: remoteAddr}
+		// layer the remotes with the first one on top
+		layers := make([]treeply.RemoteProvider, len(options.remoteAddrs))
+		for i, remoteAddr := range options.remoteAddrs {
+			layers[i] = newRemoteProvider(remoteAddr, httpIndex)
+		}
+		remote = treeply.NewUnionRemoteProvider(layers...)
+	}
+	if (options.archivePath != "" || options.manifestPath != "") && remote == nil {
+		return fmt.Errorf("--archive and --manifest apply to REMOTE arguments, so can't be used with --mount")
+	}
+	if options.archivePath != "" {
+		remote = treeply.NewArchiveRemoteProvider(remote, options.archivePath)
+	}
+	if options.manifestPath != "" {
+		// only serve the files, and the versions of them, recorded in the manifest
+		manifest, err := treeply.LoadManifest(options.manifestPath)
+		if err != nil {
+			return err
+		}
+		remote = treeply.NewManifestRemoteProvider(remote, manifest)
 	}
 	fs, err := treeply.NewFileService(remote, workDir, 10000)
 	if err != nil {
 		panic(err)
 	}
+	fs.INodes.SetMaxCacheBytes(options.maxCacheBytes)
+	fs.INodes.SetContentAddressed(options.dedupBlocks)
+	fs.ReadaheadBlocks = options.readaheadBlocks
+	fs.SetTransferLimits(options.maxTransfers, options.maxDirListings)
+	fs.RetryPolicy.MaxAttempts = options.maxAttempts
+	fs.RetryFailedDirListings = options.retryFailedListings
+	fs.DirTTL = options.dirTTL
+	fs.VerifyChecksums = options.verifyChecksums
+	fs.RemoteFactory = func(address string) (treeply.RemoteProvider, error) {
+		return treeply.NewRemoteProviderForAddress(address, httpIndex)
+	}
+	fs.MountableDirs = options.mountableDirs
+
+	for _, mount := range options.mounts {
+		name, remoteAddr, ok := strings.Cut(mount, "=")
+		if !ok {
+			return fmt.Errorf("Expected NAME=REMOTE but got %s", mount)
+		}
+		err = fs.Mount(name, newRemoteProvider(remoteAddr, httpIndex), options.dirTTL)
+		if err != nil {
+			return err
+		}
+	}
+
+	// fetch anything pinned by a previous run in the background
+	go (func() {
+		err := fs.RestorePins()
+		if err != nil {
+			log.Printf("Not all pins could be restored: %s", err)
+		}
+	})()
 
 	log.Printf("create listener...")
-	err = treeply.CreateListener(socketAddr, fs)
+	err = treeply.CreateListener(options.socketAddr, fs)
 	if err != nil {
 		panic(err)
 	}
@@ -39,22 +158,350 @@ func start(remoteAddr string, socketAddr string) error {
 	return nil
 }
 
+func isManifestFile(arg string) bool {
+	stat, err := os.Stat(arg)
+	return err == nil && stat.Mode().IsRegular()
+}
+
+// loadTree returns the manifest stored in the file named by arg, or if there
+// is no such file, treats arg as a remote address and walks it from root
+func loadTree(arg string, httpIndex string, root string) (*treeply.Manifest, error) {
+	if isManifestFile(arg) {
+		return treeply.LoadManifest(arg)
+	}
+	remote, err := treeply.NewRemoteProviderForAddress(arg, httpIndex)
+	if err != nil {
+		return nil, err
+	}
+	return treeply.WalkRemote(context.Background(), remote, root)
+}
+
+func diff(oldArg string, newArg string, httpIndex string, asJSON bool) error {
+	// a remote is walked from the root of the manifest it's compared with
+	var oldManifest *treeply.Manifest
+	var err error
+	root := ""
+	if isManifestFile(oldArg) {
+		oldManifest, err = treeply.LoadManifest(oldArg)
+		if err != nil {
+			return err
+		}
+		root = oldManifest.Root
+	}
+	newManifest, err := loadTree(newArg, httpIndex, root)
+	if err != nil {
+		return err
+	}
+	if oldManifest == nil {
+		oldManifest, err = loadTree(oldArg, httpIndex, newManifest.Root)
+		if err != nil {
+			return err
+		}
+	}
+
+	result := treeply.DiffManifests(oldManifest, newManifest)
+	if asJSON {
+		return treeply.WriteDiffJSON(os.Stdout, result)
+	}
+	return treeply.WriteDiffText(os.Stdout, result)
+}
+
+// sendRequest sends a single request to the service listening on socketAddr,
+// passing each progress response to onProgress, and returns the payload of the result
+func sendRequest(socketAddr string, requestType string, payload interface{}, onProgress func(json.RawMessage) error) (json.RawMessage, error) {
+	conn, err := net.Dial("unix", socketAddr)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	encodedPayload, err := json.Marshal(payload)
+	if err != nil {
+		return nil, err
+	}
+	request, err := json.Marshal(&treeply.ReqEnvelope{Type: requestType, Payload: encodedPayload})
+	if err != nil {
+		return nil, err
+	}
+	_, err = conn.Write(append(request, '\n'))
+	if err != nil {
+		return nil, err
+	}
+
+	decoder := json.NewDecoder(conn)
+	for {
+		var response struct {
+			Type    string
+			Payload json.RawMessage
+		}
+		err = decoder.Decode(&response)
+		if err != nil {
+			return nil, err
+		}
+
+		switch response.Type {
+		case "progress":
+			err = onProgress(response.Payload)
+			if err != nil {
+				return nil, err
+			}
+		case "error":
+			var errorResp treeply.ErrorResp
+			err = json.Unmarshal(response.Payload, &errorResp)
+			if err != nil {
+				return nil, err
+			}
+			return nil, fmt.Errorf("%s failed (%s): %s", requestType, errorResp.Errno, errorResp.Message)
+		default:
+			return response.Payload, nil
+		}
+	}
+}
+
+// prefetchOrPin asks the service to prefetch or pin path, printing its progress as it goes
+func prefetchOrPin(socketAddr string, requestType string, payload interface{}) error {
+	printProgress := func(encodedProgress json.RawMessage) error {
+		var progress treeply.PrefetchProgress
+		err := json.Unmarshal(encodedProgress, &progress)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("%d dirs, %d/%d files, %d/%d bytes, %d errors\n", progress.Dirs, progress.FilesDone, progress.Files,
+			progress.BytesDone, progress.BytesTotal, progress.ErrorCount)
+		return nil
+	}
+
+	result, err := sendRequest(socketAddr, requestType, payload, printProgress)
+	if err != nil {
+		return err
+	}
+	err = printProgress(result)
+	if err != nil {
+		return err
+	}
+
+	var progress treeply.PrefetchProgress
+	err = json.Unmarshal(result, &progress)
+	if err != nil {
+		return err
+	}
+	for _, prefetchError := range progress.Errors {
+		fmt.Printf("%s: %s\n", prefetchError.Path, prefetchError.Message)
+	}
+	if progress.ErrorCount > len(progress.Errors) {
+		fmt.Printf("(and %d more errors)\n", progress.ErrorCount-len(progress.Errors))
+	}
+	return nil
+}
+
 func main() {
+	// for the subcommands which talk to a running service
+	socketFlag := &cli.StringFlag{
+		Name:  "listen",
+		Value: "/tmp/treeply",
+		Usage: "The path of the socket the service is listening on",
+	}
 
 	app := &cli.App{
 		Name:  "boom",
 		Usage: "make an explosive entrance",
+		// if more than one remote is given, they're combined with earlier ones
+		// shadowing later ones. If none are given, remotes must be added via --mount
+		// or the mount command.
+		ArgsUsage: "[REMOTE...]",
 		Flags: []cli.Flag{
 			&cli.StringFlag{
 				Name:  "listen",
 				Value: "/tmp/treeply",
 				Usage: "The path to bind for the socket",
 			},
+			&cli.StringFlag{
+				Name:  "work-dir",
+				Value: "",
+				Usage: "The directory to cache blocks in, which is reused across restarts. If not set, a new temp directory is used",
+			},
+			&cli.Int64Flag{
+				Name:  "max-cache-bytes",
+				Value: 0,
+				Usage: "Evict cached blocks once they take up more than this many bytes (0 means no limit)",
+			},
+			&cli.BoolFlag{
+				Name:  "dedup-blocks",
+				Usage: "Store blocks with identical contents only once, even if they belong to different files",
+			},
+			&cli.BoolFlag{
+				Name:  "verify-checksums",
+				Value: true,
+				Usage: "Check each file against the checksum the remote has for it once all its blocks are cached",
+			},
+			&cli.IntFlag{
+				Name:  "readahead-blocks",
+				Value: treeply.DefaultReadaheadBlocks,
+				Usage: "The number of blocks to prefetch ahead of sequential reads (0 disables readahead)",
+			},
+			&cli.IntFlag{
+				Name:  "max-transfers",
+				Value: treeply.DefaultMaxActiveTransfers,
+				Usage: "The maximum number of concurrent block transfers (0 means no limit)",
+			},
+			&cli.IntFlag{
+				Name:  "max-dir-listings",
+				Value: treeply.DefaultMaxActiveDirListings,
+				Usage: "The maximum number of concurrent directory listings (0 means no limit)",
+			},
+			&cli.IntFlag{
+				Name:  "max-attempts",
+				Value: treeply.DefaultRetryPolicy.MaxAttempts,
+				Usage: "The number of times to try a remote request which fails with a transient error",
+			},
+			&cli.BoolFlag{
+				Name:  "retry-failed-listings",
+				Usage: "List a directory again on the next access if listing it failed, instead of reporting the original error",
+			},
+			&cli.StringFlag{
+				Name:  "http-index",
+				Value: "",
+				Usage: "For http(s) remotes, the name of the JSON index file in each directory. If not set, the server's html directory pages are parsed",
+			},
+			&cli.DurationFlag{
+				Name:  "dir-ttl",
+				Value: 0,
+				Usage: "How long to use a directory listing before listing it again in the background. Applies to REMOTE and each --mount (0 means until forgotten)",
+			},
+			&cli.StringSliceFlag{
+				Name:  "mount",
+				Usage: "NAME=REMOTE to serve the remote under the top level directory NAME. Can be repeated, but not combined with REMOTE arguments",
+			},
+			&cli.StringSliceFlag{
+				Name:  "mountable-dir",
+				Usage: "A local directory which clients may mount, along with anything under it. Can be repeated. By default clients can only mount remotes",
+			},
+			&cli.StringFlag{
+				Name:  "manifest",
+				Value: "",
+				Usage: "A manifest written by the snapshot command. If set, only the versions of the files recorded in it are served",
+			},
+			&cli.StringFlag{
+				Name:  "archive",
+				Value: "",
+				Usage: "The path of a zip or tar file within the remote whose contents should be presented instead of the remote itself",
+			},
+		},
+		Commands: []*cli.Command{
+			{
+				Name:      "diff",
+				Usage:     "Report the files which differ between two trees, each given as a manifest file or a remote address",
+				ArgsUsage: "OLD NEW",
+				Flags: []cli.Flag{
+					&cli.BoolFlag{
+						Name:  "json",
+						Usage: "Write the differences as JSON instead of text",
+					},
+					&cli.StringFlag{
+						Name:  "http-index",
+						Value: "",
+						Usage: "For http(s) remotes, the name of the JSON index file in each directory",
+					},
+				},
+				Action: func(ctx *cli.Context) error {
+					if ctx.NArg() != 2 {
+						return fmt.Errorf("Expected OLD and NEW but got %d arguments", ctx.NArg())
+					}
+					return diff(ctx.Args().Get(0), ctx.Args().Get(1), ctx.String("http-index"), ctx.Bool("json"))
+				},
+			},
+			{
+				Name:      "snapshot",
+				Usage:     "Ask a running service for a manifest of everything under PATH, and write it to OUTPUT",
+				ArgsUsage: "PATH OUTPUT",
+				Flags:     []cli.Flag{socketFlag},
+				Action: func(ctx *cli.Context) error {
+					if ctx.NArg() != 2 {
+						return fmt.Errorf("Expected PATH and OUTPUT but got %d arguments", ctx.NArg())
+					}
+					result, err := sendRequest(ctx.String("listen"), "snapshot", &treeply.SnapshotReq{Path: ctx.Args().Get(0)}, nil)
+					if err != nil {
+						return err
+					}
+					var snapshot treeply.SnapshotResp
+					err = json.Unmarshal(result, &snapshot)
+					if err != nil {
+						return err
+					}
+					err = treeply.SaveManifest(ctx.Args().Get(1), snapshot.Manifest)
+					if err != nil {
+						return err
+					}
+					fmt.Printf("%d dirs, %d files\n", snapshot.Dirs, snapshot.Files)
+					return nil
+				},
+			},
+			{
+				Name:      "prefetch",
+				Usage:     "Ask a running service to fetch everything under PATH into its cache",
+				ArgsUsage: "PATH",
+				Flags: []cli.Flag{
+					socketFlag,
+					&cli.BoolFlag{
+						Name:  "metadata-only",
+						Usage: "Only list directories, without fetching the contents of files",
+					},
+				},
+				Action: func(ctx *cli.Context) error {
+					if ctx.NArg() > 1 {
+						return fmt.Errorf("Expected at most one PATH but got %d arguments", ctx.NArg())
+					}
+					return prefetchOrPin(ctx.String("listen"), "prefetch",
+						&treeply.PrefetchReq{Path: ctx.Args().First(), MetadataOnly: ctx.Bool("metadata-only")})
+				},
+			},
+			{
+				Name:      "pin",
+				Usage:     "Ask a running service to fetch everything under PATH and never evict it, including after restarts",
+				ArgsUsage: "PATH",
+				Flags:     []cli.Flag{socketFlag},
+				Action: func(ctx *cli.Context) error {
+					if ctx.NArg() != 1 {
+						return fmt.Errorf("Expected PATH but got %d arguments", ctx.NArg())
+					}
+					return prefetchOrPin(ctx.String("listen"), "pin", &treeply.PinReq{Path: ctx.Args().First()})
+				},
+			},
+			{
+				Name:      "unpin",
+				Usage:     "Ask a running service to allow the files under a pinned PATH to be evicted again",
+				ArgsUsage: "PATH",
+				Flags:     []cli.Flag{socketFlag},
+				Action: func(ctx *cli.Context) error {
+					if ctx.NArg() != 1 {
+						return fmt.Errorf("Expected PATH but got %d arguments", ctx.NArg())
+					}
+					_, err := sendRequest(ctx.String("listen"), "unpin", &treeply.UnpinReq{Path: ctx.Args().First()}, nil)
+					return err
+				},
+			},
+			{
+				Name:  "verify",
+				Usage: "Ask a running service to check every cached block, dropping any which are corrupt",
+				Flags: []cli.Flag{socketFlag},
+				Action: func(ctx *cli.Context) error {
+					result, err := sendRequest(ctx.String("listen"), "verify", &treeply.VerifyReq{}, nil)
+					if err != nil {
+						return err
+					}
+					var verification treeply.BlockVerification
+					err = json.Unmarshal(result, &verification)
+					if err != nil {
+						return err
+					}
+					fmt.Printf("%d blocks verified, %d failed (%d bytes dropped), %d without a checksum\n", verification.Verified,
+						verification.Failed, verification.FailedBytes, verification.Unverifiable)
+					return nil
+				},
+			},
 		},
 		Action: func(ctx *cli.Context) error {
-			remoteAddr := ctx.Args().Get(0)
-			socketAddr := ctx.String("listen")
-			return start(remoteAddr, socketAddr)
+			return start(newStartOptions(ctx))
 		},
 	}
 
@@ -3,10 +3,19 @@ import json
 
 commands = {"listdir": [("Path", str)],
             "diag": [],
+            "stat": [("Path", str)],
             "open": [("Path", str)],
             "close": [("FD", int)],
             "read": [("FD", int), ("Length", int)],
-            "seek": [("FD", int), ("Offset", int), ("Whence", str)]}
+            "pread": [("FD", int), ("Offset", int), ("Length", int)],
+            "seek": [("FD", int), ("Offset", int), ("Whence", str)],  # Whence is one of SEEK_SET, SEEK_CUR, SEEK_END
+            "snapshot": [("Path", str)],
+            "prefetch": [("Path", str), ("MetadataOnly", lambda x: x.lower() == "true")],
+            "pin": [("Path", str)],
+            "unpin": [("Path", str)],
+            "verify": [],
+            "mount": [("Name", str), ("Remote", str), ("DirTTL", str)],
+            "unmount": [("Name", str)]}
 
 import random
 import glob
@@ -38,6 +47,7 @@ def fuzz():
 def main() :
     s = socket.socket(socket.AF_UNIX)
     s.connect("/tmp/treeply")
+    responses = s.makefile("r")
 
     while True:
         command = input("Command: ")
@@ -53,8 +63,12 @@ def main() :
         
         msg = {"Type": command_name, "Payload": payload}
         s.send((json.dumps(msg)+"\n").encode("utf8"))
-        x = s.recv(10000)
-        print("Response: "+json.dumps(json.loads(x), indent=2))
+        # long running commands send "progress" responses before their result
+        while True:
+            response = json.loads(responses.readline())
+            print("Response: "+json.dumps(response, indent=2))
+            if response["Type"] != "progress":
+                break
 
 if __name__ == "__main__":
     main()
\ No newline at end of file
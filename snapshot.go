@@ -0,0 +1,224 @@
+package treeply
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// the version of the manifest format written by WriteManifest
+const ManifestVersion = 1
+
+// ManifestEntry records a single file or directory in a snapshot
+type ManifestEntry struct {
+	// relative to the root of the snapshot
+	Path  string
+	IsDir bool   `json:",omitempty"`
+	Size  int64  `json:",omitempty"`
+	ETag  string `json:",omitempty"`
+}
+
+// Manifest is an immutable record of a tree at the time it was walked
+type Manifest struct {
+	Version int
+	// the path within the remote the snapshot was taken of. For a mount, this
+	// doesn't include the mount's name.
+	Root      string
+	CreatedAt time.Time
+	// ordered by path, with directories before their contents
+	Entries []ManifestEntry
+}
+
+// Snapshot walks the tree under path and records every file and directory in
+// it. When serving mounts, path must be within one of them, since the manifest
+// is read back against a single remote.
+func (f *FileService) Snapshot(path string) (*Manifest, error) {
+	path = cleanPath(path)
+	root := path
+	if f.Remote == nil {
+		mountName, pathInMount, _ := strings.Cut(root, "/")
+		if mountName == "" {
+			return nil, SNAPSHOT_SPANS_MOUNTS
+		}
+		root = pathInMount
+	}
+
+	inode, err := f.GetINodeForPath(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.INodes.UpdateRefCount(inode, -1)
+
+	manifest := &Manifest{Version: ManifestVersion, Root: root, CreatedAt: time.Now().UTC(),
+		Entries: make([]ManifestEntry, 0)}
+	err = f.snapshotDir(inode, "", manifest)
+	if err != nil {
+		return nil, err
+	}
+
+	sort.Slice(manifest.Entries, func(i, j int) bool { return manifest.Entries[i].Path < manifest.Entries[j].Path })
+	return manifest, nil
+}
+
+func (f *FileService) snapshotDir(inode INode, dirPath string, manifest *Manifest) error {
+	dirEntries, err := f.INodes.ReadDirWithErr(inode)
+	if err != nil {
+		return err
+	}
+
+	for _, dirEntry := range dirEntries {
+		if dirEntry.Name == "." || dirEntry.Name == ".." {
+			continue
+		}
+
+		childPath := pathConcat(dirPath, dirEntry.Name)
+		f.INodes.UpdateRefCount(dirEntry.INode, 1)
+		stat, err := f.INodes.Stat(dirEntry.INode)
+		if err == nil {
+			if stat.IsDir {
+				manifest.Entries = append(manifest.Entries, ManifestEntry{Path: childPath, IsDir: true})
+				err = f.snapshotDir(dirEntry.INode, childPath, manifest)
+			} else {
+				manifest.Entries = append(manifest.Entries, ManifestEntry{Path: childPath, Size: stat.Size, ETag: stat.ETag})
+			}
+		}
+		f.INodes.UpdateRefCount(dirEntry.INode, -1)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func WriteManifest(w io.Writer, manifest *Manifest) error {
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(manifest)
+}
+
+// SaveManifest writes the manifest to filename, replacing it atomically
+func SaveManifest(filename string, manifest *Manifest) error {
+	tmpFilename := filename + ".tmp"
+	f, err := os.Create(tmpFilename)
+	if err != nil {
+		return err
+	}
+
+	err = WriteManifest(f, manifest)
+	if err != nil {
+		f.Close()
+		return err
+	}
+	err = f.Close()
+	if err != nil {
+		return err
+	}
+
+	return os.Rename(tmpFilename, filename)
+}
+
+func ReadManifest(r io.Reader) (*Manifest, error) {
+	var manifest Manifest
+	err := json.NewDecoder(r).Decode(&manifest)
+	if err != nil {
+		return nil, err
+	}
+	if manifest.Version != ManifestVersion {
+		return nil, INVALID_MANIFEST
+	}
+	return &manifest, nil
+}
+
+func LoadManifest(filename string) (*Manifest, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	return ReadManifest(f)
+}
+
+// ManifestRemoteProvider serves listings purely from a manifest, and only
+// reads the versions of files recorded in it from Remote. If a file has
+// changed since the snapshot was taken, reading it fails with FILE_CHANGED
+// rather than returning different data.
+type ManifestRemoteProvider struct {
+	Remote   RemoteProvider
+	Manifest *Manifest
+
+	dirs  map[string][]RemoteFile
+	files map[string]*ManifestEntry
+}
+
+type ManifestRemoteProviderDiagnostics struct {
+	ManifestRoot      string
+	ManifestCreatedAt time.Time
+	FileCount         int
+	Remote            interface{}
+}
+
+func NewManifestRemoteProvider(remote RemoteProvider, manifest *Manifest) *ManifestRemoteProvider {
+	m := &ManifestRemoteProvider{Remote: remote, Manifest: manifest,
+		dirs:  map[string][]RemoteFile{"": make([]RemoteFile, 0)},
+		files: make(map[string]*ManifestEntry)}
+
+	for i := range manifest.Entries {
+		entry := &manifest.Entries[i]
+		parent := filepathDir(entry.Path)
+		if entry.IsDir {
+			if _, exists := m.dirs[entry.Path]; !exists {
+				m.dirs[entry.Path] = make([]RemoteFile, 0)
+			}
+		} else {
+			m.files[entry.Path] = entry
+		}
+		m.dirs[parent] = append(m.dirs[parent], RemoteFile{Name: filepath.Base(entry.Path), IsDir: entry.IsDir,
+			ETag: entry.ETag, Size: entry.Size})
+	}
+
+	return m
+}
+
+func (m *ManifestRemoteProvider) GetDiagnostics() interface{} {
+	return &ManifestRemoteProviderDiagnostics{ManifestRoot: m.Manifest.Root, ManifestCreatedAt: m.Manifest.CreatedAt,
+		FileCount: len(m.files), Remote: m.Remote.GetDiagnostics()}
+}
+
+func (m *ManifestRemoteProvider) GetDirListing(ctx context.Context, path string) ([]RemoteFile, error) {
+	files, ok := m.dirs[path]
+	if !ok {
+		if _, isFile := m.files[path]; isFile {
+			return nil, IS_NOT_DIR
+		}
+		return nil, INVALID_NAME
+	}
+	return append([]RemoteFile(nil), files...), nil
+}
+
+// entries are relative to the manifest's root, which is a path within Remote
+func (m *ManifestRemoteProvider) GetReader(ctx context.Context, path string, ETag string, Offset int64, Length int64) (io.Reader, error) {
+	entry, ok := m.files[path]
+	if !ok || entry.ETag != ETag {
+		return nil, FILE_CHANGED
+	}
+	return m.Remote.GetReader(ctx, pathConcat(m.Manifest.Root, path), entry.ETag, Offset, Length)
+}
+
+func (m *ManifestRemoteProvider) GetChecksum(ctx context.Context, path string, ETag string) (string, error) {
+	entry, ok := m.files[path]
+	if !ok || entry.ETag != ETag {
+		return "", FILE_CHANGED
+	}
+	checksumProvider, ok := m.Remote.(ChecksumProvider)
+	if !ok {
+		return "", nil
+	}
+	return checksumProvider.GetChecksum(ctx, pathConcat(m.Manifest.Root, path), entry.ETag)
+}
@@ -0,0 +1,159 @@
+package treeply
+
+import (
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSnapshot(t *testing.T) {
+	workDir, err := os.MkdirTemp(os.TempDir(), "test")
+	if err != nil {
+		panic(err)
+	}
+
+	tmpDir, err := os.MkdirTemp(os.TempDir(), "test")
+	if err != nil {
+		panic(err)
+	}
+
+	writeFile(tmpDir+"/f1", "f1", 10)
+	writeFile(tmpDir+"/d1/f2", "d1f2", 10)
+	writeFile(tmpDir+"/d1/d2/f3", "d1d2f3", 10)
+	err = os.Mkdir(tmpDir+"/empty", 0777)
+	if err != nil {
+		panic(err)
+	}
+
+	remote := &DirRemoteProvider{Root: tmpDir}
+	fs, err := NewFileService(remote, workDir, 10000)
+	if err != nil {
+		panic(err)
+	}
+	client := NewFileClient(fs)
+
+	resp, err := client.Snapshot(&SnapshotReq{Path: ""})
+	assert.Nil(t, err)
+	assert.Equal(t, 3, resp.Files)
+	assert.Equal(t, 3, resp.Dirs)
+
+	// the manifest survives being saved and loaded again
+	manifestFile := workDir + "/manifest.json"
+	err = SaveManifest(manifestFile, resp.Manifest)
+	assert.Nil(t, err)
+	manifest, err := LoadManifest(manifestFile)
+	assert.Nil(t, err)
+	paths := make([]string, 0, len(manifest.Entries))
+	for _, entry := range manifest.Entries {
+		paths = append(paths, entry.Path)
+	}
+	assert.Equal(t, []string{"d1", "d1/d2", "d1/d2/f3", "d1/f2", "empty", "f1"}, paths)
+	assert.Equal(t, int64(40), manifest.Entries[3].Size)
+	assert.NotEqual(t, "", manifest.Entries[3].ETag)
+
+	// a snapshot of a subdirectory is relative to that directory
+	subManifest, err := fs.Snapshot("d1")
+	assert.Nil(t, err)
+	assert.Equal(t, "d1", subManifest.Root)
+	assert.Equal(t, "d2", subManifest.Entries[0].Path)
+
+	// change the live tree
+	writeFile(tmpDir+"/new", "new", 1)
+	writeFile(tmpDir+"/d1/f2", "changed", 1)
+
+	// serving from the manifest should show the tree as it was
+	workDir2, err := os.MkdirTemp(os.TempDir(), "test")
+	if err != nil {
+		panic(err)
+	}
+	fs2, err := NewFileService(NewManifestRemoteProvider(remote, manifest), workDir2, 10000)
+	if err != nil {
+		panic(err)
+	}
+	client2 := NewFileClient(fs2)
+	assert.Equal(t, []string{".", "..", "d1", "empty", "f1"}, listNames(client2, t, "."))
+	assert.Equal(t, []string{".", ".."}, listNames(client2, t, "empty"))
+
+	stat, err := client2.Stat(&StatReq{Path: "d1/f2"})
+	assert.Nil(t, err)
+	assert.Equal(t, int64(40), stat.Size)
+
+	openResp, err := client2.Open(&OpenReq{Path: "d1/d2/f3"})
+	assert.Nil(t, err)
+	readResp, err := client2.Read(&ReadReq{FD: openResp.FD, Length: 6})
+	assert.Nil(t, err)
+	assert.Equal(t, "d1d2f3", string(readResp.Data))
+
+	// the file which changed can't be read, rather than returning the new content
+	openResp, err = client2.Open(&OpenReq{Path: "d1/f2"})
+	assert.Nil(t, err)
+	_, err = client2.Read(&ReadReq{FD: openResp.FD, Length: 4})
+	assert.Equal(t, FILE_CHANGED, err)
+
+	// files in a manifest of a subdirectory are read from under that directory
+	workDir3, err := os.MkdirTemp(os.TempDir(), "test")
+	if err != nil {
+		panic(err)
+	}
+	fs3, err := NewFileService(NewManifestRemoteProvider(remote, subManifest), workDir3, 10000)
+	if err != nil {
+		panic(err)
+	}
+	client3 := NewFileClient(fs3)
+	assert.Equal(t, []string{".", "..", "d2", "f2"}, listNames(client3, t, "."))
+	openResp, err = client3.Open(&OpenReq{Path: "d2/f3"})
+	assert.Nil(t, err)
+	readResp, err = client3.Read(&ReadReq{FD: openResp.FD, Length: 6})
+	assert.Nil(t, err)
+	assert.Equal(t, "d1d2f3", string(readResp.Data))
+}
+
+func TestSnapshotOfMount(t *testing.T) {
+	workDir, err := os.MkdirTemp(os.TempDir(), "test")
+	if err != nil {
+		panic(err)
+	}
+
+	tmpDir, err := os.MkdirTemp(os.TempDir(), "test")
+	if err != nil {
+		panic(err)
+	}
+
+	writeFile(tmpDir+"/d1/f2", "d1f2", 10)
+	writeFile(tmpDir+"/d1/d2/f3", "d1d2f3", 10)
+
+	remote := &DirRemoteProvider{Root: tmpDir}
+	fs, err := NewFileService(nil, workDir, 10000)
+	if err != nil {
+		panic(err)
+	}
+	err = fs.Mount("m1", remote, 0)
+	assert.Nil(t, err)
+
+	// a manifest is read against a single remote, so can't include several mounts
+	_, err = fs.Snapshot("")
+	assert.Equal(t, SNAPSHOT_SPANS_MOUNTS, err)
+	_, err = fs.Snapshot("./")
+	assert.Equal(t, SNAPSHOT_SPANS_MOUNTS, err)
+
+	// the root is relative to the mount's remote
+	manifest, err := fs.Snapshot("./m1/d1/")
+	assert.Nil(t, err)
+	assert.Equal(t, "d1", manifest.Root)
+
+	workDir2, err := os.MkdirTemp(os.TempDir(), "test")
+	if err != nil {
+		panic(err)
+	}
+	fs2, err := NewFileService(NewManifestRemoteProvider(remote, manifest), workDir2, 10000)
+	if err != nil {
+		panic(err)
+	}
+	client2 := NewFileClient(fs2)
+	openResp, err := client2.Open(&OpenReq{Path: "d2/f3"})
+	assert.Nil(t, err)
+	readResp, err := client2.Read(&ReadReq{FD: openResp.FD, Length: 6})
+	assert.Nil(t, err)
+	assert.Equal(t, "d1d2f3", string(readResp.Data))
+}
@@ -3,6 +3,7 @@ package treeply
 import (
 	"bufio"
 	"encoding/json"
+	"fmt"
 	"io"
 	"log"
 	"net"
@@ -11,13 +12,17 @@ import (
 	"syscall"
 )
 
-func InstallCleanup(socketName string) {
+func InstallCleanup(socketName string, fs *FileService) {
 	c := make(chan os.Signal, 1)
 	signal.Notify(c, os.Interrupt, syscall.SIGTERM)
 	go func() {
 		<-c
 		log.Printf("Received SIGTERM: Removing %s and exiting...", socketName)
 		os.Remove(socketName)
+		err := fs.Close()
+		if err != nil {
+			log.Printf("Could not write block index: %s", err)
+		}
 		os.Exit(1)
 	}()
 }
@@ -62,6 +67,15 @@ type ReadReq struct {
 
 type ReadResp struct {
 	Data []byte
+	// true if the read reached the end of the file, in which case Data may be
+	// shorter than requested or empty
+	EOF bool
+}
+
+type PReadReq struct {
+	FD     int
+	Offset int64
+	Length int
 }
 
 type SeekReq struct {
@@ -74,6 +88,18 @@ type SeekResp struct {
 	Offset int
 }
 
+type StatReq struct {
+	Path string
+}
+
+type StatResp struct {
+	Size         int64
+	IsDir        bool
+	ETag         string
+	BlockCount   int
+	CachedBlocks int
+}
+
 type DiagReq struct {
 }
 
@@ -81,8 +107,112 @@ type ForgetReq struct {
 	Path string
 }
 
+type MountReq struct {
+	Name string
+	// the address of the remote, as given on the command line (ie: "gs://bucket/prefix")
+	Remote string
+	// optional, how long directory listings are trusted (ie: "30s"). If
+	// empty, listings are kept until forgotten.
+	DirTTL string
+}
+
+type MountResp struct {
+}
+
+type UnmountReq struct {
+	Name string
+}
+
+type UnmountResp struct {
+}
+
+type SnapshotReq struct {
+	Path string
+}
+
+type SnapshotResp struct {
+	Files int
+	Dirs  int
+	// it's up to the client to save this, since the service shouldn't write
+	// wherever a client asks it to
+	Manifest *Manifest
+}
+
+type PrefetchReq struct {
+	Path string
+	// if true, only list directories without fetching the contents of files
+	MetadataOnly bool
+}
+
+type PinReq struct {
+	Path string
+}
+
+type UnpinReq struct {
+	Path string
+}
+
+type UnpinResp struct {
+}
+
+type VerifyReq struct {
+}
+
 type ErrorResp struct {
+	// one of the stable codes from ErrorCode, for clients to branch on
+	Code string
+	// the broader class of the error from ErrorErrno (ie: "ENOENT")
+	Errno   string
 	Message string
+	// the path and inode the request was about, when known
+	Path  string `json:",omitempty"`
+	INode INode  `json:",omitempty"`
+}
+
+func newErrorResp(err error, path string, inode INode) *ErrorResp {
+	return &ErrorResp{Code: ErrorCode(err), Errno: ErrorErrno(err), Message: err.Error(), Path: path, INode: inode}
+}
+
+// getRequestSubject returns the path and inode a request is about, for
+// reporting alongside any error. Either may be empty.
+func (fc *FileClient) getRequestSubject(req interface{}) (string, INode) {
+	fd := INVALID_FD
+	switch req := req.(type) {
+	case *ListDirReq:
+		return req.Path, 0
+	case *OpenReq:
+		return req.Path, 0
+	case *StatReq:
+		return req.Path, 0
+	case *ForgetReq:
+		return req.Path, 0
+	case *SnapshotReq:
+		return req.Path, 0
+	case *PrefetchReq:
+		return req.Path, 0
+	case *PinReq:
+		return req.Path, 0
+	case *UnpinReq:
+		return req.Path, 0
+	case *MountReq:
+		return req.Name, 0
+	case *UnmountReq:
+		return req.Name, 0
+	case *CloseReq:
+		fd = req.FD
+	case *ReadReq:
+		fd = req.FD
+	case *PReadReq:
+		fd = req.FD
+	case *SeekReq:
+		fd = req.FD
+	}
+
+	fh, ok := fc.FileHandles[fd]
+	if !ok {
+		return "", 0
+	}
+	return fh.Path, fh.INode
 }
 
 type Command struct {
@@ -91,11 +221,15 @@ type Command struct {
 	Invoke         func(interface{}) (interface{}, error)
 }
 
-func getCommand(client *FileClient, jsonMessage []byte) (*Command, interface{}) {
+// getCommand parses a request, returning the command it's for and its
+// payload. Returns INVALID_REQUEST, UNKNOWN_COMMAND or INVALID_PAYLOAD if it
+// can't be parsed.
+func getCommand(client *FileClient, jsonMessage []byte) (*Command, interface{}, error) {
 	var request ReqEnvelope
 	err := json.Unmarshal(jsonMessage, &request)
 	if err != nil {
-		log.Fatalf("Unmarshaling %s error: %s", string(jsonMessage), err)
+		log.Printf("Unmarshaling %s error: %s", string(jsonMessage), err)
+		return nil, nil, fmt.Errorf("%w: %s", INVALID_REQUEST, err)
 	}
 
 	commands := []Command{
@@ -120,6 +254,20 @@ func getCommand(client *FileClient, jsonMessage []byte) (*Command, interface{})
 			func(req interface{}) (interface{}, error) {
 				return client.Read(req.(*ReadReq))
 			}},
+		{"pread",
+			func() interface{} {
+				return new(PReadReq)
+			},
+			func(req interface{}) (interface{}, error) {
+				return client.PRead(req.(*PReadReq))
+			}},
+		{"seek",
+			func() interface{} {
+				return new(SeekReq)
+			},
+			func(req interface{}) (interface{}, error) {
+				return client.Seek(req.(*SeekReq))
+			}},
 		{"listdir",
 			func() interface{} {
 				return new(ListDirReq)
@@ -127,6 +275,13 @@ func getCommand(client *FileClient, jsonMessage []byte) (*Command, interface{})
 			func(req interface{}) (interface{}, error) {
 				return client.ListDir(req.(*ListDirReq))
 			}},
+		{"stat",
+			func() interface{} {
+				return new(StatReq)
+			},
+			func(req interface{}) (interface{}, error) {
+				return client.Stat(req.(*StatReq))
+			}},
 		{"diag",
 			func() interface{} {
 				return new(DiagReq)
@@ -143,6 +298,55 @@ func getCommand(client *FileClient, jsonMessage []byte) (*Command, interface{})
 				d, err := client.Forget(req.(*ForgetReq))
 				return d, err
 			}},
+		{"snapshot",
+			func() interface{} {
+				return new(SnapshotReq)
+			},
+			func(req interface{}) (interface{}, error) {
+				return client.Snapshot(req.(*SnapshotReq))
+			}},
+		{"prefetch",
+			func() interface{} {
+				return new(PrefetchReq)
+			},
+			func(req interface{}) (interface{}, error) {
+				return client.Prefetch(req.(*PrefetchReq))
+			}},
+		{"pin",
+			func() interface{} {
+				return new(PinReq)
+			},
+			func(req interface{}) (interface{}, error) {
+				return client.Pin(req.(*PinReq))
+			}},
+		{"unpin",
+			func() interface{} {
+				return new(UnpinReq)
+			},
+			func(req interface{}) (interface{}, error) {
+				return client.Unpin(req.(*UnpinReq))
+			}},
+		{"verify",
+			func() interface{} {
+				return new(VerifyReq)
+			},
+			func(req interface{}) (interface{}, error) {
+				return client.Verify(req.(*VerifyReq))
+			}},
+		{"mount",
+			func() interface{} {
+				return new(MountReq)
+			},
+			func(req interface{}) (interface{}, error) {
+				return client.Mount(req.(*MountReq))
+			}},
+		{"unmount",
+			func() interface{} {
+				return new(UnmountReq)
+			},
+			func(req interface{}) (interface{}, error) {
+				return client.Unmount(req.(*UnmountReq))
+			}},
 	}
 
 	for _, command := range commands {
@@ -151,23 +355,28 @@ func getCommand(client *FileClient, jsonMessage []byte) (*Command, interface{})
 			err = json.Unmarshal(request.Payload, req)
 			if err != nil {
 				log.Printf("Unmarshal payload %s into %s: %s", request.Payload, req, err)
-				return nil, nil
+				return nil, nil, fmt.Errorf("%w %s: %s", INVALID_PAYLOAD, request.Type, err)
 			}
 
-			return &command, req
+			return &command, req, nil
 		}
 	}
 
-	return nil, nil
+	return nil, nil, UNKNOWN_COMMAND
 }
 
 func DispatchReq(client *FileClient, j []byte) interface{} {
 
-	command, req := getCommand(client, j)
+	command, req, err := getCommand(client, j)
+	if err != nil {
+		return &RespEnvelope{Type: "error", Payload: newErrorResp(err, "", 0)}
+	}
 
+	// a request which closes its handle can't be looked up afterwards
+	path, inode := client.getRequestSubject(req)
 	resp, err := command.Invoke(req)
 	if err != nil {
-		return &RespEnvelope{Type: "error", Payload: &ErrorResp{Message: err.Error()}}
+		return &RespEnvelope{Type: "error", Payload: newErrorResp(err, path, inode)}
 	}
 
 	return &RespEnvelope{Type: "result", Payload: resp}
@@ -179,7 +388,7 @@ func CreateListener(socketName string, fs *FileService) error {
 		return err
 	}
 
-	InstallCleanup(socketName)
+	InstallCleanup(socketName, fs)
 
 	log.Printf("Listening on %s", socketName)
 	for {
@@ -195,38 +404,70 @@ func CreateListener(socketName string, fs *FileService) error {
 			defer connection.Close()
 
 			client := NewFileClient(fs)
-
-			reader := bufio.NewReader(connection)
-			for {
-				jsonMessage, isPrefix, err := reader.ReadLine()
-				if err == io.EOF {
-					break
-				}
-				if isPrefix {
-					log.Fatalf("Line too long")
-					return
-				}
-
-				log.Printf("Got message: %s", string(jsonMessage))
-				response := DispatchReq(client, jsonMessage)
-				if response == nil {
-					break
-				}
-				jsonResponse, err := json.Marshal(response)
+			// progress is written as separate "progress" envelopes before the command's result
+			client.OnProgress = func(progress interface{}) {
+				jsonProgress, err := json.Marshal(&RespEnvelope{Type: "progress", Payload: progress})
 				if err != nil {
-					log.Fatalf("Could not marshal: %s", err)
+					log.Printf("Could not marshal progress: %s", err)
 					return
 				}
-				jsonResponse = append(jsonResponse, '\n')
-				_, err = connection.Write(jsonResponse)
-
+				_, err = connection.Write(append(jsonProgress, '\n'))
 				if err != nil {
-					log.Fatalf("Could not write response: %s", err)
-					return
+					log.Printf("Could not write progress: %s", err)
 				}
 			}
 
+			serveRequests(client, connection)
+
 			// on reaching EOF, close connection
 		}(conn)
 	}
 }
+
+// serveRequests reads newline separated requests from connection, writing a
+// response to each, until the connection is closed
+func serveRequests(client *FileClient, connection io.ReadWriter) {
+	reader := bufio.NewReader(connection)
+	for {
+		jsonMessage, isPrefix, err := reader.ReadLine()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			log.Printf("Could not read request: %s", err)
+			return
+		}
+
+		var response interface{}
+		if isPrefix {
+			// skip the rest of the line, so the next request can still be read
+			for isPrefix && err == nil {
+				_, isPrefix, err = reader.ReadLine()
+			}
+			if err != nil {
+				log.Printf("Could not read request: %s", err)
+				return
+			}
+			log.Printf("Line too long")
+			response = &RespEnvelope{Type: "error", Payload: newErrorResp(fmt.Errorf("%w: line too long", INVALID_REQUEST), "", 0)}
+		} else {
+			log.Printf("Got message: %s", string(jsonMessage))
+			response = DispatchReq(client, jsonMessage)
+		}
+		if response == nil {
+			break
+		}
+		jsonResponse, err := json.Marshal(response)
+		if err != nil {
+			log.Printf("Could not marshal: %s", err)
+			return
+		}
+		jsonResponse = append(jsonResponse, '\n')
+		_, err = connection.Write(jsonResponse)
+
+		if err != nil {
+			log.Printf("Could not write response: %s", err)
+			return
+		}
+	}
+}
@@ -1,12 +1,139 @@
 package treeply
 
 import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
 	"testing"
 
+	"cloud.google.com/go/storage"
 	"github.com/stretchr/testify/assert"
+	"google.golang.org/api/googleapi"
 )
 
 func TestParseRequest(t *testing.T) {
-	_, req := getCommand(&FileClient{}, []byte("{\"Type\": \"listdir\", \"Payload\": {\"Path\": \".\"}}"))
+	_, req, err := getCommand(&FileClient{}, []byte("{\"Type\": \"listdir\", \"Payload\": {\"Path\": \".\"}}"))
+	assert.Nil(t, err)
 	assert.Equal(t, &ListDirReq{Path: "."}, req)
 }
+
+func TestParseSeekRequest(t *testing.T) {
+	_, req, err := getCommand(&FileClient{}, []byte("{\"Type\": \"seek\", \"Payload\": {\"FD\": 1, \"Offset\": 10, \"Whence\": \"SEEK_END\"}}"))
+	assert.Nil(t, err)
+	assert.Equal(t, &SeekReq{FD: 1, Offset: 10, Whence: SEEK_END}, req)
+}
+
+func TestDispatchInvalidRequest(t *testing.T) {
+	resp := DispatchReq(&FileClient{}, []byte("{\"Type\": "))
+	errorResp := resp.(*RespEnvelope).Payload.(*ErrorResp)
+	assert.Equal(t, "INVALID_REQUEST", errorResp.Code)
+	assert.Equal(t, EINVAL, errorResp.Errno)
+
+	// a payload which doesn't match the command is reported along with why
+	resp = DispatchReq(&FileClient{}, []byte("{\"Type\": \"read\", \"Payload\": {\"FD\": \"one\"}}"))
+	errorResp = resp.(*RespEnvelope).Payload.(*ErrorResp)
+	assert.Equal(t, "INVALID_PAYLOAD", errorResp.Code)
+	assert.Contains(t, errorResp.Message, "cannot unmarshal string")
+}
+
+type fakeConnection struct {
+	io.Reader
+	bytes.Buffer
+}
+
+func (c *fakeConnection) Read(p []byte) (int, error) {
+	return c.Reader.Read(p)
+}
+
+func TestServeRequestsAfterBadRequests(t *testing.T) {
+	connection := &fakeConnection{Reader: strings.NewReader("not json\n" + strings.Repeat("x", 10000) + "\n" +
+		"{\"Type\": \"bogus\", \"Payload\": {}}\n")}
+	serveRequests(&FileClient{}, connection)
+
+	var codes []string
+	decoder := json.NewDecoder(&connection.Buffer)
+	for decoder.More() {
+		var resp struct {
+			Type    string
+			Payload ErrorResp
+		}
+		assert.Nil(t, decoder.Decode(&resp))
+		assert.Equal(t, "error", resp.Type)
+		codes = append(codes, resp.Payload.Code)
+	}
+	assert.Equal(t, []string{"INVALID_REQUEST", "INVALID_REQUEST", "UNKNOWN_COMMAND"}, codes)
+}
+
+func TestDispatchUnknownCommand(t *testing.T) {
+	resp := DispatchReq(&FileClient{}, []byte("{\"Type\": \"bogus\", \"Payload\": {}}"))
+	assert.Equal(t, &RespEnvelope{Type: "error", Payload: &ErrorResp{Code: "UNKNOWN_COMMAND", Errno: EINVAL, Message: UNKNOWN_COMMAND.Error()}}, resp)
+}
+
+func TestErrorCodes(t *testing.T) {
+	assert.Equal(t, "FILE_CHANGED", ErrorCode(FILE_CHANGED))
+	assert.Equal(t, "FILE_CHANGED", ErrorCode(fmt.Errorf("reading f1: %w", FILE_CHANGED)))
+	assert.Equal(t, "CACHE_ERROR", ErrorCode(&CacheError{Op: "rename", Filename: "f1", Err: os.ErrPermission}))
+	assert.Equal(t, UnknownErrorCode, ErrorCode(os.ErrPermission))
+
+	resp := DispatchReq(&FileClient{FileHandles: make(map[int]*FileHandle)}, []byte("{\"Type\": \"read\", \"Payload\": {\"FD\": 5, \"Length\": 1}}"))
+	assert.Equal(t, &RespEnvelope{Type: "error", Payload: &ErrorResp{Code: "INVALID_HANDLE", Errno: EBADF, Message: INVALID_HANDLE.Error()}}, resp)
+}
+
+func TestErrorErrnos(t *testing.T) {
+	assert.Equal(t, ESTALE, ErrorErrno(FILE_CHANGED))
+	assert.Equal(t, ENOENT, ErrorErrno(INVALID_NAME))
+	assert.Equal(t, ENOTDIR, ErrorErrno(IS_NOT_DIR))
+	assert.Equal(t, EISDIR, ErrorErrno(IS_DIR))
+	assert.Equal(t, EIO, ErrorErrno(CHECKSUM_MISMATCH))
+	assert.Equal(t, EAGAIN, ErrorErrno(BLOCK_NOT_POPULATED))
+	assert.Equal(t, EIO, ErrorErrno(&CacheError{Op: "rename", Filename: "f1", Err: os.ErrPermission}))
+
+	// and errors from remotes
+	assert.Equal(t, ENOENT, ErrorErrno(fmt.Errorf("GET failed: %w", os.ErrNotExist)))
+	assert.Equal(t, ENOENT, ErrorErrno(&S3Error{StatusCode: 404, Code: "NoSuchKey"}))
+	assert.Equal(t, EACCES, ErrorErrno(&S3Error{StatusCode: 403, Code: "AccessDenied"}))
+	assert.Equal(t, EAGAIN, ErrorErrno(&TransientError{Err: &S3Error{StatusCode: 503}}))
+	assert.Equal(t, ENOENT, ErrorErrno(fmt.Errorf("reading f1: %w", storage.ErrObjectNotExist)))
+	assert.Equal(t, EACCES, ErrorErrno(&googleapi.Error{Code: 403}))
+	assert.Equal(t, EAGAIN, ErrorErrno(context.DeadlineExceeded))
+	assert.Equal(t, EIO, ErrorErrno(errors.New("something else")))
+}
+
+func TestErrorDetails(t *testing.T) {
+	workDir, err := os.MkdirTemp(os.TempDir(), "test")
+	if err != nil {
+		panic(err)
+	}
+
+	tmpDir, err := os.MkdirTemp(os.TempDir(), "test")
+	if err != nil {
+		panic(err)
+	}
+
+	writeFile(tmpDir+"/d1/f1", "f1", 10)
+
+	fs, err := NewFileService(&DirRemoteProvider{Root: tmpDir}, workDir, 10)
+	if err != nil {
+		panic(err)
+	}
+	client := NewFileClient(fs)
+
+	resp := DispatchReq(client, []byte("{\"Type\": \"open\", \"Payload\": {\"Path\": \"d1/missing\"}}"))
+	assert.Equal(t, &RespEnvelope{Type: "error", Payload: &ErrorResp{Code: "INVALID_NAME", Errno: ENOENT,
+		Message: INVALID_NAME.Error(), Path: "d1/missing"}}, resp)
+
+	resp = DispatchReq(client, []byte("{\"Type\": \"open\", \"Payload\": {\"Path\": \"d1\"}}"))
+	assert.Equal(t, EISDIR, resp.(*RespEnvelope).Payload.(*ErrorResp).Errno)
+
+	// requests on a file handle report the file it was opened on
+	openResp, err := client.Open(&OpenReq{Path: "d1/f1"})
+	assert.Nil(t, err)
+	resp = DispatchReq(client, []byte(fmt.Sprintf("{\"Type\": \"seek\", \"Payload\": {\"FD\": %d, \"Whence\": \"bogus\"}}", openResp.FD)))
+	assert.Equal(t, &RespEnvelope{Type: "error", Payload: &ErrorResp{Code: "INVALID_WHENCE", Errno: EINVAL,
+		Message: INVALID_WHENCE.Error(), Path: "d1/f1", INode: client.FileHandles[openResp.FD].INode}}, resp)
+}
@@ -0,0 +1,65 @@
+package treeply
+
+import (
+	"container/heap"
+	"context"
+	"io"
+)
+
+// A run of blocks which has been requested but is waiting for a free transfer slot
+type PendingTransfer struct {
+	TransferID  int
+	Priority    Priority
+	INode       INode
+	Run         blockRun
+	WorkDir     string
+	GetReader   func(ctx context.Context, blockIndex int, blockCount int) (io.Reader, error)
+	RetryPolicy *RetryPolicy
+
+	// position within the TransferQueue heap
+	index int
+}
+
+// TransferQueue orders pending transfers by priority, and then by the order
+// they were requested in. Implements heap.Interface.
+type TransferQueue []*PendingTransfer
+
+func (q TransferQueue) Len() int { return len(q) }
+
+func (q TransferQueue) Less(i, j int) bool {
+	if q[i].Priority != q[j].Priority {
+		return q[i].Priority > q[j].Priority
+	}
+	return q[i].TransferID < q[j].TransferID
+}
+
+func (q TransferQueue) Swap(i, j int) {
+	q[i], q[j] = q[j], q[i]
+	q[i].index = i
+	q[j].index = j
+}
+
+func (q *TransferQueue) Push(x interface{}) {
+	transfer := x.(*PendingTransfer)
+	transfer.index = len(*q)
+	*q = append(*q, transfer)
+}
+
+func (q *TransferQueue) Pop() interface{} {
+	old := *q
+	n := len(old)
+	transfer := old[n-1]
+	old[n-1] = nil
+	transfer.index = -1
+	*q = old[:n-1]
+	return transfer
+}
+
+// raisePriority moves a pending transfer ahead in the queue if the new priority is higher
+func (q *TransferQueue) raisePriority(transfer *PendingTransfer, priority Priority) {
+	if transfer.index < 0 || priority <= transfer.Priority {
+		return
+	}
+	transfer.Priority = priority
+	heap.Fix(q, transfer.index)
+}
@@ -1,19 +1,29 @@
 package treeply
 
 import (
+	"container/heap"
 	"context"
 	"io"
 	"log"
 	"os"
+	"sort"
 )
 
 const ReadChunkSize = 1024 * 1024
 
+// The default number of block transfers and directory listings which may be in progress at once
+const DefaultMaxActiveTransfers = 16
+const DefaultMaxActiveDirListings = 8
+
 type TransferServiceStatus struct {
 	BlocksRequested         int
 	ThreadsWaitingForBlocks int
 	DirsRequested           int
 	ThreadsWaitingForDirs   int
+	ActiveTransfers         int
+	QueuedTransfers         int
+	ActiveDirListings       int
+	QueuedDirListings       int
 }
 
 type INodeBlock struct {
@@ -25,12 +35,31 @@ type DiagnosticRequest struct {
 	Response chan *TransferServiceStatus
 }
 
+// SetLimitsRequest changes how many transfers and listings may run at once. Values <= 0 mean no limit.
+type SetLimitsRequest struct {
+	MaxActiveTransfers   int
+	MaxActiveDirListings int
+}
+
+// The most blocks which will be fetched via a single remote read
+const MaxBlocksPerTransfer = 64
+
 type BlockRequest struct {
-	Block     INodeBlock
-	BlockSize int64
-	GetReader func(context.Context) (io.Reader, error)
+	INode        INode
+	BlockIndices []int
+	BlockSize    int64
+	// returns a reader for blockCount consecutive blocks starting at blockIndex
+	GetReader func(ctx context.Context, blockIndex int, blockCount int) (io.Reader, error)
 	WorkDir   string
-	Response  chan error
+	// how to retry transient failures. If nil, failures are not retried.
+	RetryPolicy *RetryPolicy
+	// the keys to record each block under once it's been fetched. May be nil.
+	CacheKeys []*BlockKey
+	// one response per block, closed once that block has been fetched. If the
+	// block could not be fetched, the error is sent before closing, so these
+	// should be buffered.
+	Responses []chan error
+	Priority  Priority
 }
 
 type BlockCompletion struct {
@@ -38,21 +67,58 @@ type BlockCompletion struct {
 	Filename string
 }
 
+// TransferFinished is sent once a transfer has stopped reading from the remote
+type TransferFinished struct {
+	TransferID int
+}
+
+// BlockError reports that a transfer failed before fetching BlockCount
+// blocks starting at Block
 type BlockError struct {
-	Block INodeBlock
-	Error error
+	Block      INodeBlock
+	BlockCount int
+	TransferID int
+	Error      error
 }
 
 type WaitingThreads struct {
 	Waiting []chan error
 }
 
+type InFlightBlock struct {
+	Waiting    []chan error
+	CacheKey   *BlockKey
+	TransferID int
+}
+
+type BlockTransfers struct {
+	InFlight       map[INodeBlock]*InFlightBlock
+	nextTransferID int
+
+	Queue      TransferQueue
+	queuedByID map[int]*PendingTransfer
+	Active     int
+	MaxActive  int
+}
+
+type DirRequests struct {
+	InFlight  map[INode]*WaitingThreads
+	Queue     []*GetDirRequest
+	Active    int
+	MaxActive int
+}
+
 type GetDirRequest struct {
-	GetDirListing          func(context.Context) ([]RemoteFile, error)
-	DirINode               INode
-	MakeDirEntriesCallback func(name string) func(inode INode)
-	MakeFileCallback       func(name string, etag string) RequestCallback
-	Response               chan error
+	GetDirListing    func(context.Context) ([]RemoteFile, error)
+	DirINode         INode
+	MakeDirCallback  func(name string) *LazyDirectoryCallback
+	MakeFileCallback func(name string, etag string, checksum string) RequestCallback
+	// if true, the directory is already populated and the listing is merged
+	// into its existing entries
+	Revalidate bool
+	// closed once the listing is complete. If the listing failed, the error is
+	// sent before closing, so this should be buffered.
+	Response chan error
 }
 
 type GetDirCompletion struct {
@@ -60,24 +126,47 @@ type GetDirCompletion struct {
 	DirINode   INode
 }
 
+// GetDirError reports that the listing of a directory failed
+type GetDirError struct {
+	DirINode INode
+	Error    error
+}
+
+// GetDirFinished is sent once a listing has stopped reading from the remote, successfully or not
+type GetDirFinished struct {
+	DirINode INode
+}
+
 func TransferService(queue chan interface{}, INodes *INodes) {
-	blockRequests := make(map[INodeBlock]*WaitingThreads)
-	dirRequests := make(map[INode]*WaitingThreads)
+	blockTransfers := &BlockTransfers{InFlight: make(map[INodeBlock]*InFlightBlock),
+		queuedByID: make(map[int]*PendingTransfer), MaxActive: DefaultMaxActiveTransfers}
+	dirRequests := &DirRequests{InFlight: make(map[INode]*WaitingThreads), MaxActive: DefaultMaxActiveDirListings}
 
 	for _request := range queue {
 		switch request := _request.(type) {
 		case *BlockRequest:
-			doBlockRequest(blockRequests, request, INodes, queue)
+			doBlockRequest(blockTransfers, request, INodes, queue)
 		case *BlockCompletion:
-			doBlockCompletion(blockRequests, INodes, request)
+			doBlockCompletion(blockTransfers, INodes, request)
 		case *BlockError:
-			doBlockError(blockRequests, INodes, request)
+			doBlockError(blockTransfers, INodes, request)
+		case *TransferFinished:
+			doTransferFinished(blockTransfers, INodes, request, queue)
 		case *GetDirRequest:
 			doGetDir(dirRequests, INodes, request, queue)
 		case *GetDirCompletion:
 			doGetDirCompletion(dirRequests, INodes, request)
+		case *GetDirError:
+			doGetDirError(dirRequests, INodes, request)
+		case *GetDirFinished:
+			doGetDirFinished(dirRequests, INodes, request, queue)
 		case *DiagnosticRequest:
-			doDiagnosticRequest(blockRequests, dirRequests, request)
+			doDiagnosticRequest(blockTransfers, dirRequests, request)
+		case *SetLimitsRequest:
+			blockTransfers.MaxActive = request.MaxActiveTransfers
+			dirRequests.MaxActive = request.MaxActiveDirListings
+			startQueuedTransfers(blockTransfers, INodes, queue)
+			startQueuedDirListings(dirRequests, INodes, queue)
 		default:
 			panic("unknown msg")
 		}
@@ -85,84 +174,282 @@ func TransferService(queue chan interface{}, INodes *INodes) {
 	}
 }
 
-func doBlockRequest(blockState map[INodeBlock]*WaitingThreads, request *BlockRequest, inodes *INodes, mailbox chan interface{}) {
-	log.Printf("Received block request: %d:%d", request.Block.INode, request.Block.BlockIndex)
-	state, ok := blockState[request.Block]
-	if ok {
-		// if this block is already in progress, so just add this request to the waiting list
-		state.Waiting = append(state.Waiting, request.Response)
-		return
-	} else {
+type blockRun struct {
+	Start int
+	Count int
+}
+
+// groupIntoRuns sorts the block indices and splits them into runs of
+// consecutive blocks, each no longer than maxCount
+func groupIntoRuns(blockIndices []int, maxCount int) []blockRun {
+	sorted := append([]int(nil), blockIndices...)
+	sort.Ints(sorted)
+
+	runs := make([]blockRun, 0)
+	for _, blockIndex := range sorted {
+		if len(runs) > 0 {
+			last := &runs[len(runs)-1]
+			if last.Start+last.Count == blockIndex && last.Count < maxCount {
+				last.Count++
+				continue
+			}
+		}
+		runs = append(runs, blockRun{Start: blockIndex, Count: 1})
+	}
+	return runs
+}
+
+func doBlockRequest(transfers *BlockTransfers, request *BlockRequest, inodes *INodes, mailbox chan interface{}) {
+	log.Printf("Received block request: %d:%v", request.INode, request.BlockIndices)
+
+	toFetch := make([]int, 0, len(request.BlockIndices))
+	for i, blockIndex := range request.BlockIndices {
+		block := INodeBlock{INode: request.INode, BlockIndex: blockIndex}
+		state, ok := transfers.InFlight[block]
+		if ok {
+			// if this block is already in progress, so just add this request to the waiting list
+			state.Waiting = append(state.Waiting, request.Responses[i])
+			// and if it hasn't started yet, make sure it's not stuck behind lower priority work
+			if queued, ok := transfers.queuedByID[state.TransferID]; ok {
+				transfers.Queue.raisePriority(queued, request.Priority)
+			}
+			continue
+		}
+
 		// if we don't have as a block which is in progress, check to see if maybe
 		// it's already been populated while this request has been waiting in the
 		// queue.
-		if inodes.IsBlockPopulated(request.Block.INode, request.Block.BlockIndex) {
-			log.Printf("Block %d:%d is already populated", request.Block.INode, request.Block.BlockIndex)
-			close(request.Response)
-			return
+		populated, err := inodes.IsBlockPopulated(request.INode, blockIndex)
+		if err != nil {
+			// ie: the inode was released while the request was queued
+			select {
+			case request.Responses[i] <- err:
+			default:
+			}
+			close(request.Responses[i])
+			continue
+		}
+		if populated {
+			log.Printf("Block %d:%d is already populated", request.INode, blockIndex)
+			close(request.Responses[i])
+			continue
+		}
+
+		var cacheKey *BlockKey
+		if request.CacheKeys != nil {
+			cacheKey = request.CacheKeys[i]
+		}
+		transfers.InFlight[block] = &InFlightBlock{Waiting: []chan error{request.Responses[i]}, CacheKey: cacheKey}
+		toFetch = append(toFetch, blockIndex)
+	}
+
+	// queue one transfer for each run of consecutive blocks
+	for _, run := range groupIntoRuns(toFetch, MaxBlocksPerTransfer) {
+		transfers.nextTransferID++
+		transferID := transfers.nextTransferID
+		for i := 0; i < run.Count; i++ {
+			transfers.InFlight[INodeBlock{INode: request.INode, BlockIndex: run.Start + i}].TransferID = transferID
 		}
+
+		pending := &PendingTransfer{TransferID: transferID, Priority: request.Priority, INode: request.INode,
+			Run: run, WorkDir: request.WorkDir, GetReader: request.GetReader, RetryPolicy: request.RetryPolicy}
+		heap.Push(&transfers.Queue, pending)
+		transfers.queuedByID[transferID] = pending
 	}
 
+	startQueuedTransfers(transfers, inodes, mailbox)
+}
+
+// startQueuedTransfers starts the highest priority transfers until we run out of transfer slots
+func startQueuedTransfers(transfers *BlockTransfers, inodes *INodes, mailbox chan interface{}) {
 	ctx := context.Background()
-	// start a new transfer
-	blockState[request.Block] = &WaitingThreads{Waiting: []chan error{request.Response}}
-	log.Printf("starting transfer for %d:%d", request.Block.INode, request.Block.BlockIndex)
-	go startTransfer(ctx, mailbox, request.WorkDir, request.Block.INode, request.Block.BlockIndex,
-		inodes.blockSize, request.GetReader)
+	for transfers.Queue.Len() > 0 && (transfers.MaxActive <= 0 || transfers.Active < transfers.MaxActive) {
+		pending := heap.Pop(&transfers.Queue).(*PendingTransfer)
+		delete(transfers.queuedByID, pending.TransferID)
+		transfers.Active++
+
+		// every block of the run must be filled, except for the last block of the file
+		length := int64(pending.Run.Count) * inodes.blockSize
+		if stat, err := inodes.Stat(pending.INode); err == nil {
+			remaining := stat.Size - int64(pending.Run.Start)*inodes.blockSize
+			if remaining < length {
+				length = remaining
+			}
+		}
+
+		log.Printf("starting transfer %d for %d:%d (%d blocks)", pending.TransferID, pending.INode, pending.Run.Start, pending.Run.Count)
+		go startTransfer(ctx, mailbox, pending.WorkDir, pending.INode, pending.Run.Start, pending.Run.Count, length, pending.TransferID,
+			inodes.blockSize, pending.GetReader, pending.RetryPolicy)
+	}
+}
+
+func doTransferFinished(transfers *BlockTransfers, inodes *INodes, finished *TransferFinished, mailbox chan interface{}) {
+	transfers.Active--
+	startQueuedTransfers(transfers, inodes, mailbox)
 }
 
-func doBlockError(blockState map[INodeBlock]*WaitingThreads, inodes *INodes, completion *BlockError) {
-	log.Printf("got error for block %d:%d: %s", completion.Block.INode, completion.Block.BlockIndex, completion.Error)
+func doBlockError(transfers *BlockTransfers, inodes *INodes, completion *BlockError) {
+	log.Printf("got error for blocks %d:%d-%d: %s", completion.Block.INode, completion.Block.BlockIndex,
+		completion.Block.BlockIndex+completion.BlockCount-1, completion.Error)
+
+	// only mark the file as unreadable if it has changed. Otherwise, a later read can try again.
+	markedUnreadable := false
+	for i := 0; i < completion.BlockCount; i++ {
+		block := INodeBlock{INode: completion.Block.INode, BlockIndex: completion.Block.BlockIndex + i}
 
-	inodes.MarkUnreadable(completion.Block.INode, completion.Error)
+		// ignore blocks which have since been requested again by a different transfer
+		state, ok := transfers.InFlight[block]
+		if !ok || state.TransferID != completion.TransferID {
+			continue
+		}
+
+		if !markedUnreadable && IsPreconditionFailure(completion.Error) {
+			err := inodes.MarkUnreadable(completion.Block.INode, completion.Error)
+			if err != nil {
+				log.Printf("Could not mark inode %d unreadable: %s", completion.Block.INode, err)
+			}
+			markedUnreadable = true
+		}
 
-	wakeWaitingForBlock(blockState, completion.Block)
+		wakeWaitingForBlock(transfers, block, completion.Error)
+	}
 }
 
-func wakeWaitingForBlock(blockState map[INodeBlock]*WaitingThreads, block INodeBlock) {
-	state, ok := blockState[block]
+// wakeWaitingForBlock notifies everyone waiting on the block, passing along err if the block could not be fetched
+func wakeWaitingForBlock(transfers *BlockTransfers, block INodeBlock, err error) {
+	state, ok := transfers.InFlight[block]
 	if ok {
 		log.Printf("waking %d threads", len(state.Waiting))
 		for _, waiting := range state.Waiting {
+			if err != nil {
+				// response channels are buffered, but never block the transfer service
+				// if someone didn't allocate room for the error
+				select {
+				case waiting <- err:
+				default:
+				}
+			}
 			close(waiting)
 		}
+		delete(transfers.InFlight, block)
 	} else {
 		log.Printf("Warning: Got block completion of block not requested")
 	}
 }
 
-func doBlockCompletion(blockState map[INodeBlock]*WaitingThreads, inodes *INodes, completion *BlockCompletion) {
+func doBlockCompletion(transfers *BlockTransfers, inodes *INodes, completion *BlockCompletion) {
 	log.Printf("completed transfer for %d:%d", completion.Block.INode, completion.Block.BlockIndex)
 
-	blockID := inodes.blocks.Allocate(completion.Filename)
+	var blockID BlockID
+	hash, err := hashBlockFile(completion.Filename)
+	if err != nil {
+		log.Printf("Could not hash %s, storing it without a checksum: %s", completion.Filename, err)
+		blockID, err = inodes.blocks.Allocate(completion.Filename)
+	} else {
+		blockID, err = inodes.blocks.AllocateWithHash(completion.Filename, hash)
+	}
+	if err != nil {
+		log.Printf("Could not add %s to the cache: %s", completion.Filename, err)
+		os.Remove(completion.Filename)
+		wakeWaitingForBlock(transfers, completion.Block, err)
+		return
+	}
 	log.Printf("mapping %s to block %d", completion.Filename, blockID)
-	inodes.SetBlock(completion.Block.INode, completion.Block.BlockIndex, blockID)
+	if state, ok := transfers.InFlight[completion.Block]; ok && state.CacheKey != nil {
+		inodes.blocks.SetKey(blockID, *state.CacheKey)
+	}
+	err = inodes.SetBlock(completion.Block.INode, completion.Block.BlockIndex, blockID)
+	if err != nil {
+		// the block stays cached under its key, but nothing else references it
+		log.Printf("Could not set block %d:%d: %s", completion.Block.INode, completion.Block.BlockIndex, err)
+		inodes.blocks.UpdateRefCount(blockID, -1)
+		wakeWaitingForBlock(transfers, completion.Block, err)
+		return
+	}
 	log.Printf("setblock called for %d:%d", completion.Block.INode, completion.Block.BlockIndex)
 
-	wakeWaitingForBlock(blockState, completion.Block)
+	wakeWaitingForBlock(transfers, completion.Block, nil)
 }
 
-func startTransfer(ctx context.Context, completions chan interface{}, WorkDir string, inode INode, blockIndex int, BlockSize int64, GetReader func(context.Context) (io.Reader, error)) {
-	reader, err := GetReader(ctx) // Remote.GetReader(ctx, path, etag, int64(blockIndex)*BlockSize, BlockSize)
+// startTransfer fetches blockCount blocks starting at blockIndex, which
+// should add up to length bytes
+func startTransfer(ctx context.Context, completions chan interface{}, WorkDir string, inode INode, blockIndex int, blockCount int, length int64, transferID int, BlockSize int64, GetReader func(context.Context, int, int) (io.Reader, error), retryPolicy *RetryPolicy) {
+	if retryPolicy == nil {
+		retryPolicy = &RetryPolicy{MaxAttempts: 1}
+	}
+
+	completed := 0
+	var err error
+	for attempt := 1; ; attempt++ {
+		var n int
+		n, err = transferAttempt(ctx, completions, WorkDir, inode, blockIndex+completed, blockCount-completed, length-int64(completed)*BlockSize, BlockSize, GetReader, retryPolicy)
+		completed += n
+		log.Printf("transfer %d completed %d of %d blocks, err=%s", transferID, completed, blockCount, err)
+		if completed >= blockCount {
+			break
+		}
+		if n > 0 {
+			// we made progress, so don't count earlier failures against this transfer
+			attempt = 1
+		}
+		if !retryPolicy.shouldRetry(ctx, attempt, err) {
+			break
+		}
+		log.Printf("Retrying transfer %d after error: %s", transferID, err)
+	}
+
+	// any blocks which we didn't get to must be failed, otherwise whoever is waiting on them would wait forever
+	if completed < blockCount {
+		completions <- &BlockError{Block: INodeBlock{INode: inode, BlockIndex: blockIndex + completed},
+			BlockCount: blockCount - completed, TransferID: transferID, Error: err}
+	}
+
+	completions <- &TransferFinished{TransferID: transferID}
+}
+
+// transferAttempt makes a single request for the given blocks. Returns the number of blocks completed.
+func transferAttempt(ctx context.Context, completions chan interface{}, WorkDir string, inode INode, blockIndex int, blockCount int, length int64, BlockSize int64, GetReader func(context.Context, int, int) (io.Reader, error), retryPolicy *RetryPolicy) (int, error) {
+	ctx, cancel := retryPolicy.withTimeout(ctx)
+	defer cancel()
+
+	reader, err := GetReader(ctx, blockIndex, blockCount)
 	if err != nil {
-		log.Printf("Error in requestDirEntries: %s", err)
-		completions <- &BlockError{Block: INodeBlock{INode: inode, BlockIndex: blockIndex}, Error: err}
-		return
+		log.Printf("Error in GetReader: %s", err)
+		return 0, err
 	}
-	err = Transfer(ctx, inode, BlockSize, blockIndex, WorkDir, completions, reader, ReadChunkSize)
-	log.Printf("err=%s", err)
+
+	completed, err := Transfer(ctx, inode, BlockSize, blockIndex, length, WorkDir, completions, reader, ReadChunkSize)
+	if err == nil && completed < blockCount {
+		err = io.ErrUnexpectedEOF
+	}
+	return completed, err
 }
 
-func Transfer(ctx context.Context, inode INode, blockSize int64, blockIndex int, tempDir string, completions chan interface{}, reader io.Reader, readChunkSize int) error {
+// Transfer copies the contents of reader into a series of block files, sending a BlockCompletion for
+// each one. Returns the number of blocks completed. reader should contain length bytes, and if it
+// ends early, the partial block is dropped and io.ErrUnexpectedEOF is returned.
+func Transfer(ctx context.Context, inode INode, blockSize int64, blockIndex int, length int64, tempDir string, completions chan interface{}, reader io.Reader, readChunkSize int) (int, error) {
 	if blockSize == 0 {
 		panic("blocksize==0")
 	}
 	if readerCloser, ok := reader.(io.Closer); ok {
 		defer readerCloser.Close()
 	}
+	// ignore anything past what was asked for
+	reader = io.LimitReader(reader, length)
+	var bytesRead int64
 
 	var file *os.File
 	var bytesInBlockRemaining int
+	completed := 0
+
+	defer (func() {
+		// if we stopped part way through a block, that partial block is useless
+		if file != nil {
+			file.Close()
+			os.Remove(file.Name())
+		}
+	})()
 
 	finishCurrentFile := func() error {
 		if file != nil {
@@ -173,6 +460,7 @@ func Transfer(ctx context.Context, inode INode, blockSize int64, blockIndex int,
 			}
 			completions <- &BlockCompletion{Block: INodeBlock{INode: inode, BlockIndex: blockIndex}, Filename: file.Name()}
 			blockIndex++
+			completed++
 			file = nil
 		}
 		return nil
@@ -224,39 +512,68 @@ func Transfer(ctx context.Context, inode INode, blockSize int64, blockIndex int,
 	for {
 		n, err := reader.Read(buffer)
 		log.Printf("read completed n=%d, err=%s", n, err)
-		writeToTemp(buffer[:n])
+		bytesRead += int64(n)
+		writeErr := writeToTemp(buffer[:n])
+		if writeErr != nil {
+			return completed, writeErr
+		}
 		if err == io.EOF {
 			break
 		} else if err != nil {
-			return err
+			return completed, err
 		}
 		if ctx.Err() != nil {
-			return ctx.Err()
+			return completed, ctx.Err()
 		}
 	}
 	log.Printf("done reading")
-	return finishCurrentFile()
+	if bytesRead < length {
+		log.Printf("Expected %d bytes but only got %d", length, bytesRead)
+		return completed, io.ErrUnexpectedEOF
+	}
+	err := finishCurrentFile()
+	return completed, err
 }
 
-func doGetDirCompletion(dirRequests map[INode]*WaitingThreads, inodes *INodes, request *GetDirCompletion) {
-	inodes.SetDirEntries(request.DirINode, request.DirEntries)
+func doGetDirCompletion(dirRequests *DirRequests, inodes *INodes, request *GetDirCompletion) {
+	err := inodes.SetDirEntries(request.DirINode, request.DirEntries)
+
+	wakeWaitingForDir(dirRequests, request.DirINode, err)
+}
+
+func doGetDirError(dirRequests *DirRequests, inodes *INodes, request *GetDirError) {
+	// if revalidating a listing failed, the previous listing is still usable
+	populated, err := inodes.IsDirPopulated(request.DirINode)
+	if err == nil && !populated {
+		inodes.MarkDirListingFailed(request.DirINode, request.Error)
+	}
+
+	wakeWaitingForDir(dirRequests, request.DirINode, request.Error)
+}
 
-	// notify any waiting that the request has completed
-	existing, ok := dirRequests[request.DirINode]
+// wakeWaitingForDir notifies everyone waiting on the listing, passing along err if it failed
+func wakeWaitingForDir(dirRequests *DirRequests, dirINode INode, err error) {
+	existing, ok := dirRequests.InFlight[dirINode]
 	if !ok {
 		panic("missing dir request")
 	}
 	for _, waiting := range existing.Waiting {
+		if err != nil {
+			select {
+			case waiting <- err:
+			default:
+			}
+		}
 		close(waiting)
 	}
 
 	// remove from the list of in-progress requests
-	delete(dirRequests, request.DirINode)
+	delete(dirRequests.InFlight, dirINode)
 }
 
-func doGetDir(dirRequests map[INode]*WaitingThreads, inodes *INodes, request *GetDirRequest, mailbox chan interface{}) {
+func doGetDir(dirRequests *DirRequests, inodes *INodes, request *GetDirRequest, mailbox chan interface{}) {
 
-	existing, ok := dirRequests[request.DirINode]
+	existing, ok := dirRequests.InFlight[request.DirINode]
 	if ok {
 		// if there's an existing request, simply add this to the list of channels to notify when the request is
 		// complete
@@ -265,22 +582,63 @@ func doGetDir(dirRequests map[INode]*WaitingThreads, inodes *INodes, request *Ge
 	}
 
 	// double check that this dir isn't yet populated
-	if inodes.IsDirPopulated(request.DirINode) {
+	populated, err := inodes.IsDirPopulated(request.DirINode)
+	if err != nil {
+		select {
+		case request.Response <- err:
+		default:
+		}
+		close(request.Response)
+		return
+	}
+	if !request.Revalidate && populated {
 		// if so, it must have gotten populated in parallel. Notify thread its done
 		close(request.Response)
+		return
 	}
 
 	// We must create a new request to get the dir contents
-	dirRequests[request.DirINode] = &WaitingThreads{Waiting: []chan error{request.Response}}
+	dirRequests.InFlight[request.DirINode] = &WaitingThreads{Waiting: []chan error{request.Response}}
+	dirRequests.Queue = append(dirRequests.Queue, request)
+	startQueuedDirListings(dirRequests, inodes, mailbox)
+}
+
+// startQueuedDirListings starts listings in the order they were requested until we run out of listing slots
+func startQueuedDirListings(dirRequests *DirRequests, inodes *INodes, mailbox chan interface{}) {
 	ctx := context.Background()
-	go startGetDir(ctx, inodes, request, mailbox)
+	for len(dirRequests.Queue) > 0 && (dirRequests.MaxActive <= 0 || dirRequests.Active < dirRequests.MaxActive) {
+		request := dirRequests.Queue[0]
+		dirRequests.Queue = dirRequests.Queue[1:]
+		dirRequests.Active++
+		go startGetDir(ctx, inodes, request, mailbox)
+	}
+}
 
+func doGetDirFinished(dirRequests *DirRequests, inodes *INodes, finished *GetDirFinished, mailbox chan interface{}) {
+	dirRequests.Active--
+	startQueuedDirListings(dirRequests, inodes, mailbox)
 }
 
 func startGetDir(ctx context.Context, inodes *INodes, request *GetDirRequest, mailbox chan interface{}) {
+	defer (func() {
+		mailbox <- &GetDirFinished{DirINode: request.DirINode}
+	})()
+
 	files, err := request.GetDirListing(ctx)
 	if err != nil {
 		log.Printf("Error in requestDirEntries: %s", err)
+		mailbox <- &GetDirError{DirINode: request.DirINode, Error: err}
+		return
+	}
+
+	if request.Revalidate {
+		err = inodes.MergeDirListing(request.DirINode, files, request.MakeDirCallback, request.MakeFileCallback)
+		if err != nil {
+			mailbox <- &GetDirError{DirINode: request.DirINode, Error: err}
+		} else {
+			// the entries have already been updated, so there's nothing more to set
+			mailbox <- &GetDirCompletion{DirINode: request.DirINode}
+		}
 		return
 	}
 
@@ -288,9 +646,9 @@ func startGetDir(ctx context.Context, inodes *INodes, request *GetDirRequest, ma
 	for _, file := range files {
 		var inode INode
 		if file.IsDir {
-			inode = inodes.CreateLazyDir(request.DirINode, &LazyDirectoryCallback{RequestDirEntries: request.MakeDirEntriesCallback(file.Name)})
+			inode = inodes.CreateLazyDir(request.DirINode, request.MakeDirCallback(file.Name))
 		} else {
-			inode = inodes.CreateLazyFile(file.Size, request.MakeFileCallback(file.Name, file.ETag))
+			inode = inodes.CreateLazyFile(file.Size, file.ETag, request.MakeFileCallback(file.Name, file.ETag, file.Checksum))
 		}
 		dirEntries = append(dirEntries, DirEntry{Name: file.Name, INode: inode})
 	}
@@ -298,22 +656,26 @@ func startGetDir(ctx context.Context, inodes *INodes, request *GetDirRequest, ma
 	mailbox <- &GetDirCompletion{DirINode: request.DirINode, DirEntries: dirEntries}
 }
 
-func doDiagnosticRequest(blockState map[INodeBlock]*WaitingThreads, dirRequests map[INode]*WaitingThreads, request *DiagnosticRequest) {
+func doDiagnosticRequest(transfers *BlockTransfers, dirRequests *DirRequests, request *DiagnosticRequest) {
 	ThreadsWaitingForBlocks := 0
-	for _, request := range blockState {
+	for _, request := range transfers.InFlight {
 		ThreadsWaitingForBlocks += len(request.Waiting)
 	}
 
 	ThreadsWaitingForDirs := 0
-	for _, request := range dirRequests {
+	for _, request := range dirRequests.InFlight {
 		ThreadsWaitingForDirs += len(request.Waiting)
 	}
 
 	response := &TransferServiceStatus{
-		BlocksRequested:         len(blockState),
+		BlocksRequested:         len(transfers.InFlight),
 		ThreadsWaitingForBlocks: ThreadsWaitingForBlocks,
-		DirsRequested:           len(dirRequests),
+		DirsRequested:           len(dirRequests.InFlight),
 		ThreadsWaitingForDirs:   ThreadsWaitingForDirs,
+		ActiveTransfers:         transfers.Active,
+		QueuedTransfers:         transfers.Queue.Len(),
+		ActiveDirListings:       dirRequests.Active,
+		QueuedDirListings:       len(dirRequests.Queue),
 	}
 
 	request.Response <- response
@@ -3,8 +3,11 @@ package treeply
 import (
 	"bytes"
 	"context"
+	"errors"
+	"io"
 	"os"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 )
@@ -24,7 +27,7 @@ func TestTransfer(t *testing.T) {
 
 	go (func() {
 		Transfer(context.Background(),
-			inode, blockSize, blockIndex, tempDir,
+			inode, blockSize, blockIndex, int64(len(source)), tempDir,
 			completions, reader, readChunkSize)
 		close(completions)
 	})()
@@ -56,3 +59,200 @@ func TestTransfer(t *testing.T) {
 	_, remaining := <-completions
 	assert.False(t, remaining)
 }
+
+func TestGroupIntoRuns(t *testing.T) {
+	assert.Equal(t, []blockRun{}, groupIntoRuns([]int{}, 3))
+	assert.Equal(t, []blockRun{{Start: 1, Count: 3}, {Start: 5, Count: 1}, {Start: 7, Count: 3}, {Start: 10, Count: 1}},
+		groupIntoRuns([]int{10, 5, 9, 2, 3, 1, 7, 8}, 3))
+}
+
+func makeTestRequestCallback(queue chan interface{}, workDir string, retryPolicy *RetryPolicy, getReader func(ctx context.Context, blockIndex int, blockCount int) (io.Reader, error)) RequestCallback {
+	return func(inode INode, blockIndices []int, priority Priority) error {
+		responses := make([]chan error, len(blockIndices))
+		for i := range responses {
+			responses[i] = make(chan error, 1)
+		}
+		queue <- &BlockRequest{INode: inode, BlockIndices: blockIndices, WorkDir: workDir, Responses: responses,
+			RetryPolicy: retryPolicy, GetReader: getReader}
+		var firstErr error
+		for _, response := range responses {
+			err, ok := <-response
+			if ok && firstErr == nil {
+				firstErr = err
+			}
+		}
+		return firstErr
+	}
+}
+
+func TestTransferServiceShortRead(t *testing.T) {
+	workDir, err := os.MkdirTemp(os.TempDir(), "test")
+	if err != nil {
+		panic(err)
+	}
+
+	inodes, err := NewINodes(workDir, 10)
+	if err != nil {
+		panic(err)
+	}
+
+	queue := make(chan interface{})
+	go TransferService(queue, inodes)
+
+	readerCalls := 0
+	requestCallback := makeTestRequestCallback(queue, workDir, nil, func(ctx context.Context, blockIndex int, blockCount int) (io.Reader, error) {
+		readerCalls++
+		// only return a block and a half, even though more was requested
+		return bytes.NewBuffer(make([]byte, 15)), nil
+	})
+
+	inode := inodes.CreateLazyFile(30, "", requestCallback)
+	buffer := make([]byte, 30)
+	_, err = inodes.ReadFile(inode, 0, buffer)
+	assert.Equal(t, io.ErrUnexpectedEOF, err)
+	assert.Equal(t, 1, readerCalls)
+
+	// the half block isn't kept, as it isn't the end of the file
+	populated, err := inodes.IsBlockPopulated(inode, 0)
+	assert.Nil(t, err)
+	assert.True(t, populated)
+	populated, err = inodes.IsBlockPopulated(inode, 1)
+	assert.Nil(t, err)
+	assert.False(t, populated)
+}
+
+func TestTransferServicePriority(t *testing.T) {
+	workDir, err := os.MkdirTemp(os.TempDir(), "test")
+	if err != nil {
+		panic(err)
+	}
+
+	inodes, err := NewINodes(workDir, 10)
+	if err != nil {
+		panic(err)
+	}
+
+	queue := make(chan interface{})
+	go TransferService(queue, inodes)
+	queue <- &SetLimitsRequest{MaxActiveTransfers: 1, MaxActiveDirListings: 1}
+
+	started := make(chan int, 10)
+	release := make(chan bool)
+	inode := inodes.CreateLazyFile(100, "", nil)
+
+	request := func(blockIndex int, priority Priority) chan error {
+		response := make(chan error)
+		queue <- &BlockRequest{INode: inode, BlockIndices: []int{blockIndex}, WorkDir: workDir,
+			Responses: []chan error{response}, Priority: priority,
+			GetReader: func(ctx context.Context, blockIndex int, blockCount int) (io.Reader, error) {
+				started <- blockIndex
+				<-release
+				return bytes.NewBuffer(make([]byte, 10)), nil
+			}}
+		return response
+	}
+
+	status := func() *TransferServiceStatus {
+		response := make(chan *TransferServiceStatus)
+		queue <- &DiagnosticRequest{Response: response}
+		return <-response
+	}
+
+	// occupy the only transfer slot
+	r0 := request(0, BlockingPriority)
+	assert.Equal(t, 0, <-started)
+
+	// queue up prefetches, and then a blocking request
+	r1 := request(1, PrefetchPriority)
+	r2 := request(2, PrefetchPriority)
+	r3 := request(3, BlockingPriority)
+	s := status()
+	assert.Equal(t, 1, s.ActiveTransfers)
+	assert.Equal(t, 3, s.QueuedTransfers)
+
+	// a blocking request for a queued prefetch should move it ahead of the other prefetch
+	r2b := request(2, BlockingPriority)
+
+	// once the slot frees up, the blocking requests should go first, in the order they were queued
+	release <- true
+	<-r0
+	assert.Equal(t, 2, <-started)
+	release <- true
+	<-r2
+	<-r2b
+	assert.Equal(t, 3, <-started)
+	release <- true
+	<-r3
+	assert.Equal(t, 1, <-started)
+	release <- true
+	<-r1
+
+	assert.Eventually(t, func() bool { return status().ActiveTransfers == 0 }, time.Second, 10*time.Millisecond)
+	assert.Equal(t, 0, status().QueuedTransfers)
+}
+
+func TestTransferServiceRetries(t *testing.T) {
+	workDir, err := os.MkdirTemp(os.TempDir(), "test")
+	if err != nil {
+		panic(err)
+	}
+
+	inodes, err := NewINodes(workDir, 10)
+	if err != nil {
+		panic(err)
+	}
+
+	queue := make(chan interface{})
+	go TransferService(queue, inodes)
+
+	retryPolicy := &RetryPolicy{MaxAttempts: 3, InitialBackoff: time.Millisecond, MaxBackoff: time.Millisecond}
+	var failure error
+	failuresRemaining := 0
+	readerCalls := 0
+	requestCallback := makeTestRequestCallback(queue, workDir, retryPolicy, func(ctx context.Context, blockIndex int, blockCount int) (io.Reader, error) {
+		readerCalls++
+		if failuresRemaining > 0 {
+			failuresRemaining--
+			return nil, failure
+		}
+		return bytes.NewBuffer(make([]byte, 10*blockCount)), nil
+	})
+	inode := inodes.CreateLazyFile(30, "", requestCallback)
+	buffer := make([]byte, 10)
+
+	// transient errors are retried
+	failure = &TransientError{Err: errors.New("connection reset")}
+	failuresRemaining = 2
+	n, err := inodes.ReadFile(inode, 0, buffer)
+	assert.Nil(t, err)
+	assert.Equal(t, 10, n)
+	assert.Equal(t, 3, readerCalls)
+
+	// but only up to the policy's limit
+	readerCalls = 0
+	failuresRemaining = 3
+	_, err = inodes.ReadFile(inode, 10, buffer)
+	assert.Equal(t, failure, err)
+	assert.Equal(t, 3, readerCalls)
+
+	// and the failure doesn't prevent a later read from succeeding
+	n, err = inodes.ReadFile(inode, 10, buffer)
+	assert.Nil(t, err)
+	assert.Equal(t, 10, n)
+
+	// errors which aren't transient are not retried
+	readerCalls = 0
+	failure = errors.New("permission denied")
+	failuresRemaining = 1
+	_, err = inodes.ReadFile(inode, 20, buffer)
+	assert.Equal(t, failure, err)
+	assert.Equal(t, 1, readerCalls)
+
+	// and the file changing makes the inode permanently unreadable
+	failure = FILE_CHANGED
+	failuresRemaining = 1
+	_, err = inodes.ReadFile(inode, 20, buffer)
+	assert.Equal(t, FILE_CHANGED, err)
+	_, err = inodes.ReadFile(inode, 20, buffer)
+	assert.Equal(t, FILE_CHANGED, err)
+}
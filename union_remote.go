@@ -0,0 +1,120 @@
+package treeply
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// UnionRemoteProvider presents several providers as a single tree. Layers
+// are ordered from the top down: where more than one layer has an entry with
+// the same name, the upper one is used, except that directories present in
+// several layers are merged.
+type UnionRemoteProvider struct {
+	Layers []RemoteProvider
+}
+
+type UnionRemoteProviderDiagnostics struct {
+	Layers []interface{}
+}
+
+func NewUnionRemoteProvider(layers ...RemoteProvider) *UnionRemoteProvider {
+	return &UnionRemoteProvider{Layers: layers}
+}
+
+func (u *UnionRemoteProvider) GetDiagnostics() interface{} {
+	layers := make([]interface{}, len(u.Layers))
+	for i, layer := range u.Layers {
+		layers[i] = layer.GetDiagnostics()
+	}
+	return &UnionRemoteProviderDiagnostics{Layers: layers}
+}
+
+// the ETag of a file records which layer it came from, so that reads go to
+// the same layer and the layer's own ETag can still be checked
+func encodeUnionETag(layer int, etag string) string {
+	return fmt.Sprintf("%d:%s", layer, etag)
+}
+
+func decodeUnionETag(etag string) (int, string, bool) {
+	layerStr, layerETag, ok := strings.Cut(etag, ":")
+	if !ok {
+		return 0, "", false
+	}
+	layer, err := strconv.Atoi(layerStr)
+	if err != nil {
+		return 0, "", false
+	}
+	return layer, layerETag, true
+}
+
+// isMissingDirError returns true if the error means the layer has no such
+// directory, as opposed to the listing having failed
+func isMissingDirError(err error) bool {
+	return errors.Is(err, fs.ErrNotExist) || errors.Is(err, syscall.ENOTDIR) ||
+		errors.Is(err, INVALID_NAME) || errors.Is(err, IS_NOT_DIR)
+}
+
+func (u *UnionRemoteProvider) GetDirListing(ctx context.Context, path string) ([]RemoteFile, error) {
+	result := make([]RemoteFile, 0)
+	seen := make(map[string]bool)
+	var firstMissingErr error
+	found := false
+
+	for layer, provider := range u.Layers {
+		files, err := provider.GetDirListing(ctx, path)
+		if err != nil {
+			if isMissingDirError(err) {
+				if firstMissingErr == nil {
+					firstMissingErr = err
+				}
+				continue
+			}
+			return nil, err
+		}
+		found = true
+
+		for _, file := range files {
+			if seen[file.Name] {
+				// shadowed by an upper layer
+				continue
+			}
+			seen[file.Name] = true
+			if !file.IsDir {
+				file.ETag = encodeUnionETag(layer, file.ETag)
+			}
+			result = append(result, file)
+		}
+	}
+
+	if !found && firstMissingErr != nil {
+		return nil, firstMissingErr
+	}
+	return result, nil
+}
+
+func (u *UnionRemoteProvider) GetReader(ctx context.Context, path string, ETag string, Offset int64, Length int64) (io.Reader, error) {
+	layer, layerETag, ok := decodeUnionETag(ETag)
+	if !ok || layer < 0 || layer >= len(u.Layers) {
+		return nil, FILE_CHANGED
+	}
+	return u.Layers[layer].GetReader(ctx, path, layerETag, Offset, Length)
+}
+
+// GetChecksum asks the layer the file came from, if it can compute checksums
+func (u *UnionRemoteProvider) GetChecksum(ctx context.Context, path string, ETag string) (string, error) {
+	layer, layerETag, ok := decodeUnionETag(ETag)
+	if !ok || layer < 0 || layer >= len(u.Layers) {
+		return "", FILE_CHANGED
+	}
+	checksumProvider, ok := u.Layers[layer].(ChecksumProvider)
+	if !ok {
+		return "", nil
+	}
+	return checksumProvider.GetChecksum(ctx, path, layerETag)
+}
@@ -0,0 +1,119 @@
+package treeply
+
+import (
+	"context"
+	"io"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestUnionRemoteProvider(t *testing.T) {
+	lowerDir, err := os.MkdirTemp(os.TempDir(), "test")
+	if err != nil {
+		panic(err)
+	}
+	upperDir, err := os.MkdirTemp(os.TempDir(), "test")
+	if err != nil {
+		panic(err)
+	}
+
+	writeFile(lowerDir+"/f1", "lower", 1)
+	writeFile(lowerDir+"/f2", "lower", 1)
+	writeFile(lowerDir+"/d1/a", "lower", 1)
+	writeFile(lowerDir+"/d1/b", "lower", 1)
+	writeFile(lowerDir+"/shadowed/c", "lower", 1)
+	writeFile(upperDir+"/f2", "upper", 1)
+	writeFile(upperDir+"/d1/b", "upper", 1)
+	writeFile(upperDir+"/d1/c", "upper", 1)
+	writeFile(upperDir+"/d2/x", "upper", 1)
+	writeFile(upperDir+"/shadowed", "upper", 1)
+
+	ctx := context.Background()
+	union := NewUnionRemoteProvider(&DirRemoteProvider{Root: upperDir}, &DirRemoteProvider{Root: lowerDir})
+
+	files, err := union.GetDirListing(ctx, "")
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"d1/", "d2/", "f1", "f2", "shadowed"}, sortedNames(files))
+
+	files, err = union.GetDirListing(ctx, "d1")
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"a", "b", "c"}, sortedNames(files))
+
+	// directories which only exist in one layer are still found
+	files, err = union.GetDirListing(ctx, "d2")
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"x"}, sortedNames(files))
+
+	_, err = union.GetDirListing(ctx, "missing")
+	assert.True(t, os.IsNotExist(err))
+
+	readAll := func(path string, etag string) string {
+		reader, err := union.GetReader(ctx, path, etag, 0, 5)
+		assert.Nil(t, err)
+		buffer, err := io.ReadAll(reader)
+		assert.Nil(t, err)
+		return string(buffer)
+	}
+
+	etags := make(map[string]string)
+	for _, file := range files {
+		etags["d2/"+file.Name] = file.ETag
+	}
+	files, err = union.GetDirListing(ctx, "d1")
+	assert.Nil(t, err)
+	for _, file := range files {
+		etags["d1/"+file.Name] = file.ETag
+	}
+	assert.Equal(t, "lower", readAll("d1/a", etags["d1/a"]))
+	assert.Equal(t, "upper", readAll("d1/b", etags["d1/b"]))
+	assert.Equal(t, "upper", readAll("d1/c", etags["d1/c"]))
+	assert.Equal(t, "upper", readAll("d2/x", etags["d2/x"]))
+
+	// changes are still detected through the layer's own ETag
+	writeFile(upperDir+"/d1/b", "changed", 1)
+	_, err = union.GetReader(ctx, "d1/b", etags["d1/b"], 0, 5)
+	assert.Equal(t, FILE_CHANGED, err)
+
+	// as is an ETag which doesn't name a layer
+	_, err = union.GetReader(ctx, "d1/a", "garbage", 0, 5)
+	assert.Equal(t, FILE_CHANGED, err)
+	_, err = union.GetReader(ctx, "d1/a", "7:"+etags["d1/a"][2:], 0, 5)
+	assert.Equal(t, FILE_CHANGED, err)
+}
+
+func TestUnionRemoteProviderWithFileService(t *testing.T) {
+	lowerDir, err := os.MkdirTemp(os.TempDir(), "test")
+	if err != nil {
+		panic(err)
+	}
+	upperDir, err := os.MkdirTemp(os.TempDir(), "test")
+	if err != nil {
+		panic(err)
+	}
+
+	writeFile(lowerDir+"/d1/a", "lower", 1)
+	writeFile(upperDir+"/d1/a", "upper", 1)
+	writeFile(lowerDir+"/d1/b", "lower", 1)
+
+	workDir, err := os.MkdirTemp(os.TempDir(), "test")
+	if err != nil {
+		panic(err)
+	}
+
+	union := NewUnionRemoteProvider(&DirRemoteProvider{Root: upperDir}, &DirRemoteProvider{Root: lowerDir})
+	fs, err := NewFileService(union, workDir, 10000)
+	if err != nil {
+		panic(err)
+	}
+	client := NewFileClient(fs)
+
+	for path, expected := range map[string]string{"d1/a": "upper", "d1/b": "lower"} {
+		openResp, err := client.Open(&OpenReq{Path: path})
+		assert.Nil(t, err)
+		readResp, err := client.Read(&ReadReq{FD: openResp.FD, Length: 5})
+		assert.Nil(t, err)
+		assert.Equal(t, expected, string(readResp.Data))
+	}
+}